@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"essync/conf"
+	"essync/lib"
+	"fmt"
+	"math"
+	"text/template"
+	"time"
+)
+
+// alert 发给 webhook 的告警，也是 payload 模板的数据
+type alert struct {
+	Status    string     `json:"status"` // firing 或 resolved
+	Rule      string     `json:"rule"`
+	Type      string     `json:"type"`
+	Job       string     `json:"job"`
+	Target    string     `json:"target,omitempty"`
+	Value     float64    `json:"value"`
+	Threshold float64    `json:"threshold"`
+	Message   string     `json:"message"`
+	StartsAt  time.Time  `json:"starts_at"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"`
+}
+
+type alertWebhook struct {
+	name string
+	sink *lib.WebhookSink
+	tmpl *template.Template
+}
+
+type alertRule struct {
+	cfg      conf.AlertRule
+	jobs     map[string]bool // 为空时检查所有任务
+	webhooks []*alertWebhook
+}
+
+// alertState 一条规则对一个任务(或目标)的状态，sentTo 记录已经通知过的 webhook，
+// 同一告警只通知一次(按 repeat_interval 重复)，恢复时只通知收到过告警的 webhook
+type alertState struct {
+	rule         *alertRule
+	job          *syncJob
+	target       string
+	checked      time.Time // 最近一次检查的时间
+	pendingSince time.Time
+	firing       bool
+	alert        alert
+	sentTo       map[string]time.Time
+}
+
+// alertCheck 一次检查的结果
+type alertCheck struct {
+	target  string
+	active  bool
+	value   float64
+	message string
+}
+
+type errorSnapshot struct {
+	time  time.Time
+	count int64
+}
+
+type alertManager struct {
+	interval time.Duration
+	rules    []*alertRule
+	states   map[string]*alertState
+	errSnaps map[string][]errorSnapshot
+	started  time.Time
+}
+
+var alerts *alertManager
+
+func initAlerts() error {
+	cfg := yaml_conf.Alerting
+	m := &alertManager{
+		interval: time.Second * cfg.Interval,
+		states:   map[string]*alertState{},
+		errSnaps: map[string][]errorSnapshot{},
+		started:  time.Now(),
+	}
+	if m.interval <= 0 {
+		m.interval = time.Minute
+	}
+	funcs := template.FuncMap{"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	}}
+	webhooks := map[string]*alertWebhook{}
+	var all []*alertWebhook
+	for i, w := range cfg.Webhooks {
+		if w.Name == "" || w.Url == "" {
+			return fmt.Errorf("alerting.webhooks[%d]: name and url are required", i)
+		}
+		if webhooks[w.Name] != nil {
+			return fmt.Errorf("alerting.webhooks[%d]: duplicate name %q", i, w.Name)
+		}
+		hook := &alertWebhook{name: w.Name, sink: lib.NewWebhookSink(w.Url, w.Headers, time.Second*w.Timeout)}
+		if w.Template != "" {
+			tmpl, err := template.New(w.Name).Funcs(funcs).Parse(w.Template)
+			if err != nil {
+				return fmt.Errorf("alerting.webhooks[%d]: template: %v", i, err)
+			}
+			hook.tmpl = tmpl
+		}
+		webhooks[w.Name] = hook
+		all = append(all, hook)
+	}
+	names := map[string]bool{}
+	for i, rc := range cfg.Rules {
+		if rc.Name == "" {
+			return fmt.Errorf("alerting.rules[%d]: name is required", i)
+		}
+		if names[rc.Name] {
+			return fmt.Errorf("alerting.rules[%d]: duplicate name %q", i, rc.Name)
+		}
+		names[rc.Name] = true
+		switch rc.Type {
+		case "lag", "error_rate":
+			if rc.Threshold <= 0 {
+				return fmt.Errorf("alerting.rules[%d]: %s needs threshold", i, rc.Type)
+			}
+		case "job_stopped", "retention_failed":
+		default:
+			return fmt.Errorf("alerting.rules[%d]: unknown type %q", i, rc.Type)
+		}
+		if rc.Clock != "" && rc.Clock != "source" && rc.Clock != "wall" {
+			return fmt.Errorf("alerting.rules[%d]: clock must be source or wall", i)
+		}
+		r := &alertRule{cfg: rc, jobs: map[string]bool{}, webhooks: all}
+		for _, name := range rc.Jobs {
+			if findJob(name) == nil {
+				return fmt.Errorf("alerting.rules[%d]: unknown job %q", i, name)
+			}
+			r.jobs[name] = true
+		}
+		if len(rc.Webhooks) > 0 {
+			r.webhooks = nil
+			for _, name := range rc.Webhooks {
+				hook := webhooks[name]
+				if hook == nil {
+					return fmt.Errorf("alerting.rules[%d]: unknown webhook %q", i, name)
+				}
+				r.webhooks = append(r.webhooks, hook)
+			}
+		}
+		if len(r.webhooks) == 0 {
+			return fmt.Errorf("alerting.rules[%d]: no webhook to send to", i)
+		}
+		m.rules = append(m.rules, r)
+	}
+	alerts = m
+	return nil
+}
+
+func (m *alertManager) run() {
+	for {
+		m.evaluate(time.Now())
+		time.Sleep(m.interval)
+	}
+}
+
+func (m *alertManager) evaluate(now time.Time) {
+	for _, job := range jobs {
+		m.snapshotErrors(job, now)
+	}
+	for _, r := range m.rules {
+		for _, job := range jobs {
+			if len(r.jobs) > 0 && !r.jobs[job.cfg.Name] {
+				continue
+			}
+			for _, c := range m.check(r, job, now) {
+				m.update(r, job, c, now)
+			}
+		}
+	}
+	// 这一轮没有检查到的(延迟无法换算成时间、分区不在本实例、目标或任务已经去掉)按恢复处理
+	for key, st := range m.states {
+		if st.checked.Equal(now) {
+			continue
+		}
+		if st.firing {
+			name := st.job.cfg.Name
+			if st.target != "" {
+				name = st.target
+			}
+			m.update(st.rule, st.job, alertCheck{target: st.target, value: st.alert.Value,
+				message: fmt.Sprintf("%s is no longer checked", name)}, now)
+		}
+		if !st.firing {
+			delete(m.states, key)
+		}
+	}
+}
+
+// snapshotErrors 记录任务的累计错误数，error_rate 用 window 内的增量计算
+func (m *alertManager) snapshotErrors(job *syncJob, now time.Time) {
+	job.mu.Lock()
+	count := job.errorCount
+	job.mu.Unlock()
+	window := m.maxWindow()
+	snaps := append(m.errSnaps[job.cfg.Name], errorSnapshot{time: now, count: count})
+	for len(snaps) > 1 && now.Sub(snaps[1].time) >= window {
+		snaps = snaps[1:]
+	}
+	m.errSnaps[job.cfg.Name] = snaps
+}
+
+func (m *alertManager) maxWindow() time.Duration {
+	window := 5 * time.Minute
+	for _, r := range m.rules {
+		if w := time.Second * r.cfg.Window; w > window {
+			window = w
+		}
+	}
+	return window
+}
+
+func ruleWindow(r *alertRule) time.Duration {
+	if r.cfg.Window > 0 {
+		return time.Second * r.cfg.Window
+	}
+	return 5 * time.Minute
+}
+
+// check 按规则检查任务：lag 按目标，retention_failed 按写入目标，其他按任务；暂停和备用的任务不算延迟和停止
+func (m *alertManager) check(r *alertRule, job *syncJob, now time.Time) []alertCheck {
+	threshold := r.cfg.Threshold
+	paused := !job.active()
+	var checks []alertCheck
+	switch r.cfg.Type {
+	case "lag":
+		for _, in := range job.inputs {
+			// 分区不在本实例上时由持有它的实例报警
+			skip := paused || !in.owned()
+			for _, t := range in.targets {
+				t.mu.Lock()
+				measured, v := !t.lagAt.IsZero(), t.lagSec
+				if r.cfg.Clock == "wall" {
+					v = t.ageSec
+				}
+				t.mu.Unlock()
+				if !measured || v < 0 {
+					continue
+				}
+				checks = append(checks, alertCheck{
+					target:  t.key,
+					active:  !skip && v > threshold,
+					value:   v,
+					message: fmt.Sprintf("%s is %s behind", t.key, (time.Duration(v) * time.Second).String()),
+				})
+			}
+		}
+	case "error_rate":
+		snaps := m.errSnaps[job.cfg.Name]
+		window := ruleWindow(r)
+		cur := snaps[len(snaps)-1]
+		from := snaps[0]
+		for _, s := range snaps {
+			if cur.time.Sub(s.time) <= window {
+				from = s
+				break
+			}
+		}
+		rate := 0.0
+		if d := cur.time.Sub(from.time).Minutes(); d > 0 {
+			rate = float64(cur.count-from.count) / d
+		}
+		checks = append(checks, alertCheck{
+			active:  rate > threshold,
+			value:   rate,
+			message: fmt.Sprintf("%s: %.1f errors/min over the last %s", job.cfg.Name, rate, window),
+		})
+	case "job_stopped":
+		if threshold <= 0 {
+			// 没有配置时 3 个 sync_interval 且至少 5 分钟没有成功读取算停止
+			threshold = math.Max(3*float64(job.cfg.SyncInterval), 300)
+		}
+		job.mu.Lock()
+		last := job.lastRun
+		job.mu.Unlock()
+		if last.IsZero() {
+			last = m.started
+		}
+		idle := now.Sub(last).Seconds()
+		checks = append(checks, alertCheck{
+			active:  !paused && idle > threshold,
+			value:   idle,
+			message: fmt.Sprintf("%s: no successful read for %s", job.cfg.Name, now.Sub(last).Truncate(time.Second)),
+		})
+	case "retention_failed":
+		job.mu.Lock()
+		runs := append([]retentionRun(nil), job.retention...)
+		job.mu.Unlock()
+		for _, o := range job.outputs {
+			var last *retentionRun
+			for i := range runs {
+				if runs[i].Target == o.key {
+					last = &runs[i]
+				}
+			}
+			if last == nil {
+				continue
+			}
+			c := alertCheck{target: o.key, active: last.Result != "success"}
+			c.message = fmt.Sprintf("%s: %s %s", o.key, last.Kind, last.Result)
+			if last.Error != "" {
+				c.message += ": " + last.Error
+			}
+			if c.active {
+				c.value = 1
+			}
+			checks = append(checks, c)
+		}
+	}
+	return checks
+}
+
+func (m *alertManager) update(r *alertRule, job *syncJob, c alertCheck, now time.Time) {
+	key := r.cfg.Name + "/" + job.cfg.Name
+	if c.target != "" {
+		key += "/" + c.target
+	}
+	st := m.states[key]
+	if st == nil {
+		st = &alertState{rule: r, job: job, target: c.target, sentTo: map[string]time.Time{}}
+		m.states[key] = st
+	}
+	st.checked = now
+	labels := map[string]string{"rule": r.cfg.Name, "job": job.cfg.Name}
+	if c.target != "" {
+		labels["target"] = c.target
+	}
+	if c.active {
+		if st.pendingSince.IsZero() {
+			st.pendingSince = now
+		}
+		if !st.firing && now.Sub(st.pendingSince) >= time.Second*r.cfg.For {
+			st.firing = true
+			st.alert = alert{Status: "firing", Rule: r.cfg.Name, Type: r.cfg.Type, Job: job.cfg.Name, Target: c.target,
+				Threshold: r.cfg.Threshold, StartsAt: now}
+			alertLog.Info("alert firing", "rule", r.cfg.Name, "job", job.cfg.Name, "target", c.target, "value", c.value, "message", c.message)
+		}
+		if !st.firing {
+			return
+		}
+		st.alert.Status = "firing"
+		st.alert.EndsAt = nil
+		st.alert.Value = c.value
+		st.alert.Message = c.message
+		lib.MetricSet("essync_alerts_firing", labels, 1)
+		repeat := time.Second * r.cfg.RepeatInterval
+		for _, hook := range r.webhooks {
+			last, sent := st.sentTo[hook.name]
+			if sent && (repeat <= 0 || now.Sub(last) < repeat) {
+				continue
+			}
+			if m.notify(hook, st.alert) {
+				st.sentTo[hook.name] = now
+			}
+		}
+		return
+	}
+	st.pendingSince = time.Time{}
+	if !st.firing {
+		return
+	}
+	lib.MetricSet("essync_alerts_firing", labels, 0)
+	resolved := st.alert
+	resolved.Status = "resolved"
+	resolved.Value = c.value
+	resolved.Message = c.message
+	resolved.EndsAt = &now
+	for _, hook := range r.webhooks {
+		if _, sent := st.sentTo[hook.name]; !sent {
+			continue
+		}
+		// 发送失败的下一轮再发
+		if m.notify(hook, resolved) {
+			delete(st.sentTo, hook.name)
+		}
+	}
+	if len(st.sentTo) == 0 {
+		st.firing = false
+		alertLog.Info("alert resolved", "rule", r.cfg.Name, "job", job.cfg.Name, "target", c.target)
+	}
+}
+
+func (m *alertManager) notify(hook *alertWebhook, a alert) bool {
+	var body []byte
+	var err error
+	if hook.tmpl != nil {
+		var buf bytes.Buffer
+		err = hook.tmpl.Execute(&buf, a)
+		body = buf.Bytes()
+	} else {
+		body, err = json.Marshal(a)
+	}
+	if err == nil {
+		err = hook.sink.Post(body)
+	}
+	labels := map[string]string{"webhook": hook.name, "result": "success"}
+	if err != nil {
+		alertLog.Error("alert webhook", "webhook", hook.name, "rule", a.Rule, "err", err)
+		labels["result"] = "error"
+	}
+	lib.MetricAdd("essync_alert_notifications_total", labels, 1)
+	return err == nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	_ "embed"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+//go:embed web/dashboard.html
+var dashboardHtml []byte
+
+// registerJobApi 任务管理接口：查看状态、暂停、恢复、立即同步、重置同步进度，以及使用这些接口的看板。
+// 看板页面本身不带数据，不经过 auth：只配置了 token 时浏览器打开页面带不了 token，由页面请求接口时带上
+func registerJobApi(router gin.IRouter, auth gin.HandlerFunc) {
+	router.GET("/dashboard", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", dashboardHtml)
+	})
+	r := router.Group("/", auth)
+	r.GET("/jobs", func(c *gin.Context) {
+		list := make([]jobStatus, 0, len(jobs))
+		for _, job := range jobs {
+			list = append(list, job.status())
+		}
+		c.JSON(http.StatusOK, list)
+	})
+	r.GET("/leader", func(c *gin.Context) {
+		c.JSON(http.StatusOK, leaderView())
+	})
+	r.GET("/partitions", func(c *gin.Context) {
+		c.JSON(http.StatusOK, partitionsView())
+	})
+	r.GET("/jobs/:name", withJob(func(c *gin.Context, job *syncJob) {
+		c.JSON(http.StatusOK, job.status())
+	}))
+	r.GET("/jobs/:name/history", withJob(func(c *gin.Context, job *syncJob) {
+		c.JSON(http.StatusOK, job.historyView())
+	}))
+	r.POST("/jobs/:name/pause", withJob(func(c *gin.Context, job *syncJob) {
+		job.setPaused(true)
+		c.JSON(http.StatusOK, job.status())
+	}))
+	r.POST("/jobs/:name/resume", withJob(func(c *gin.Context, job *syncJob) {
+		job.setPaused(false)
+		c.JSON(http.StatusOK, job.status())
+	}))
+	r.POST("/jobs/:name/run-now", withJob(func(c *gin.Context, job *syncJob) {
+		if err := job.runNow(); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, job.status())
+	}))
+	r.POST("/jobs/:name/reset-checkpoint", withJob(func(c *gin.Context, job *syncJob) {
+		if err := job.resetCheckpoints(); err != nil {
+			code := http.StatusInternalServerError
+			if err == errNotPaused {
+				code = http.StatusConflict
+			}
+			c.JSON(code, gin.H{"error": err.Error()})
+			return
+		}
+		apiLog.Info("checkpoint reset", "job", job.cfg.Name, "client", c.ClientIP())
+		c.JSON(http.StatusOK, job.status())
+	}))
+}
+
+func withJob(h func(c *gin.Context, job *syncJob)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job := findJob(c.Param("name"))
+		if job == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "job not found: " + c.Param("name")})
+			return
+		}
+		h(c, job)
+	}
+}
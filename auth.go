@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"essync/conf"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/phachon/go-logger"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// 管理接口的角色：read 只能查看，admin 可以暂停、恢复、重置进度等
+const (
+	roleRead  = "read"
+	roleAdmin = "admin"
+)
+
+var auditLogger = go_logger.NewLogger()
+
+type adminPrincipal struct {
+	name   string
+	method string // token、basic、mtls 或 none
+	role   string
+}
+
+type adminToken struct {
+	principal adminPrincipal
+	token     []byte
+}
+
+// adminAuth 管理接口的认证：bearer token、basic(bcrypt)和客户端证书，都没配置时不校验，按 anonymous_role(默认 read)处理
+type adminAuth struct {
+	tokens        []adminToken
+	users         map[string]conf.AdminUser
+	clientRoles   map[string]string
+	mtls          bool
+	anonymousRole string
+}
+
+// csrfHeader basic、客户端证书和不认证时浏览器会自动带上凭据，修改类的请求要求带这个头：
+// 跨站的表单和简单请求带不了自定义头，看板的 fetch 会带上
+const csrfHeader = "X-Requested-With"
+
+func checkRole(role string) (string, error) {
+	switch role {
+	case "":
+		return roleRead, nil
+	case roleRead, roleAdmin:
+		return role, nil
+	}
+	return "", fmt.Errorf("unknown role %q, want read or admin", role)
+}
+
+func newAdminAuth(cfg conf.Admin) (*adminAuth, error) {
+	a := &adminAuth{users: map[string]conf.AdminUser{}, clientRoles: map[string]string{}, mtls: cfg.Tls.ClientCaFile != ""}
+	var err error
+	if a.anonymousRole, err = checkRole(cfg.AnonymousRole); err != nil {
+		return nil, fmt.Errorf("admin.anonymous_role: %v", err)
+	}
+	for i, t := range cfg.Tokens {
+		token := t.Token
+		if t.TokenFile != "" {
+			b, err := ioutil.ReadFile(t.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("admin.tokens[%d]: %v", i, err)
+			}
+			token = strings.TrimSpace(string(b))
+		}
+		if token == "" {
+			return nil, fmt.Errorf("admin.tokens[%d]: token or token_file is required", i)
+		}
+		role, err := checkRole(t.Role)
+		if err != nil {
+			return nil, fmt.Errorf("admin.tokens[%d]: %v", i, err)
+		}
+		name := t.Name
+		if name == "" {
+			name = fmt.Sprintf("token%d", i)
+		}
+		a.tokens = append(a.tokens, adminToken{principal: adminPrincipal{name: name, method: "token", role: role}, token: []byte(token)})
+	}
+	for i, u := range cfg.Users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("admin.users[%d]: name is required", i)
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("admin.users[%d]: password_hash: %v", i, err)
+		}
+		role, err := checkRole(u.Role)
+		if err != nil {
+			return nil, fmt.Errorf("admin.users[%d]: %v", i, err)
+		}
+		u.Role = role
+		a.users[u.Name] = u
+	}
+	for cn, r := range cfg.Tls.ClientRoles {
+		role, err := checkRole(r)
+		if err != nil {
+			return nil, fmt.Errorf("admin.tls.client_roles[%s]: %v", cn, err)
+		}
+		a.clientRoles[cn] = role
+	}
+	return a, nil
+}
+
+func (a *adminAuth) enabled() bool {
+	return len(a.tokens) > 0 || len(a.users) > 0 || a.mtls
+}
+
+func (a *adminAuth) authenticate(r *http.Request) (adminPrincipal, error) {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		token := []byte(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare(token, t.token) == 1 {
+				return t.principal, nil
+			}
+		}
+		return adminPrincipal{}, errors.New("invalid token")
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		u, found := a.users[name]
+		if !found || bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+			return adminPrincipal{name: name}, errors.New("invalid user or password")
+		}
+		return adminPrincipal{name: name, method: "basic", role: u.Role}, nil
+	}
+	// 客户端证书已由 tls 校验过，这里只按 CN 取角色
+	if a.mtls && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.PeerCertificates[0].Subject.CommonName
+		role, found := a.clientRoles[cn]
+		if !found {
+			role = roleRead
+		}
+		return adminPrincipal{name: cn, method: "mtls", role: role}, nil
+	}
+	return adminPrincipal{}, errors.New("authentication required")
+}
+
+// middleware 认证并检查角色，GET/HEAD 需要 read，其他方法需要 admin；修改类的请求都写审计日志
+func (a *adminAuth) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mutating := c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead
+		p := adminPrincipal{name: "anonymous", method: "none", role: a.anonymousRole}
+		if a.enabled() {
+			var err error
+			p, err = a.authenticate(c.Request)
+			if err != nil {
+				// 没有配置用户时不要让浏览器弹出 basic 登录框，看板自己提示输入 token
+				if len(a.users) > 0 {
+					c.Header("WWW-Authenticate", `Basic realm="essync"`)
+				} else {
+					c.Header("WWW-Authenticate", `Bearer realm="essync"`)
+				}
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				if mutating {
+					audit(c, p, err.Error())
+				}
+				return
+			}
+		}
+		if mutating && p.role != roleAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "role " + p.role + " cannot " + c.Request.Method})
+			audit(c, p, "forbidden")
+			return
+		}
+		if mutating && p.method != "token" && c.GetHeader(csrfHeader) == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": csrfHeader + " header is required"})
+			audit(c, p, "missing "+csrfHeader)
+			return
+		}
+		c.Next()
+		if mutating {
+			audit(c, p, "")
+		}
+	}
+}
+
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user,omitempty"`
+	Auth   string    `json:"auth,omitempty"`
+	Role   string    `json:"role,omitempty"`
+	Remote string    `json:"remote"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Status int       `json:"status"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func audit(c *gin.Context, p adminPrincipal, reason string) {
+	b, err := json.Marshal(auditEntry{
+		Time:   time.Now(),
+		User:   p.name,
+		Auth:   p.method,
+		Role:   p.role,
+		Remote: c.ClientIP(),
+		Method: c.Request.Method,
+		Path:   c.Request.URL.Path,
+		Status: c.Writer.Status(),
+		Error:  reason,
+	})
+	if err != nil {
+		apiLog.Error("audit", "err", err)
+		return
+	}
+	auditLogger.Info(string(b))
+}
+
+func initAuditLogger(cfg conf.Admin) {
+	auditLogger.Detach("console")
+	file := cfg.AuditLog
+	if file == "" {
+		file = yaml_conf.LogDir + "essync_audit.log"
+	}
+	fileConfig := logFileConfig()
+	fileConfig.Filename = file
+	fileConfig.Format = "%body%"
+	if err := auditLogger.Attach("file", go_logger.LOGGER_LEVEL_INFO, fileConfig); err != nil {
+		apiLog.Error("audit log", "file", file, "err", err)
+	}
+}
+
+// adminTlsConfig 管理接口的 https 配置；配置了 client_ca_file 时校验客户端证书，
+// 同时配置了 token 或用户时证书是可选的
+func adminTlsConfig(cfg conf.Admin) (*tls.Config, error) {
+	t := cfg.Tls
+	if t.CertFile == "" && t.KeyFile == "" {
+		if t.ClientCaFile != "" {
+			return nil, errors.New("admin.tls: client_ca_file needs cert_file and key_file")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if t.ClientCaFile != "" {
+		pem, err := ioutil.ReadFile(t.ClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("admin.tls: no certificate in " + t.ClientCaFile)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+		if len(cfg.Tokens) > 0 || len(cfg.Users) > 0 {
+			tc.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return tc, nil
+}
+
+// runPasswd 处理 essync passwd：从标准输入读密码，输出 admin.users 用的 bcrypt hash
+func runPasswd() {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintln(os.Stderr, "passwd: "+err.Error())
+		os.Exit(1)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(line, "\r\n")), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "passwd: "+err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(string(hash))
+}
@@ -1,6 +1,10 @@
 package conf
 
-import "time"
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"time"
+)
 
 type HttpConfig struct {
 	MaxIdleConns          int           `yaml:"MaxIdleConns"`
@@ -30,20 +34,438 @@ type TargetEs struct {
 	HttpConfig HttpConfig `yaml:"http_config"`
 }
 
-type EsConfig struct {
+type DeleteByQuery struct {
+	WaitForCompletion bool          `yaml:"wait_for_completion"`
+	Slices            string        `yaml:"slices"`
+	RequestsPerSecond int           `yaml:"requests_per_second"`
+	Conflicts         string        `yaml:"conflicts"`
+	PollInterval      time.Duration `yaml:"poll_interval"`
+}
+
+type Archive struct {
+	Enabled    bool   `yaml:"enabled"`
+	Dir        string `yaml:"dir"`
+	ScrollSize int    `yaml:"scroll_size"`
+}
+
+// Health /livez 和 /readyz 的参数
+type Health struct {
+	LiveIntervals int           `yaml:"live_intervals"`
+	Timeout       time.Duration `yaml:"timeout"`
+}
+
+// Log 日志格式(text、json、logfmt)、级别和文件切分。levels 按组件覆盖 level，
+// 组件有 main、sync、retention、api、alert、audit、es、service、import、export、leader、shard；max_size 单位 MB
+type Log struct {
+	Format    string            `yaml:"format"`
+	Level     string            `yaml:"level"`
+	Levels    map[string]string `yaml:"levels"`
+	Console   *bool             `yaml:"console"`
+	MaxSize   int64             `yaml:"max_size"`
+	MaxLine   int64             `yaml:"max_line"`
+	DateSlice string            `yaml:"date_slice"`
+}
+
+// Dashboard 看板每隔 sample_interval 秒记录一次延迟和吞吐，保留 history_hours 小时
+type Dashboard struct {
+	SampleInterval time.Duration `yaml:"sample_interval"`
+	HistoryHours   int           `yaml:"history_hours"`
+}
+
+// Alerting 告警：每 interval 秒检查一次 rules，触发和恢复时发到 webhooks
+type Alerting struct {
+	Interval time.Duration  `yaml:"interval"`
+	Webhooks []AlertWebhook `yaml:"webhooks"`
+	Rules    []AlertRule    `yaml:"rules"`
+}
+
+// AlertWebhook template 为 text/template，为空时发送告警本身的 json
+type AlertWebhook struct {
+	Name     string            `yaml:"name"`
+	Url      string            `yaml:"url"`
+	Headers  map[string]string `yaml:"headers"`
+	Template string            `yaml:"template"`
+	Timeout  time.Duration     `yaml:"timeout"`
+}
+
+// AlertRule type：lag、error_rate、job_stopped、retention_failed，threshold 的单位见 config.yaml
+type AlertRule struct {
+	Name           string        `yaml:"name"`
+	Type           string        `yaml:"type"`
+	Jobs           []string      `yaml:"jobs"`
+	Threshold      float64       `yaml:"threshold"`
+	Clock          string        `yaml:"clock"`
+	Window         time.Duration `yaml:"window"`
+	For            time.Duration `yaml:"for"`
+	RepeatInterval time.Duration `yaml:"repeat_interval"`
+	Webhooks       []string      `yaml:"webhooks"`
+}
+
+// AuditIndex 同步记录索引：每批写入和每次清理写一条文档，默认写到顶层 target_es，
+// 每 flush_interval 秒或攒够 batch_size 条批量写入，超过 keep_day 天的记录每 clear_interval 秒清理一次
+type AuditIndex struct {
+	Enabled       bool          `yaml:"enabled"`
+	Index         string        `yaml:"index"`
+	TargetEs      TargetEs      `yaml:"target_es"`
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	KeepDay       int           `yaml:"keep_day"`
+	ClearInterval time.Duration `yaml:"clear_interval"`
+}
+
+// Tracing OpenTelemetry：exporter 为 otlp(http，endpoint 默认 localhost:4318)或 file(每行一个 span 的 json)，
+// 为空时不记录；sample_ratio 为 0 到 1 的采样比例，默认全部记录
+type Tracing struct {
+	Exporter    string            `yaml:"exporter"`
+	Endpoint    string            `yaml:"endpoint"`
+	UrlPath     string            `yaml:"url_path"`
+	Insecure    bool              `yaml:"insecure"`
+	Headers     map[string]string `yaml:"headers"`
+	File        string            `yaml:"file"`
+	ServiceName string            `yaml:"service_name"`
+	SampleRatio float64           `yaml:"sample_ratio"`
+}
+
+// LeaderElection 主备：多个实例通过 index 索引里名为 lease 的租约文档选出 leader，只有 leader 同步和清理。
+// leader 每 renew_interval 秒续约，租约 ttl 秒没有变化时备用实例接管；开启后同步进度也保存在这个索引里
+type LeaderElection struct {
+	Enabled       bool          `yaml:"enabled"`
+	Index         string        `yaml:"index"`
+	Lease         string        `yaml:"lease"`
+	Identity      string        `yaml:"identity"`
+	Ttl           time.Duration `yaml:"ttl"`
+	RenewInterval time.Duration `yaml:"renew_interval"`
+	TargetEs      TargetEs      `yaml:"target_es"`
+}
+
+// Sharding 多个实例分担分区任务：每个分区任务在 index 索引里有一个协调文档，记录存活的实例和每个分区的持有者。
+// 实例每 heartbeat_interval 秒更新心跳，ttl 秒没有变化的实例被移除；实例加入或离开时分区重新分配
+type Sharding struct {
+	Enabled           bool          `yaml:"enabled"`
+	Index             string        `yaml:"index"`
+	Identity          string        `yaml:"identity"`
+	Ttl               time.Duration `yaml:"ttl"`
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	TargetEs          TargetEs      `yaml:"target_es"`
+}
+
+// Admin 管理接口(/jobs 等)的监听地址和认证，不配置认证时不校验
+type Admin struct {
+	Address       string       `yaml:"address"`
+	Tokens        []AdminToken `yaml:"tokens"`
+	Users         []AdminUser  `yaml:"users"`
+	Tls           AdminTls     `yaml:"tls"`
+	AuditLog      string       `yaml:"audit_log"`
+	AnonymousRole string       `yaml:"anonymous_role"`
+}
+
+type AdminToken struct {
+	Name      string `yaml:"name"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	Role      string `yaml:"role"`
+}
+
+// AdminUser basic 认证用户，password_hash 为 bcrypt，可以用 essync passwd 生成
+type AdminUser struct {
+	Name         string `yaml:"name"`
+	PasswordHash string `yaml:"password_hash"`
+	Role         string `yaml:"role"`
+}
+
+// AdminTls 管理接口的 https 和客户端证书认证，client_roles 按证书 CN 指定角色
+type AdminTls struct {
+	CertFile     string            `yaml:"cert_file"`
+	KeyFile      string            `yaml:"key_file"`
+	ClientCaFile string            `yaml:"client_ca_file"`
+	ClientRoles  map[string]string `yaml:"client_roles"`
+}
+
+type Transform struct {
+	Type         string      `yaml:"type"`
+	Field        string      `yaml:"field"`
+	To           string      `yaml:"to"`
+	Value        interface{} `yaml:"value"`
+	MaxDepth     int         `yaml:"max_depth"`
+	MaxBytes     int         `yaml:"max_bytes"`
+	Flatten      bool        `yaml:"flatten"`
+	FailureField string      `yaml:"failure_field"`
+	Method       string      `yaml:"method"`
+	KeyFile      string      `yaml:"key_file"`
+	Pattern      string      `yaml:"pattern"`
+	Replacement  string      `yaml:"replacement"`
+	KeepStart    int         `yaml:"keep_start"`
+	KeepEnd      int         `yaml:"keep_end"`
+	MaskChar     string      `yaml:"mask_char"`
+	Name         string      `yaml:"name"`
+	Script       string      `yaml:"script"`
+	ScriptFile   string      `yaml:"script_file"`
+	Timeout      int         `yaml:"timeout"` // script 每条文档的执行时间，单位毫秒(其他 timeout 都是秒)
+}
+
+type SinkColumn struct {
+	Field  string `yaml:"field"`
+	Column string `yaml:"column"`
+	Type   string `yaml:"type"`
+}
+
+type Sink struct {
+	Type                string            `yaml:"type"`
+	WriteMode           string            `yaml:"write_mode"`
+	Dir                 string            `yaml:"dir"`
+	Prefix              string            `yaml:"prefix"`
+	Gzip                bool              `yaml:"gzip"`
+	MaxDocs             int64             `yaml:"max_docs"`
+	MaxBytes            int64             `yaml:"max_bytes"`
+	Url                 string            `yaml:"url"`
+	Headers             map[string]string `yaml:"headers"`
+	Timeout             time.Duration     `yaml:"timeout"`
+	Routing             string            `yaml:"routing"`
+	RoutingField        string            `yaml:"routing_field"`
+	Pipeline            string            `yaml:"pipeline"`
+	Refresh             string            `yaml:"refresh"`
+	WaitForActiveShards string            `yaml:"wait_for_active_shards"`
+	Path                string            `yaml:"path"`
+	Table               string            `yaml:"table"`
+	Columns             []SinkColumn      `yaml:"columns"`
+	JsonColumn          bool              `yaml:"json_column"`
+}
+
+// DocId 写入目标的 _id：source 沿用来源 _id(默认)，template 按模板拼字段如 "{appId}-{callDate}"，
+// hash 对 fields(为空时整条文档)做 sha256 用于去重，auto 由 elasticsearch 生成
+type DocId struct {
+	Strategy string   `yaml:"strategy"`
+	Template string   `yaml:"template"`
+	Fields   []string `yaml:"fields"`
+}
+
+// Target 扇出的一个写入目标，target_es、sink 和 doc_id 里没写的字段沿用任务的值，
+// transforms 在任务的 transforms 之后执行，buffer 是最多缓冲的批次数
+type Target struct {
+	Name       string      `yaml:"name"`
+	TargetEs   TargetEs    `yaml:"target_es"`
+	Sink       Sink        `yaml:"sink"`
+	Transforms []Transform `yaml:"transforms"`
+	DocId      DocId       `yaml:"doc_id"`
+	Buffer     int         `yaml:"buffer"`
+}
+
+// Sample 按 percent 百分比抽样，by 为 _id(默认) 或字段路径，按哈希选择，同一条文档每次结果一样
+type Sample struct {
+	Percent float64 `yaml:"percent"`
+	By      string  `yaml:"by"`
+}
+
+// Partition 把 elasticsearch 来源分成多个分区并行读取，每个分区有自己的同步进度：
+// by 为 shard 时每个主分片一个分区，id_hash 时按 _id 哈希(point in time 的 slice)分成 count 份；by 为空不分区
+type Partition struct {
+	By    string `yaml:"by"`
+	Count int    `yaml:"count"`
+}
+
+// Input 扇入的一个来源，source_es 和 source 里没写的字段沿用任务的值
+type Input struct {
+	Name     string   `yaml:"name"`
+	SourceEs SourceEs `yaml:"source_es"`
+	Source   Source   `yaml:"source"`
+}
+
+// Provenance 扇入时标记文档来源：field 里写来源名、集群名和索引，
+// keep_id 为 false 时 _id 前加 "来源名:" 避免不同来源的 id 冲突
+type Provenance struct {
+	Field  string `yaml:"field"`
+	KeepId bool   `yaml:"keep_id"`
+}
+
+// Source 读取来源，elasticsearch(默认，读 source_es) 或 file(跟踪 NDJSON 日志文件)
+type Source struct {
+	Type          string `yaml:"type"`
+	Path          string `yaml:"path"`
+	IdField       string `yaml:"id_field"`
+	StartPosition string `yaml:"start_position"`
+}
+
+// JobConfig 一个同步任务的配置，顶层的这些字段就是默认任务，jobs 里的任务在其基础上覆盖
+type JobConfig struct {
 	SourceEs      SourceEs      `yaml:"source_es"`
 	TargetEs      TargetEs      `yaml:"target_es"`
+	Source        Source        `yaml:"source"`
+	Sources       []Input       `yaml:"sources"`
+	Provenance    Provenance    `yaml:"provenance"`
+	Sink          Sink          `yaml:"sink"`
+	Targets       []Target      `yaml:"targets"`
 	SortField     string        `yaml:"sort_field"`
 	SortFieldType string        `yaml:"sort_field_type"`
 	DateField     string        `yaml:"date_field"`
 	DateFieldType string        `yaml:"date_field_type"`
 	SyncInterval  time.Duration `yaml:"sync_interval"`
 	ClearInterval time.Duration `yaml:"clear_interval"`
+	DeleteByQuery DeleteByQuery `yaml:"delete_by_query"`
+	Archive       Archive       `yaml:"archive"`
 	SyncCount     int           `yaml:"sync_count"`
+	Transforms    []Transform   `yaml:"transforms"`
+	DocId         DocId         `yaml:"doc_id"`
+	Sample        Sample        `yaml:"sample"`
+	MaxDocsPerSec float64       `yaml:"max_docs_per_second"`
 	LogKeepDay    int           `yaml:"log_keep_day"`
-	HttpPort      int           `yaml:"http_port"`
-	TcpPort       int           `yaml:"tcp_port"`
-	LogDir        string        `yaml:"log_dir"`
-	Daemon        bool          `yaml:"daemon"`
-	PidFile       string        `yaml:"pid_file"`
+	Partition     Partition     `yaml:"partition"`
+}
+
+type Job struct {
+	Name      string `yaml:"name"`
+	JobConfig `yaml:",inline"`
+}
+
+type EsConfig struct {
+	JobConfig      `yaml:",inline"`
+	Jobs           []Job          `yaml:"-"`
+	HttpPort       int            `yaml:"http_port"`
+	TcpPort        int            `yaml:"tcp_port"`
+	LogDir         string         `yaml:"log_dir"`
+	CheckpointDir  string         `yaml:"checkpoint_dir"`
+	Daemon         bool           `yaml:"daemon"`
+	PidFile        string         `yaml:"pid_file"`
+	Health         Health         `yaml:"health"`
+	Admin          Admin          `yaml:"admin"`
+	Dashboard      Dashboard      `yaml:"dashboard"`
+	Alerting       Alerting       `yaml:"alerting"`
+	Log            Log            `yaml:"log"`
+	AuditIndex     AuditIndex     `yaml:"audit_index"`
+	Tracing        Tracing        `yaml:"tracing"`
+	LeaderElection LeaderElection `yaml:"leader_election"`
+	Sharding       Sharding       `yaml:"sharding"`
+}
+
+// LoadConfig parses the yaml config. Without a jobs list the top level is the single job "default";
+// otherwise every entry of jobs starts from the top level values and overrides what it sets.
+func LoadConfig(data []byte) (EsConfig, error) {
+	var c EsConfig
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return c, err
+	}
+	var raw struct {
+		Jobs []yaml.MapSlice `yaml:"jobs"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return c, err
+	}
+	if c.CheckpointDir == "" {
+		c.CheckpointDir = c.LogDir
+	}
+	top, err := rawListsOf(data)
+	if err != nil {
+		return c, err
+	}
+	if len(raw.Jobs) == 0 {
+		job := Job{Name: "default", JobConfig: c.JobConfig}
+		if err := resolveLists(&job.JobConfig, top); err != nil {
+			return c, err
+		}
+		c.Jobs = []Job{job}
+		return c, nil
+	}
+	names := map[string]bool{}
+	for i, m := range raw.Jobs {
+		job := Job{JobConfig: c.JobConfig}
+		job.Sink.Headers = copyMap(c.Sink.Headers)
+		b, err := yaml.Marshal(m)
+		if err != nil {
+			return c, err
+		}
+		if err := yaml.Unmarshal(b, &job); err != nil {
+			return c, fmt.Errorf("jobs[%d]: %v", i, err)
+		}
+		lists, err := rawListsOf(b)
+		if err != nil {
+			return c, err
+		}
+		if lists.Targets == nil {
+			lists.Targets = top.Targets
+		}
+		if lists.Sources == nil {
+			lists.Sources = top.Sources
+		}
+		if err := resolveLists(&job.JobConfig, lists); err != nil {
+			return c, fmt.Errorf("jobs[%d]: %v", i, err)
+		}
+		if job.Name == "" {
+			return c, fmt.Errorf("jobs[%d]: name is required", i)
+		}
+		if names[job.Name] {
+			return c, fmt.Errorf("jobs[%d]: duplicate name %q", i, job.Name)
+		}
+		names[job.Name] = true
+		c.Jobs = append(c.Jobs, job)
+	}
+	return c, nil
+}
+
+// rawLists targets 和 sources 的原始内容，用来让每一项在任务配置的基础上覆盖
+type rawLists struct {
+	Targets []yaml.MapSlice `yaml:"targets"`
+	Sources []yaml.MapSlice `yaml:"sources"`
+}
+
+func rawListsOf(data []byte) (rawLists, error) {
+	var raw rawLists
+	err := yaml.Unmarshal(data, &raw)
+	return raw, err
+}
+
+// overlay 把 m 里写了的字段覆盖到 out 上
+func overlay(m yaml.MapSlice, out interface{}) error {
+	b, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(b, out)
+}
+
+// resolveLists 每个目标从任务的 target_es、sink 开始，每个来源从任务的 source_es、source 开始，再覆盖自己写的字段
+func resolveLists(job *JobConfig, raw rawLists) error {
+	job.Targets = nil
+	names := map[string]bool{}
+	for i, m := range raw.Targets {
+		t := Target{TargetEs: job.TargetEs, Sink: job.Sink, DocId: job.DocId}
+		t.Sink.Headers = copyMap(job.Sink.Headers)
+		if err := overlay(m, &t); err != nil {
+			return fmt.Errorf("targets[%d]: %v", i, err)
+		}
+		if t.Name == "" {
+			return fmt.Errorf("targets[%d]: name is required", i)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("targets[%d]: duplicate name %q", i, t.Name)
+		}
+		names[t.Name] = true
+		job.Targets = append(job.Targets, t)
+	}
+	job.Sources = nil
+	names = map[string]bool{}
+	for i, m := range raw.Sources {
+		in := Input{SourceEs: job.SourceEs, Source: job.Source}
+		if err := overlay(m, &in); err != nil {
+			return fmt.Errorf("sources[%d]: %v", i, err)
+		}
+		if in.Name == "" {
+			return fmt.Errorf("sources[%d]: name is required", i)
+		}
+		if names[in.Name] {
+			return fmt.Errorf("sources[%d]: duplicate name %q", i, in.Name)
+		}
+		names[in.Name] = true
+		job.Sources = append(job.Sources, in)
+	}
+	return nil
+}
+
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
 }
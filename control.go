@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"essync/lib"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var errNotPaused = errors.New("job must be paused first")
+
+func (j *syncJob) isPaused() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.paused
+}
+
+// active 任务是否在本实例上运行：没有暂停，开启选主时本实例是 leader，开启 sharding 时本实例至少持有一个分区
+func (j *syncJob) active() bool {
+	return !j.isPaused() && isLeader() && j.parts.ownsAny()
+}
+
+// running 来源是否在本实例上同步：任务在运行，并且来源所在的分区由本实例持有
+func (j *syncJob) running(in *jobInput) bool {
+	return j.active() && in.owned()
+}
+
+// setPaused 暂停或恢复任务，恢复时唤醒等待中的读取和追赶
+func (j *syncJob) setPaused(paused bool) {
+	j.mu.Lock()
+	changed := j.paused != paused
+	j.paused = paused
+	j.mu.Unlock()
+	if changed {
+		j.log.Info("paused", "paused", paused)
+	}
+	if !paused {
+		j.wakeAll()
+	}
+}
+
+// wakeChan 返回当前的唤醒通道，wakeAll 关闭它来唤醒所有等待者
+func (j *syncJob) wakeChan() chan struct{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.wake
+}
+
+func (j *syncJob) wakeAll() {
+	j.mu.Lock()
+	close(j.wake)
+	j.wake = make(chan struct{})
+	j.mu.Unlock()
+}
+
+// runNow 不等 sync_interval 立即同步一轮，暂停中的任务不能执行
+func (j *syncJob) runNow() error {
+	if j.isPaused() {
+		return errors.New("job is paused")
+	}
+	j.wakeAll()
+	return nil
+}
+
+// idle 读取循环两轮之间的等待：等 d 或被唤醒，暂停、备用或分区不在本实例时一直等到恢复；
+// 收到重置进度的请求时返回，由读取循环处理
+func (j *syncJob) idle(in *jobInput, d time.Duration) chan error {
+	for {
+		wake := j.wakeChan()
+		if !j.running(in) {
+			select {
+			case reply := <-in.reset:
+				return reply
+			case <-wake:
+			}
+			continue
+		}
+		if d <= 0 {
+			select {
+			case reply := <-in.reset:
+				return reply
+			default:
+				return nil
+			}
+		}
+		timer := time.NewTimer(d)
+		select {
+		case reply := <-in.reset:
+			timer.Stop()
+			return reply
+		case <-wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+		return nil
+	}
+}
+
+// initPositions 从第一个目标的进度开始读，进度不同的目标先自己追赶
+func (j *syncJob) initPositions(in *jobInput) (lib.Checkpoint, bool) {
+	pos := in.targets[0].checkpoint()
+	for _, t := range in.targets[1:] {
+		t.mu.Lock()
+		t.behind = !t.cp.Equal(pos)
+		t.caughtUp = false
+		t.mu.Unlock()
+	}
+	return pos, true
+}
+
+// resetCheckpoints 把任务所有来源、目标的进度重置到开始位置(log_keep_day 之前)，任务需先暂停
+func (j *syncJob) resetCheckpoints() error {
+	if !j.isPaused() {
+		return errNotPaused
+	}
+	for _, in := range j.inputs {
+		reply := make(chan error, 1)
+		select {
+		case in.reset <- reply:
+		case <-time.After(time.Minute):
+			return fmt.Errorf("input %s: reader busy", in.key)
+		}
+		if err := <-reply; err != nil {
+			return fmt.Errorf("input %s: %v", in.key, err)
+		}
+	}
+	return nil
+}
+
+// resetInput 在来源的读取循环里执行：丢弃缓冲的批次，正在写的批次不再保存进度
+func (j *syncJob) resetInput(in *jobInput) error {
+	if !in.owned() {
+		// 分区由其他实例同步，进度在那个实例上重置
+		return nil
+	}
+	var firstErr error
+	for _, t := range in.targets {
+		cp := j.defaultCheckpoint()
+		t.restart(cp)
+		// 保存开始位置而不是删除，避免重启后又从 Sink 里推算出旧的进度
+		if err := checkpoints.Set(t.key, cp); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		t.log.Info("checkpoint reset")
+		lib.MetricAdd("essync_checkpoint_reset_total", t.labels(j), 1)
+	}
+	return firstErr
+}
+
+// reloadInput 成为 leader 或认领分区时在读取循环里执行：之前的实例可能已经往前同步了，从保存的进度重新开始
+func (j *syncJob) reloadInput(in *jobInput) {
+	for _, t := range in.targets {
+		t.restart(j.startCheckpoint(t))
+	}
+	in.log.Info("checkpoints reloaded", "term", in.term())
+}
+
+// restart 丢弃缓冲的批次，从 cp 重新开始
+func (t *jobTarget) restart(cp lib.Checkpoint) {
+	for len(t.queue) > 0 {
+		<-t.queue
+	}
+	t.mu.Lock()
+	t.gen++
+	t.cp = cp
+	t.behind = false
+	t.caughtUp = false
+	t.mu.Unlock()
+}
+
+// recordRun 记录最近一次成功读取来源的时间
+func (j *syncJob) recordRun() {
+	j.mu.Lock()
+	j.lastRun = time.Now()
+	j.mu.Unlock()
+}
+
+func (j *syncJob) recordError(key string, err error) {
+	j.mu.Lock()
+	j.lastError = key + ": " + err.Error()
+	j.lastErrorAt = time.Now()
+	j.errorCount++
+	j.recentErrors = append(j.recentErrors, jobError{Time: j.lastErrorAt, Key: key, Error: err.Error()})
+	if len(j.recentErrors) > recentSize {
+		j.recentErrors = j.recentErrors[1:]
+	}
+	j.mu.Unlock()
+}
+
+type jobStatus struct {
+	Name             string         `json:"name"`
+	State            string         `json:"state"`
+	Paused           bool           `json:"paused"`
+	LastRun          *time.Time     `json:"last_run"`
+	LastError        string         `json:"last_error,omitempty"`
+	LastErrorAt      *time.Time     `json:"last_error_at,omitempty"`
+	DocsSynced       int64          `json:"docs_synced"`
+	SyncInterval     int64          `json:"sync_interval"`
+	MaxDocsPerSecond float64        `json:"max_docs_per_second,omitempty"`
+	Sample           *sampleStatus  `json:"sample,omitempty"`
+	Targets          []targetStatus `json:"targets"`
+}
+
+type sampleStatus struct {
+	Percent float64 `json:"percent"`
+	By      string  `json:"by"`
+	Kept    int64   `json:"kept"`
+	Dropped int64   `json:"dropped"`
+}
+
+type targetStatus struct {
+	Source          string         `json:"source,omitempty"`
+	Target          string         `json:"target,omitempty"`
+	Partition       *int           `json:"partition,omitempty"`
+	Owner           string         `json:"owner,omitempty"` // 开启 sharding 时分区的持有者
+	Key             string         `json:"key"`
+	Checkpoint      lib.Checkpoint `json:"checkpoint"`
+	DocsSynced      int64          `json:"docs_synced"`
+	Lag             lib.Lag        `json:"lag"`
+	LagAt           *time.Time     `json:"lag_at,omitempty"`
+	LagSeconds      float64        `json:"lag_seconds"`
+	AgeSeconds      float64        `json:"checkpoint_age_seconds"`
+	Behind          bool           `json:"behind"`
+	RateLimit       float64        `json:"rate_limit,omitempty"`                // max_docs_per_second，多个来源写同一个目标时共用
+	RateLimitWaited float64        `json:"rate_limit_waited_seconds,omitempty"` // 限速累计等待的秒数
+}
+
+// status 任务当前状态：paused 暂停，standby 本实例不是 leader 或没有持有分区，error 最近一轮出错，degraded 有目标脱离扇出在追赶，否则 running
+func (j *syncJob) status() jobStatus {
+	j.mu.Lock()
+	s := jobStatus{
+		Name:             j.cfg.Name,
+		Paused:           j.paused,
+		LastRun:          timePtr(j.lastRun),
+		LastError:        j.lastError,
+		LastErrorAt:      timePtr(j.lastErrorAt),
+		SyncInterval:     int64(j.cfg.SyncInterval),
+		MaxDocsPerSecond: j.cfg.MaxDocsPerSec,
+	}
+	lastRun, lastErrorAt := j.lastRun, j.lastErrorAt
+	j.mu.Unlock()
+	if j.sampler != nil {
+		kept, dropped := j.sampler.Counts()
+		s.Sample = &sampleStatus{Percent: j.sampler.Percent, By: j.sampler.By, Kept: kept, Dropped: dropped}
+	}
+	behind := false
+	for _, in := range j.inputs {
+		var partition *int
+		var owner string
+		if in.parts != nil {
+			partition, owner = &in.partition, in.parts.owner(in.partition)
+		}
+		for _, t := range in.targets {
+			t.mu.Lock()
+			ts := targetStatus{
+				Source:     in.name,
+				Target:     t.out.name,
+				Partition:  partition,
+				Owner:      owner,
+				Key:        t.key,
+				Checkpoint: t.cp,
+				DocsSynced: atomic.LoadInt64(&t.synced),
+				Lag:        t.lag,
+				LagAt:      timePtr(t.lagAt),
+				LagSeconds: t.lagSec,
+				AgeSeconds: t.ageSec,
+				Behind:     t.behind,
+			}
+			t.mu.Unlock()
+			if l := t.out.limiter; l != nil {
+				ts.RateLimit = l.Rate
+				ts.RateLimitWaited = l.Waited().Seconds()
+			}
+			behind = behind || ts.Behind
+			s.DocsSynced += ts.DocsSynced
+			s.Targets = append(s.Targets, ts)
+		}
+	}
+	switch {
+	case s.Paused:
+		s.State = "paused"
+	case !isLeader() || !j.parts.ownsAny():
+		s.State = "standby"
+	case !lastErrorAt.IsZero() && !lastErrorAt.Before(lastRun):
+		s.State = "error"
+	case behind:
+		s.State = "degraded"
+	default:
+		s.State = "running"
+	}
+	return s
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func findJob(name string) *syncJob {
+	for _, job := range jobs {
+		if job.cfg.Name == name {
+			return job
+		}
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"essync/lib"
+	"github.com/elastic/go-elasticsearch/v7"
+	"time"
+)
+
+// syncEvent 同步记录索引里的一条文档：type 为 batch(一批读写)或 retention(一次清理)
+type syncEvent struct {
+	Timestamp        time.Time  `json:"@timestamp"`
+	Type             string     `json:"type"`
+	Job              string     `json:"job"`
+	Source           string     `json:"source,omitempty"`
+	Target           string     `json:"target,omitempty"`
+	Cluster          string     `json:"cluster,omitempty"`
+	Index            string     `json:"index,omitempty"`
+	BatchId          string     `json:"batch_id,omitempty"`
+	TraceId          string     `json:"trace_id,omitempty"`
+	From             *time.Time `json:"from,omitempty"` // 批次覆盖的 sort_field 时间范围
+	To               *time.Time `json:"to,omitempty"`
+	CheckpointBefore string     `json:"checkpoint_before,omitempty"`
+	CheckpointAfter  string     `json:"checkpoint_after,omitempty"`
+	Read             int        `json:"read"`
+	Written          int        `json:"written"`
+	Failed           int        `json:"failed"`
+	Skipped          int        `json:"skipped"` // 抽样、过滤掉的和 create 冲突的
+	Kind             string     `json:"kind,omitempty"`
+	Deleted          int64      `json:"deleted,omitempty"`
+	Result           string     `json:"result"`
+	DurationMs       float64    `json:"duration_ms"`
+	Errors           []string   `json:"errors,omitempty"`
+}
+
+// maxEventErrors 每条记录最多带的错误数，单条错误截断到 maxEventErrorLen
+const (
+	maxEventErrors   = 10
+	maxEventErrorLen = 1000
+)
+
+// eventIndex 异步批量写同步记录，写入失败时保留下来，退避之后在定时器上重试，队列满时丢弃
+type eventIndex struct {
+	client    *elasticsearch.Client
+	index     string
+	batchSize int
+	flush     time.Duration
+	keepDay   int
+	clear     time.Duration
+	queue     chan syncEvent
+	done      chan chan struct{}
+	log       *lib.Logger
+}
+
+// events 没有开启 audit_index 时为 nil，record 什么也不做
+var events *eventIndex
+
+func initEvents() error {
+	cfg := yaml_conf.AuditIndex
+	if !cfg.Enabled {
+		return nil
+	}
+	esCfg := cfg.TargetEs
+	if len(esCfg.Hosts) == 0 {
+		esCfg = yaml_conf.TargetEs
+	}
+	client, err := getTargetClient(esCfg)
+	if err != nil {
+		return err
+	}
+	e := &eventIndex{
+		client:    client,
+		index:     cfg.Index,
+		batchSize: cfg.BatchSize,
+		flush:     time.Second * cfg.FlushInterval,
+		keepDay:   cfg.KeepDay,
+		clear:     time.Second * cfg.ClearInterval,
+		done:      make(chan chan struct{}),
+	}
+	if e.index == "" {
+		e.index = "essync-audit"
+	}
+	if e.batchSize <= 0 {
+		e.batchSize = 500
+	}
+	if e.flush <= 0 {
+		e.flush = 5 * time.Second
+	}
+	if e.clear <= 0 {
+		e.clear = time.Hour
+	}
+	e.queue = make(chan syncEvent, e.batchSize*10)
+	e.log = lib.NewLogger("audit").With("index", e.index)
+	events = e
+	return nil
+}
+
+// record 把记录放进队列，不阻塞同步
+func (e *eventIndex) record(ev syncEvent) {
+	if e == nil {
+		return
+	}
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now()
+	}
+	select {
+	case e.queue <- ev:
+	default:
+		lib.MetricAdd("essync_audit_dropped_total", nil, 1)
+	}
+}
+
+func (e *eventIndex) run() {
+	if e.keepDay > 0 {
+		go e.clearLoop()
+	}
+	var pending []lib.Doc
+	// 写入失败之后到 retryAt 之前不再写，每次失败等待时间翻倍，最多 maxEventBackoff
+	var retryAt time.Time
+	var backoff time.Duration
+	ticker := time.NewTicker(e.flush)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-e.queue:
+			pending = append(pending, e.doc(ev))
+			if len(pending) < e.batchSize || !retryAt.IsZero() {
+				continue
+			}
+		case <-ticker.C:
+			if time.Now().Before(retryAt) {
+				continue
+			}
+		case done := <-e.done:
+			for len(e.queue) > 0 {
+				pending = append(pending, e.doc(<-e.queue))
+			}
+			e.write(pending)
+			close(done)
+			return
+		}
+		var err error
+		if pending, err = e.write(pending); err != nil {
+			backoff = nextEventBackoff(backoff, e.flush)
+			retryAt = time.Now().Add(backoff)
+		} else {
+			backoff, retryAt = 0, time.Time{}
+		}
+	}
+}
+
+const maxEventBackoff = 5 * time.Minute
+
+// nextEventBackoff 第一次失败等一个 flush_interval，之后翻倍
+func nextEventBackoff(last, flush time.Duration) time.Duration {
+	if last < flush {
+		return flush
+	}
+	if last *= 2; last > maxEventBackoff {
+		last = maxEventBackoff
+	}
+	return last
+}
+
+// write 写一批，失败时返回没写进去的文档，最多保留一个队列长度
+func (e *eventIndex) write(docs []lib.Doc) ([]lib.Doc, error) {
+	if len(docs) == 0 {
+		return docs, nil
+	}
+	res, err := lib.Bulk(e.client, e.index, docs, "index", lib.WriteOptions{})
+	if err != nil {
+		e.log.Error("Bulk", "docs", len(docs), "err", err)
+		lib.MetricAdd("essync_audit_write_errors_total", nil, 1)
+		if over := len(docs) - cap(e.queue); over > 0 {
+			lib.MetricAdd("essync_audit_dropped_total", nil, float64(over))
+			docs = docs[over:]
+		}
+		return docs, err
+	}
+	for _, de := range res.Errors {
+		e.log.Error("Bulk", "err", de.Err)
+	}
+	lib.MetricAdd("essync_audit_written_total", nil, float64(res.Succeeded))
+	return docs[:0], nil
+}
+
+func (e *eventIndex) doc(ev syncEvent) lib.Doc {
+	data, _ := json.Marshal(ev)
+	source, _ := lib.DecodeSource(data)
+	return lib.Doc{Source: source}
+}
+
+// close 写完队列里的记录，最多等 10 秒
+func (e *eventIndex) close() {
+	if e == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case e.done <- done:
+	case <-time.After(10 * time.Second):
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+	}
+}
+
+// clearLoop 删除 keep_day 天之前的记录
+func (e *eventIndex) clearLoop() {
+	for {
+		query := lib.EsQuery{
+			"query": map[string]interface{}{
+				"range": map[string]interface{}{
+					"@timestamp": map[string]interface{}{"lt": time.Now().AddDate(0, 0, -e.keepDay)},
+				},
+			},
+		}
+		begin := time.Now()
+		res, err := lib.DeleteByQuery(e.client, e.index, query, lib.DeleteByQueryOptions{WaitForCompletion: true, Conflicts: "proceed"})
+		if err != nil {
+			e.log.Error("DeleteByQuery", "err", err)
+		} else {
+			e.log.Info("DeleteByQuery", "deleted", res.Deleted, "latency_ms", time.Since(begin))
+		}
+		time.Sleep(e.clear)
+	}
+}
+
+// batchEvent 一批写入的记录，b.read 为 0 且没有出错的空轮询不记录
+func (j *syncJob) batchEvent(t *jobTarget, b targetBatch, batchId string, res lib.BulkResult, err error, took time.Duration) {
+	if events == nil || (b.read == 0 && err == nil) {
+		return
+	}
+	o := t.out
+	ev := syncEvent{
+		Type:             "batch",
+		Job:              j.cfg.Name,
+		Source:           t.in.key,
+		Target:           o.key,
+		Cluster:          o.cluster,
+		Index:            o.cfg.TargetEs.IndexName,
+		BatchId:          batchId,
+		TraceId:          traceId(b.ctx),
+		CheckpointBefore: checkpointString(b.from),
+		CheckpointAfter:  checkpointString(b.next),
+		Read:             b.read,
+		Written:          res.Succeeded,
+		Failed:           res.Failed,
+		Result:           "success",
+		DurationMs:       float64(took.Microseconds()) / 1000,
+	}
+	if !o.isEsSink() {
+		ev.Cluster, ev.Index = "", ""
+	}
+	if from, ok := lib.SortTime(b.from.Value); ok {
+		ev.From = &from
+	}
+	if to, ok := lib.SortTime(b.next.Value); ok {
+		ev.To = &to
+	}
+	if skipped := b.read - res.Succeeded - res.Failed; skipped > 0 {
+		ev.Skipped = skipped
+	}
+	if err != nil {
+		ev.Result = "error"
+		ev.Failed = len(b.docs)
+		ev.Skipped = 0
+		ev.Errors = []string{eventError(err.Error())}
+	} else if res.Failed > 0 {
+		ev.Result = "partial"
+	}
+	for _, de := range res.Errors {
+		if len(ev.Errors) >= maxEventErrors {
+			break
+		}
+		ev.Errors = append(ev.Errors, eventError(de.Error()))
+	}
+	events.record(ev)
+}
+
+// readErrorEvent 读来源失败也记一条，没有目标
+func (j *syncJob) readErrorEvent(ctx context.Context, in *jobInput, cp lib.Checkpoint, err error, took time.Duration) {
+	if events == nil {
+		return
+	}
+	events.record(syncEvent{
+		Type:             "batch",
+		Job:              j.cfg.Name,
+		Source:           in.key,
+		TraceId:          traceId(ctx),
+		CheckpointBefore: checkpointString(cp),
+		Result:           "error",
+		DurationMs:       float64(took.Microseconds()) / 1000,
+		Errors:           []string{eventError(err.Error())},
+	})
+}
+
+func (j *syncJob) retentionEvent(o *jobOutput, kind string, result string, docs int64, errMsg string, took time.Duration) {
+	if events == nil {
+		return
+	}
+	ev := syncEvent{
+		Type:       "retention",
+		Job:        j.cfg.Name,
+		Target:     o.key,
+		Kind:       kind,
+		Deleted:    docs,
+		Result:     result,
+		DurationMs: float64(took.Microseconds()) / 1000,
+	}
+	if o.isEsSink() {
+		ev.Cluster, ev.Index = o.cluster, o.cfg.TargetEs.IndexName
+	}
+	if errMsg != "" {
+		ev.Errors = []string{eventError(errMsg)}
+	}
+	events.record(ev)
+}
+
+// checkpointString 进度写成字符串，避免不同来源的值类型在索引里冲突
+func checkpointString(cp lib.Checkpoint) string {
+	if cp.Path != "" {
+		return cp.Path + "@" + lib.FieldString(cp.Offset)
+	}
+	if cp.Value == nil {
+		return ""
+	}
+	return lib.FieldString(cp.Value)
+}
+
+func eventError(s string) string {
+	if len(s) > maxEventErrorLen {
+		return s[:maxEventErrorLen]
+	}
+	return s
+}
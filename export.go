@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"essync/conf"
+	"essync/lib"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// exportLine 导出的行格式，可以直接被 essync import 读取
+type exportLine struct {
+	Index  string          `json:"_index,omitempty"`
+	Id     string          `json:"_id"`
+	Source json.RawMessage `json:"_source"`
+}
+
+// runExport 处理 essync export [flags] config.yaml
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	jobName := fs.String("job", "", "job whose clusters and sort_field are used, default the first job")
+	cluster := fs.String("cluster", "source", "cluster to read: source or target")
+	indexName := fs.String("index", "", "index to export, default the index of -cluster")
+	queryArg := fs.String("query", "", "query DSL as JSON (the value of \"query\"), or @file to read it from a file")
+	from := fs.String("from", "", "only documents with sort_field >= from")
+	to := fs.String("to", "", "only documents with sort_field < to")
+	method := fs.String("method", "pit", "pit (point in time + search_after) or scroll")
+	out := fs.String("out", ".", "output directory")
+	prefix := fs.String("prefix", "", "output file prefix, default the index name")
+	compress := fs.Bool("gzip", true, "gzip the output files")
+	maxDocs := fs.Int64("max-docs", 0, "start a new file after N documents, 0 for no limit")
+	maxBytes := fs.Int64("max-bytes", 0, "start a new file after N uncompressed bytes, 0 for no limit")
+	withIndex := fs.Bool("with-index", false, "write _index on every line")
+	batchSize := fs.Int("batch", 1000, "documents per search request")
+	progress := fs.Int64("progress", 10000, "log progress every N documents")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: essync export [flags] config.yaml")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	loadConfig(fs.Arg(0))
+	initLogger()
+	log := lib.NewLogger("export")
+	cfg, err := findJobConfig(*jobName)
+	if err != nil {
+		log.Error("findJobConfig", "err", err)
+		os.Exit(2)
+	}
+
+	client, err := getSourceClient(cfg.SourceEs)
+	if *cluster == "target" {
+		client, err = getTargetClient(cfg.TargetEs)
+		if *indexName == "" {
+			*indexName = cfg.TargetEs.IndexName
+		}
+	} else if *indexName == "" {
+		*indexName = cfg.SourceEs.IndexName
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+	query, err := exportQuery(cfg, *queryArg, *from, *to)
+	if err != nil {
+		log.Error("exportQuery", "job", cfg.Name, "err", err)
+		os.Exit(2)
+	}
+	if *prefix == "" {
+		*prefix = strings.Replace(*indexName, "*", "_", -1)
+	}
+	writer := &lib.RotatingNdjsonWriter{
+		Dir:      *out,
+		Prefix:   *prefix,
+		Compress: *compress,
+		MaxDocs:  *maxDocs,
+		MaxBytes: *maxBytes,
+	}
+
+	begin := time.Now()
+	var exported int64
+	write := func(hits []*lib.SearchResponseHitsHits) error {
+		for _, hit := range hits {
+			line := exportLine{Id: hit.ID, Source: hit.Source}
+			if *withIndex {
+				line.Index = hit.Index
+			}
+			if err := writer.Write(line); err != nil {
+				return err
+			}
+			exported++
+			if *progress > 0 && exported%*progress == 0 {
+				log.Info("progress", "index", *indexName, "exported", exported, "files", len(writer.Files()),
+					"rate", math.Round(float64(exported)/time.Since(begin).Seconds()))
+			}
+		}
+		return nil
+	}
+	if *method == "scroll" {
+		if cfg.SortField != "" {
+			query["sort"] = []interface{}{map[string]string{cfg.SortField: "asc"}}
+		}
+		_, err = lib.Scroll(client, *indexName, query, *batchSize, time.Minute*5, write)
+	} else {
+		_, err = lib.SearchAfter(client, *indexName, query, cfg.SortField, *batchSize, time.Minute*5, write)
+	}
+	if cerr := writer.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Error("export", "index", *indexName, "exported", exported, "err", err)
+		os.Exit(1)
+	}
+	for _, f := range writer.Files() {
+		log.Info("wrote", "file", f)
+	}
+	log.Info("finished", "index", *indexName, "docs", exported, "files", len(writer.Files()),
+		"latency_ms", time.Since(begin))
+}
+
+// exportQuery 组合 -query 和 sort_field 范围条件
+func exportQuery(cfg *conf.Job, queryArg string, from string, to string) (lib.EsQuery, error) {
+	var filters []interface{}
+	if queryArg != "" {
+		raw := []byte(queryArg)
+		if strings.HasPrefix(queryArg, "@") {
+			data, err := ioutil.ReadFile(queryArg[1:])
+			if err != nil {
+				return nil, err
+			}
+			raw = data
+		}
+		var q map[string]interface{}
+		if err := json.Unmarshal(raw, &q); err != nil {
+			return nil, fmt.Errorf("-query: %v", err)
+		}
+		// 同时接受 {"query":{...}} 和 {...}
+		if inner, ok := q["query"].(map[string]interface{}); ok && len(q) == 1 {
+			q = inner
+		}
+		filters = append(filters, q)
+	}
+	if from != "" || to != "" {
+		if cfg.SortField == "" {
+			return nil, fmt.Errorf("-from/-to need sort_field in config")
+		}
+		r := map[string]interface{}{}
+		if from != "" {
+			r["gte"] = exportRangeValue(cfg, from)
+		}
+		if to != "" {
+			r["lt"] = exportRangeValue(cfg, to)
+		}
+		filters = append(filters, map[string]interface{}{"range": map[string]interface{}{cfg.SortField: r}})
+	}
+	if len(filters) == 0 {
+		return lib.EsQuery{"query": map[string]interface{}{"match_all": map[string]interface{}{}}}, nil
+	}
+	return lib.EsQuery{"query": map[string]interface{}{"bool": map[string]interface{}{"filter": filters}}}, nil
+}
+
+func exportRangeValue(cfg *conf.Job, v string) interface{} {
+	if cfg.SortFieldType == "int64" {
+		if n, err := json.Number(v).Int64(); err == nil {
+			return n
+		}
+	}
+	return v
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// healthCheck 一项检查的结果
+type healthCheck struct {
+	Name     string     `json:"name"`
+	Status   string     `json:"status"` // ok 或 fail
+	Error    string     `json:"error,omitempty"`
+	LastBeat *time.Time `json:"last_beat,omitempty"`
+	Took     string     `json:"took,omitempty"`
+}
+
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks"`
+}
+
+func newHealthReport(checks []healthCheck) (int, healthReport) {
+	report := healthReport{Status: "ok", Checks: checks}
+	for _, c := range checks {
+		if c.Status != "ok" {
+			report.Status = "fail"
+			return http.StatusServiceUnavailable, report
+		}
+	}
+	return http.StatusOK, report
+}
+
+// registerHealthApi /livez 检查同步循环是否在推进，/readyz 检查来源、目标和进度目录是否可用
+func registerHealthApi(r *gin.Engine) {
+	r.GET("/livez", func(c *gin.Context) {
+		c.JSON(newHealthReport(liveChecks()))
+	})
+	r.GET("/readyz", func(c *gin.Context) {
+		c.JSON(newHealthReport(readyChecks()))
+	})
+}
+
+func touch(beat *int64) {
+	atomic.StoreInt64(beat, time.Now().UnixNano())
+}
+
+// liveChecks 每个读取和写入循环在 live_intervals 个 sync_interval 内(至少 1 分钟)要有一轮，暂停、备用和不在本实例上的分区不检查
+func liveChecks() []healthCheck {
+	intervals := yaml_conf.Health.LiveIntervals
+	if intervals <= 0 {
+		intervals = 5
+	}
+	checks := []healthCheck{{Name: "process", Status: "ok"}}
+	for _, job := range jobs {
+		stall := time.Duration(intervals) * time.Second * job.cfg.SyncInterval
+		if stall < time.Minute {
+			stall = time.Minute
+		}
+		for _, in := range job.inputs {
+			paused := !job.running(in)
+			checks = append(checks, beatCheck("reader/"+in.key, &in.beat, stall, paused))
+			for _, t := range in.targets {
+				checks = append(checks, beatCheck("writer/"+t.key, &t.beat, stall, paused))
+			}
+		}
+	}
+	return checks
+}
+
+func beatCheck(name string, beat *int64, stall time.Duration, paused bool) healthCheck {
+	c := healthCheck{Name: name, Status: "ok"}
+	n := atomic.LoadInt64(beat)
+	if n == 0 {
+		c.Status = "fail"
+		c.Error = "not started"
+		return c
+	}
+	last := time.Unix(0, n)
+	c.LastBeat = &last
+	if !paused && time.Since(last) > stall {
+		c.Status = "fail"
+		c.Error = "no progress for " + time.Since(last).Truncate(time.Second).String()
+	}
+	return c
+}
+
+// readyChecks 并发检查所有来源、目标和进度目录，超过 health.timeout 没有结果的算失败；
+// 返回时取消还在进行的检查，卡住的集群不会让每次 /readyz 都留下 goroutine
+func readyChecks() []healthCheck {
+	timeout := time.Second * yaml_conf.Health.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	type probe struct {
+		name string
+		fn   func(ctx context.Context) error
+	}
+	probes := []probe{{"checkpoint_store", checkpoints.Health}}
+	for _, job := range jobs {
+		for _, in := range job.inputs {
+			probes = append(probes, probe{"source/" + in.key, in.source.Health})
+		}
+		for _, o := range job.outputs {
+			probes = append(probes, probe{"target/" + o.key, o.sink.Health})
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	checks := make([]healthCheck, len(probes))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, p := range probes {
+		checks[i] = healthCheck{Name: p.name, Status: "fail", Error: "timeout after " + timeout.String()}
+		wg.Add(1)
+		go func(i int, p probe) {
+			defer wg.Done()
+			begin := time.Now()
+			err := p.fn(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			c := healthCheck{Name: p.name, Status: "ok", Took: time.Since(begin).String()}
+			if err != nil {
+				c.Status = "fail"
+				c.Error = err.Error()
+			}
+			mu.Lock()
+			checks[i] = c
+			mu.Unlock()
+		}(i, p)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]healthCheck(nil), checks...)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// recentSize 每个任务保留的最近错误和清理记录条数
+const recentSize = 20
+
+type jobError struct {
+	Time  time.Time `json:"time"`
+	Key   string    `json:"key"`
+	Error string    `json:"error"`
+}
+
+// retentionRun 一次清理：delete_by_query、purge 或 archive
+type retentionRun struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	Kind   string    `json:"kind"`
+	Result string    `json:"result"`
+	Docs   int64     `json:"docs"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// recordRetention 记录到看板，开启 audit_index 时同时写一条同步记录
+func (j *syncJob) recordRetention(o *jobOutput, kind string, result string, docs int64, errMsg string, took time.Duration) {
+	j.mu.Lock()
+	j.retention = append(j.retention, retentionRun{Time: time.Now(), Target: o.key, Kind: kind, Result: result, Docs: docs, Error: errMsg})
+	if len(j.retention) > recentSize {
+		j.retention = j.retention[1:]
+	}
+	j.mu.Unlock()
+	j.retentionEvent(o, kind, result, docs, errMsg, took)
+}
+
+// historySample 某一时刻任务的延迟和吞吐，延迟为所有目标的合计，来源无法统计条数时不计入
+type historySample struct {
+	Time       time.Time `json:"time"`
+	LagDocs    int64     `json:"lag_docs"`
+	LagSeconds float64   `json:"lag_seconds"`
+	DocsSynced int64     `json:"docs_synced"`
+	DocsPerSec float64   `json:"docs_per_sec"`
+	Errors     int64     `json:"errors"`
+}
+
+// historyRing 固定大小的环形缓冲，写满后覆盖最早的记录
+type historyRing struct {
+	buf  []historySample
+	next int
+	full bool
+}
+
+func newHistoryRing() *historyRing {
+	interval, hours := historySettings()
+	size := int(time.Duration(hours) * time.Hour / interval)
+	if size < 1 {
+		size = 1
+	}
+	return &historyRing{buf: make([]historySample, size)}
+}
+
+func historySettings() (time.Duration, int) {
+	interval := time.Second * yaml_conf.Dashboard.SampleInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	hours := yaml_conf.Dashboard.HistoryHours
+	if hours <= 0 {
+		hours = 6
+	}
+	return interval, hours
+}
+
+func (r *historyRing) add(s historySample) {
+	r.buf[r.next] = s
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *historyRing) last() (historySample, bool) {
+	if !r.full && r.next == 0 {
+		return historySample{}, false
+	}
+	return r.buf[(r.next+len(r.buf)-1)%len(r.buf)], true
+}
+
+// samples 按时间顺序返回所有记录
+func (r *historyRing) samples() []historySample {
+	if !r.full {
+		return append([]historySample(nil), r.buf[:r.next]...)
+	}
+	return append(append([]historySample(nil), r.buf[r.next:]...), r.buf[:r.next]...)
+}
+
+// recordHistory 定时给每个任务记录一次延迟和吞吐；一个间隔内没有写入过的目标先重新统计延迟，
+// 目标卡住或来源没有新数据时延迟也会更新；扇出的目标进度相同时对来源只统计一次
+func recordHistory() {
+	interval, _ := historySettings()
+	for {
+		for _, job := range jobs {
+			for _, in := range job.inputs {
+				if !in.owned() {
+					// 其他实例上的分区由那个实例统计
+					continue
+				}
+				var stale []*jobTarget
+				for _, t := range in.targets {
+					t.mu.Lock()
+					if time.Since(t.lagAt) >= interval {
+						stale = append(stale, t)
+					}
+					t.mu.Unlock()
+				}
+				job.reportLags(stale)
+			}
+			job.sampleHistory(time.Now())
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (j *syncJob) sampleHistory(now time.Time) {
+	s := historySample{Time: now}
+	for _, in := range j.inputs {
+		if !in.owned() {
+			continue
+		}
+		for _, t := range in.targets {
+			t.mu.Lock()
+			if t.lag.Docs > 0 {
+				s.LagDocs += t.lag.Docs
+			}
+			if t.lagSec > s.LagSeconds {
+				s.LagSeconds = t.lagSec
+			}
+			t.mu.Unlock()
+			s.DocsSynced += atomic.LoadInt64(&t.synced)
+		}
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s.Errors = j.errorCount
+	if prev, ok := j.history.last(); ok {
+		if d := now.Sub(prev.Time).Seconds(); d > 0 {
+			s.DocsPerSec = float64(s.DocsSynced-prev.DocsSynced) / d
+		}
+	}
+	j.history.add(s)
+}
+
+type jobHistory struct {
+	Samples   []historySample `json:"samples"`
+	Errors    []jobError      `json:"errors"`
+	Retention []retentionRun  `json:"retention"`
+}
+
+func (j *syncJob) historyView() jobHistory {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return jobHistory{
+		Samples:   j.history.samples(),
+		Errors:    append([]jobError{}, j.recentErrors...),
+		Retention: append([]retentionRun{}, j.retention...),
+	}
+}
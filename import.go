@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"essync/lib"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// importLine 兼容 essync 归档和 elasticdump 的行格式
+type importLine struct {
+	Index  string          `json:"_index"`
+	Id     string          `json:"_id"`
+	Source json.RawMessage `json:"_source"`
+}
+
+// runImport 处理 essync import [flags] config.yaml file...
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	jobName := fs.String("job", "", "job whose target cluster, transforms and write mode are used, default the first job")
+	targetName := fs.String("target", "", "target of a fan-out job, default the first")
+	indexName := fs.String("index", "", "target index, default target_es.indexName of the target")
+	idField := fs.String("id-field", "_id", "field used as document id: _id of the line, a _source field, or empty for auto ids")
+	offset := fs.Int64("offset", 0, "skip the first N documents of the first file, to resume an interrupted import")
+	batchSize := fs.Int("batch", 500, "documents per bulk request")
+	progress := fs.Int64("progress", 10000, "log progress every N documents")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: essync import [flags] config.yaml file.ndjson[.gz]...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	loadConfig(fs.Arg(0))
+	initLogger()
+	log := lib.NewLogger("import")
+	cfg, err := findJobConfig(*jobName)
+	if err != nil {
+		log.Error("findJobConfig", "err", err)
+		os.Exit(2)
+	}
+	if *batchSize <= 0 {
+		*batchSize = 500
+	}
+	tc, err := findTargetConfig(cfg, *targetName)
+	if err != nil {
+		log.Error("import", "job", cfg.Name, "err", err)
+		os.Exit(2)
+	}
+	if *indexName == "" {
+		*indexName = tc.TargetEs.IndexName
+	}
+	// 导入总是写 elasticsearch，沿用目标的转换和写入方式；只建这一个目标，
+	// 来源和其他目标连不上或配置有问题时也能恢复
+	tc.Sink.Type = "elasticsearch"
+	tc.TargetEs.IndexName = *indexName
+	target, err := newJobOutput(cfg, tc)
+	if err != nil {
+		log.Error("import", "job", cfg.Name, "err", err)
+		os.Exit(1)
+	}
+	job := &syncJob{cfg: cfg, outputs: []*jobOutput{target}}
+
+	begin := time.Now()
+	var imported, skipped, failed int64
+	for i, file := range fs.Args()[1:] {
+		start := int64(0)
+		if i == 0 {
+			start = *offset
+		}
+		var batch []lib.Doc
+		batchStart := start
+		flush := func(next int64) error {
+			if len(batch) == 0 {
+				return nil
+			}
+			res, err := writeDocs(context.Background(), job, target, target.log, target.labels(job), newBatchId(), batch)
+			if err != nil {
+				return err
+			}
+			if retry := res.RetryDocs(); len(retry) > 0 {
+				return fmt.Errorf("%d docs still rejected by the target", len(retry))
+			}
+			imported += int64(res.Succeeded)
+			skipped += int64(res.Conflicts)
+			failed += int64(res.Failed)
+			batch = batch[:0]
+			batchStart = next
+			return nil
+		}
+		lineCount, err := lib.ReadNdjson(file, start, func(lineNo int64, line []byte) error {
+			doc, err := parseImportLine(line, *idField)
+			if err != nil {
+				log.Error("parse line", "file", file, "line", lineNo, "err", err)
+				failed++
+			} else {
+				batch = append(batch, doc)
+			}
+			if len(batch) >= *batchSize {
+				if err := flush(lineNo + 1); err != nil {
+					return err
+				}
+			}
+			if *progress > 0 && (lineNo+1)%*progress == 0 {
+				rate := float64(imported) / time.Since(begin).Seconds()
+				log.Info("progress", "file", file, "offset", lineNo+1, "imported", imported, "skipped", skipped,
+					"failed", failed, "rate", math.Round(rate))
+			}
+			return nil
+		})
+		if err == nil {
+			err = flush(lineCount)
+		}
+		if err != nil {
+			log.Error("import", "file", file, "err", err)
+			log.Info("stopped, resume with -offset", "file", file, "offset", batchStart)
+			os.Exit(1)
+		}
+		log.Info("file done", "file", file, "lines", lineCount)
+	}
+	log.Info("finished", "index", *indexName, "imported", imported, "skipped", skipped, "failed", failed,
+		"latency_ms", time.Since(begin))
+}
+
+// parseImportLine 解析一行：带 _source 的按 essync/elasticdump 格式处理，否则整行就是文档
+func parseImportLine(line []byte, idField string) (lib.Doc, error) {
+	var wrapped importLine
+	if err := json.Unmarshal(line, &wrapped); err != nil {
+		return lib.Doc{}, err
+	}
+	raw := []byte(wrapped.Source)
+	if len(raw) == 0 {
+		raw = line
+		wrapped.Id = ""
+	}
+	source, err := lib.DecodeSource(raw)
+	if err != nil {
+		return lib.Doc{}, err
+	}
+	doc := lib.Doc{Index: wrapped.Index, Source: source}
+	switch idField {
+	case "":
+	case "_id":
+		doc.Id = wrapped.Id
+	default:
+		if v, ok := lib.GetField(source, idField); ok {
+			doc.Id = lib.FieldString(v)
+		}
+	}
+	return doc, nil
+}
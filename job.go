@@ -0,0 +1,836 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"essync/conf"
+	"essync/lib"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// syncJob 一个同步任务：一个或多个来源(扇入)，每个来源写到同一组目标(扇出)
+type syncJob struct {
+	cfg     *conf.Job
+	inputs  []*jobInput
+	outputs []*jobOutput
+	sampler *lib.Sampler
+	parts   *jobPartitions // 配置了 partition 或开启 sharding 时不为空
+	log     *lib.Logger
+
+	// 以下由管理接口和同步循环共用，见 control.go
+	mu          sync.Mutex
+	paused      bool
+	wake        chan struct{}
+	lastRun     time.Time
+	lastError   string
+	lastErrorAt time.Time
+
+	// 看板用的最近记录，见 history.go
+	errorCount   int64
+	recentErrors []jobError
+	retention    []retentionRun
+	history      *historyRing
+}
+
+// jobInput 任务的一个来源，每个来源对每个目标有单独的同步进度
+type jobInput struct {
+	name      string // 扇入的来源名，单来源任务为空
+	key       string
+	client    *elasticsearch.Client
+	source    lib.Source
+	cluster   string // 来源集群的 cluster_name，扇入时标记到文档上
+	targets   []*jobTarget
+	log       *lib.Logger
+	attrs     []attribute.KeyValue // span 属性
+	parts     *jobPartitions
+	partition int // 分区任务里这个来源读的分区
+	reset     chan chan error
+	beat      int64 // 读取循环最近一轮的时间(UnixNano)，/livez 用
+}
+
+// jobOutput 任务的一个写入目标，所有来源共用它的转换和 Sink
+type jobOutput struct {
+	name       string // 扇出的目标名，单目标任务为空
+	key        string
+	cfg        conf.Target
+	transforms []lib.Transform
+	client     *elasticsearch.Client
+	sink       lib.Sink
+	limiter    *lib.RateLimiter
+	cluster    string
+	log        *lib.Logger // 写入日志
+	rlog       *lib.Logger // 清理日志
+	attrs      []attribute.KeyValue
+	mu         sync.Mutex // 多个来源同时写非 elasticsearch 的 Sink 时串行
+	deadMu     sync.Mutex
+	dead       *lib.RotatingNdjsonWriter // 写不进去的文档
+}
+
+// writeRetries 目标暂时拒绝(429)的文档在同一批里最多重写几次，间隔依次加长
+const writeRetries = 3
+
+// jobTarget 一个来源写一个目标的状态，有自己的缓冲和同步进度。
+// 缓冲满或写入失败时脱离扇出，自己从 cp 读来源追赶，追上后再回到扇出。
+type jobTarget struct {
+	in       *jobInput
+	out      *jobOutput
+	key      string // 同步进度的 key
+	baseKey  string // 分区任务里分区之前的进度 key，分区还没有进度时从它开始
+	queue    chan targetBatch
+	log      *lib.Logger
+	mu       sync.Mutex
+	cp       lib.Checkpoint
+	gen      int // 每次重置进度加一，重置前开始写的批次不再保存进度
+	behind   bool
+	caughtUp bool
+	synced   int64
+	beat     int64 // 写入循环最近一轮的时间(UnixNano)
+	lag      lib.Lag
+	lagAt    time.Time
+	lagSec   float64 // 来源最新 sort_field 和进度相差的秒数，-1 表示无法换算成时间
+	ageSec   float64 // 进度和当前时间相差的秒数
+}
+
+// targetBatch 来源读出的一批文档，from 是读之前的进度，next 是读之后的进度，read 是抽样前读到的条数，
+// ctx 带着读这一批的 span，写入的 span 挂在它下面
+type targetBatch struct {
+	docs []lib.Doc
+	from lib.Checkpoint
+	next lib.Checkpoint
+	read int
+	ctx  context.Context
+}
+
+var jobs []*syncJob
+var checkpoints lib.Checkpoints
+
+func initJobs() error {
+	store, err := lib.NewCheckpointStore(yaml_conf.CheckpointDir)
+	if err != nil {
+		return err
+	}
+	checkpoints = store
+	if election != nil {
+		// 主备切换后新的 leader 要接着同步，进度保存在租约所在的索引里，没有时从本地文件迁移
+		checkpoints = lib.NewEsCheckpointStore(election.client, election.index, store)
+	}
+	if sharding != nil {
+		// 分区会在实例间移动，进度和协调文档保存在同一个索引里
+		checkpoints = lib.NewEsCheckpointStore(sharding.client, sharding.index, store)
+	}
+	for i := range yaml_conf.Jobs {
+		job, err := newSyncJob(&yaml_conf.Jobs[i])
+		if err != nil {
+			return fmt.Errorf("job %s: %v", yaml_conf.Jobs[i].Name, err)
+		}
+		jobs = append(jobs, job)
+	}
+	return nil
+}
+
+func newSyncJob(cfg *conf.Job) (*syncJob, error) {
+	job := &syncJob{cfg: cfg, wake: make(chan struct{}), history: newHistoryRing(), log: syncLog.With("job", cfg.Name)}
+	if cfg.Sample.Percent < 0 || cfg.Sample.Percent > 100 {
+		return nil, fmt.Errorf("sample.percent must be between 0 and 100: %v", cfg.Sample.Percent)
+	}
+	if cfg.Sample.Percent > 0 && cfg.Sample.Percent < 100 {
+		job.sampler = lib.NewSampler(cfg.Sample.Percent, cfg.Sample.By)
+		lib.MetricSet("essync_sample_percent", job.labels(), cfg.Sample.Percent)
+	}
+	for _, tc := range jobTargets(cfg) {
+		o, err := newJobOutput(cfg, tc)
+		if err != nil {
+			if tc.Name != "" {
+				err = fmt.Errorf("target %s: %v", tc.Name, err)
+			}
+			return nil, err
+		}
+		job.outputs = append(job.outputs, o)
+	}
+	if cfg.Partition.By != "" || sharding != nil {
+		var err error
+		if job.parts, err = newJobPartitions(job); err != nil {
+			return nil, err
+		}
+	}
+	sources := cfg.Sources
+	if len(sources) == 0 {
+		sources = []conf.Input{{SourceEs: cfg.SourceEs, Source: cfg.Source}}
+	}
+	for _, sc := range sources {
+		partitions := 1
+		if job.parts.partition(0) != nil {
+			// 分区任务只有一个来源，每个分区一个读取循环
+			partitions = job.parts.count
+		}
+		for i := 0; i < partitions; i++ {
+			in, err := job.newJobInput(sc, i)
+			if err != nil {
+				if sc.Name != "" {
+					err = fmt.Errorf("source %s: %v", sc.Name, err)
+				}
+				return nil, err
+			}
+			job.inputs = append(job.inputs, in)
+		}
+	}
+	return job, nil
+}
+
+func newJobOutput(cfg *conf.Job, tc conf.Target) (*jobOutput, error) {
+	o := &jobOutput{name: tc.Name, key: cfg.Name, cfg: tc}
+	if tc.Name != "" {
+		o.key = cfg.Name + "." + tc.Name
+	}
+	var err error
+	if o.transforms, err = lib.NewTransforms(append(append([]conf.Transform{}, cfg.Transforms...), tc.Transforms...)); err != nil {
+		return nil, err
+	}
+	idTransform, err := lib.NewIdTransform(tc.DocId)
+	if err != nil {
+		return nil, err
+	}
+	if idTransform != nil {
+		o.transforms = append(o.transforms, idTransform)
+	}
+	if o.client, err = getTargetClient(tc.TargetEs); err != nil {
+		return nil, err
+	}
+	if o.sink, err = newSink(o.key, tc, o.client); err != nil {
+		return nil, err
+	}
+	fields := []interface{}{"job", cfg.Name, "target", o.key}
+	if o.isEsSink() {
+		if o.cluster, err = lib.ClusterName(o.client); err != nil {
+			syncLog.Warn("ClusterName", append(fields, "err", err)...)
+		}
+		fields = append(fields, "cluster", o.cluster, "index", tc.TargetEs.IndexName)
+	}
+	o.log = syncLog.With(fields...)
+	o.rlog = retentionLog.With(fields...)
+	o.attrs = []attribute.KeyValue{attribute.String("target", o.key), attribute.String("sink", tc.Sink.Type)}
+	if o.isEsSink() {
+		o.attrs = append(o.attrs, attribute.String("target.cluster", o.cluster), attribute.String("target.index", tc.TargetEs.IndexName))
+	}
+	if cfg.MaxDocsPerSec > 0 {
+		// 每个目标单独限速
+		o.limiter = lib.NewRateLimiter(cfg.MaxDocsPerSec)
+	}
+	return o, nil
+}
+
+func (j *syncJob) newJobInput(sc conf.Input, partition int) (*jobInput, error) {
+	in := &jobInput{name: sc.Name, key: j.cfg.Name, parts: j.parts, partition: partition, reset: make(chan chan error)}
+	if sc.Name != "" {
+		in.key = j.cfg.Name + "." + sc.Name
+	}
+	baseKey := in.key
+	part := j.parts.partition(partition)
+	in.key = partitionKey(in.key, part)
+	var err error
+	if in.client, err = getSourceClient(sc.SourceEs); err != nil {
+		return nil, err
+	}
+	if part != nil {
+		in.source = lib.NewEsPartitionSource(in.client, sc.SourceEs.IndexName, j.cfg.SortField, *part)
+	} else if in.source, err = newSource(j.cfg, sc, in.client); err != nil {
+		return nil, err
+	}
+	in.log = j.log.With("source", in.key)
+	in.attrs = []attribute.KeyValue{attribute.String("job", j.cfg.Name), attribute.String("source", in.key)}
+	if part != nil {
+		in.log = in.log.With("partition", partition)
+		in.attrs = append(in.attrs, attribute.Int("partition", partition))
+	}
+	if _, ok := in.source.(*lib.EsSource); ok {
+		if in.cluster, err = lib.ClusterName(in.client); err != nil {
+			in.log.Warn("ClusterName", "err", err)
+		}
+		in.log = in.log.With("cluster", in.cluster, "index", sc.SourceEs.IndexName)
+		in.attrs = append(in.attrs, attribute.String("source.cluster", in.cluster), attribute.String("source.index", sc.SourceEs.IndexName))
+	}
+	for _, o := range j.outputs {
+		t := &jobTarget{in: in, out: o, key: in.key}
+		if o.name != "" {
+			t.key = in.key + "." + o.name
+		}
+		if part != nil {
+			t.baseKey = baseKey
+			if o.name != "" {
+				t.baseKey = baseKey + "." + o.name
+			}
+		}
+		t.log = o.log.With("source", in.key, "key", t.key)
+		buffer := o.cfg.Buffer
+		if buffer <= 0 {
+			buffer = 10
+		}
+		t.queue = make(chan targetBatch, buffer)
+		in.targets = append(in.targets, t)
+	}
+	return in, nil
+}
+
+// jobTargets 任务的写入目标，没有配置 targets 时是任务自己的 target_es 和 sink
+func jobTargets(cfg *conf.Job) []conf.Target {
+	if len(cfg.Targets) > 0 {
+		return cfg.Targets
+	}
+	return []conf.Target{{TargetEs: cfg.TargetEs, Sink: cfg.Sink, DocId: cfg.DocId}}
+}
+
+// findTargetConfig 按名字找扇出目标的配置，name 为空时返回第一个，import 用
+func findTargetConfig(cfg *conf.Job, name string) (conf.Target, error) {
+	for _, tc := range jobTargets(cfg) {
+		if name == "" || tc.Name == name {
+			return tc, nil
+		}
+	}
+	return conf.Target{}, errors.New("target not found: " + name)
+}
+
+// findJobConfig 按名字找任务配置，name 为空时返回第一个，import/export 用
+func findJobConfig(name string) (*conf.Job, error) {
+	for i := range yaml_conf.Jobs {
+		if name == "" || yaml_conf.Jobs[i].Name == name {
+			return &yaml_conf.Jobs[i], nil
+		}
+	}
+	return nil, errors.New("job not found: " + name)
+}
+
+func newSource(cfg *conf.Job, sc conf.Input, sourceClient *elasticsearch.Client) (lib.Source, error) {
+	sourceCfg := sc.Source
+	switch sourceCfg.Type {
+	case "", "elasticsearch":
+		return lib.NewEsSource(sourceClient, sc.SourceEs.IndexName, cfg.SortField), nil
+	case "file":
+		if sourceCfg.Path == "" {
+			return nil, errors.New("source.path is required for file source")
+		}
+		return lib.NewFileSource(sourceCfg.Path, sourceCfg.IdField, sourceCfg.StartPosition == "end"), nil
+	}
+	return nil, errors.New("unknown source type: " + sourceCfg.Type)
+}
+
+// newSink 创建目标的 Sink，name 用作文件前缀、sqlite 表名的默认值
+func newSink(name string, tc conf.Target, targetClient *elasticsearch.Client) (lib.Sink, error) {
+	sinkCfg := tc.Sink
+	switch sinkCfg.Type {
+	case "", "elasticsearch":
+		opts, err := esWriteOptions(sinkCfg)
+		if err != nil {
+			return nil, err
+		}
+		return lib.NewEsSink(targetClient, tc.TargetEs.IndexName, sinkCfg.WriteMode, opts), nil
+	case "file":
+		if sinkCfg.Dir == "" {
+			return nil, errors.New("sink.dir is required for file sink")
+		}
+		prefix := sinkCfg.Prefix
+		if prefix == "" {
+			prefix = name
+		}
+		return lib.NewFileSink(sinkCfg.Dir, prefix, sinkCfg.Gzip, sinkCfg.MaxDocs, sinkCfg.MaxBytes)
+	case "stdout":
+		return lib.NewStdoutSink(os.Stdout), nil
+	case "sqlite":
+		if sinkCfg.Path == "" {
+			return nil, errors.New("sink.path is required for sqlite sink")
+		}
+		table := sinkCfg.Table
+		if table == "" {
+			table = strings.Replace(name, ".", "_", -1)
+		}
+		columns := make([]lib.SqliteColumn, 0, len(sinkCfg.Columns))
+		for _, c := range sinkCfg.Columns {
+			columns = append(columns, lib.SqliteColumn{Field: c.Field, Column: c.Column, Type: c.Type})
+		}
+		return lib.NewSqliteSink(sinkCfg.Path, table, columns, sinkCfg.JsonColumn)
+	case "webhook":
+		if sinkCfg.Url == "" {
+			return nil, errors.New("sink.url is required for webhook sink")
+		}
+		return lib.NewWebhookSink(sinkCfg.Url, sinkCfg.Headers, time.Second*sinkCfg.Timeout), nil
+	}
+	return nil, errors.New("unknown sink type: " + sinkCfg.Type)
+}
+
+// esWriteOptions elasticsearch 目标每次写入带的 routing、pipeline 等参数
+func esWriteOptions(sinkCfg conf.Sink) (lib.WriteOptions, error) {
+	switch sinkCfg.Refresh {
+	case "", "true", "false", "wait_for":
+	default:
+		return lib.WriteOptions{}, errors.New("sink.refresh must be true, false or wait_for: " + sinkCfg.Refresh)
+	}
+	return lib.WriteOptions{
+		Routing:             sinkCfg.Routing,
+		RoutingField:        sinkCfg.RoutingField,
+		Pipeline:            sinkCfg.Pipeline,
+		Refresh:             sinkCfg.Refresh,
+		WaitForActiveShards: sinkCfg.WaitForActiveShards,
+		Timeout:             time.Second * sinkCfg.Timeout,
+	}, nil
+}
+
+// isEsSink 清理过期数据、归档等只对 elasticsearch 目标有效
+func (o *jobOutput) isEsSink() bool {
+	_, ok := o.sink.(*lib.EsSink)
+	return ok
+}
+
+func (j *syncJob) labels() map[string]string {
+	return map[string]string{"job": j.cfg.Name}
+}
+
+func (o *jobOutput) labels(job *syncJob) map[string]string {
+	labels := job.labels()
+	if o.name != "" {
+		labels["target"] = o.name
+	}
+	return labels
+}
+
+func (o *jobOutput) resultLabels(job *syncJob, result string) map[string]string {
+	labels := o.labels(job)
+	labels["result"] = result
+	return labels
+}
+
+func (t *jobTarget) labels(job *syncJob) map[string]string {
+	labels := t.out.labels(job)
+	if t.in.name != "" {
+		labels["source"] = t.in.name
+	}
+	if t.baseKey != "" {
+		labels["partition"] = strconv.Itoa(t.in.partition)
+	}
+	return labels
+}
+
+// write 执行目标的 transforms，按 max_docs_per_second 限速后写入 Sink；EsSink 可以并发写，其他 Sink 在多个来源间串行
+func (o *jobOutput) write(ctx context.Context, docs []lib.Doc, labels map[string]string) ([]lib.Doc, []error, lib.BulkResult, error) {
+	_, span := tracer.Start(ctx, "transform", trace.WithAttributes(o.attrs...))
+	n := len(docs)
+	docs, errs := lib.ApplyTransforms(o.transforms, docs)
+	span.SetAttributes(attribute.Int("docs.in", n), attribute.Int("docs.out", len(docs)), attribute.Int("docs.failed", len(errs)))
+	span.End()
+	o.throttle(len(docs), labels)
+	if !o.isEsSink() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+	}
+	_, span = tracer.Start(ctx, "sink.write", trace.WithAttributes(o.attrs...))
+	res, err := o.sink.Write(docs)
+	for attempt := 1; err == nil && attempt <= writeRetries; attempt++ {
+		retry := res.RetryDocs()
+		if len(retry) == 0 {
+			break
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+		// 重写的文档同样占 max_docs_per_second 的额度
+		o.throttle(len(retry), labels)
+		lib.MetricAdd("essync_docs_retried_total", labels, float64(len(retry)))
+		again, rerr := o.sink.Write(retry)
+		if rerr != nil {
+			// 重写整批失败时保留原来的结果，由调用方按可重写的失败处理
+			break
+		}
+		res = res.Retried(again)
+	}
+	span.SetAttributes(attribute.Int("docs", len(docs)), attribute.Int("docs.succeeded", res.Succeeded),
+		attribute.Int("docs.conflicts", res.Conflicts), attribute.Int("docs.failed", res.Failed))
+	endSpan(span, err)
+	return docs, errs, res, err
+}
+
+// throttle 按 max_docs_per_second 等待写 n 条文档的额度
+func (o *jobOutput) throttle(n int, labels map[string]string) {
+	if o.limiter == nil || n == 0 {
+		return
+	}
+	wait := o.limiter.Wait(n)
+	lib.MetricAdd("essync_rate_limit_wait_seconds_total", labels, wait.Seconds())
+}
+
+// deadLetterLine 死信文件的一行，在 export 的格式上加了错误，可以直接 import 重放
+type deadLetterLine struct {
+	lib.NdjsonLine
+	Error string `json:"error"`
+}
+
+// deadLetter 把写入失败的文档连同错误追加到 log_dir/dead_letter/<目标>-NNNNN.ndjson
+func (o *jobOutput) deadLetter(log *lib.Logger, labels map[string]string, errs []lib.DocError) {
+	if len(errs) == 0 {
+		return
+	}
+	o.deadMu.Lock()
+	defer o.deadMu.Unlock()
+	if o.dead == nil {
+		o.dead = &lib.RotatingNdjsonWriter{Dir: yaml_conf.LogDir + "dead_letter", Prefix: o.key, MaxBytes: 64 << 20}
+	}
+	n := 0
+	for _, e := range errs {
+		if e.Doc == nil {
+			continue
+		}
+		index := e.Doc.TargetIndex
+		if index == "" {
+			index = e.Doc.Index
+		}
+		line := deadLetterLine{NdjsonLine: lib.NdjsonLine{Index: index, Id: e.Doc.Id, Source: e.Doc.Source}, Error: e.Err}
+		if err := o.dead.Write(line); err != nil {
+			log.Error("dead letter", "doc_id", e.Doc.Id, "err", err)
+			continue
+		}
+		n++
+	}
+	if err := o.dead.Flush(); err != nil {
+		log.Error("dead letter", "err", err)
+	}
+	lib.MetricAdd("essync_docs_dead_letter_total", labels, float64(n))
+}
+
+// lastCheckpoint 取保存的同步进度；没有时如果是唯一的来源且按 sort_field 读取，由 Sink 根据已写入的数据推算
+func (j *syncJob) lastCheckpoint(t *jobTarget) (lib.Checkpoint, bool) {
+	cp, found, err := checkpoints.Get(t.key)
+	if err != nil {
+		t.log.Error("checkpoint get", "err", err)
+	}
+	if found {
+		return cp, true
+	}
+	if t.baseKey != "" {
+		// 任务改成分区同步后各分区从之前的进度开始；分区的进度各不相同，不能从 Sink 推算
+		if cp, found, err = checkpoints.Get(t.baseKey); err != nil {
+			t.log.Error("checkpoint get", "key", t.baseKey, "err", err)
+		}
+		return cp, found
+	}
+	if _, ok := t.in.source.(*lib.EsSource); !ok || len(j.inputs) > 1 {
+		return cp, false
+	}
+	if cs, ok := t.out.sink.(lib.CheckpointSink); ok {
+		v, found, err := cs.LastSortValue(j.cfg.SortField)
+		if err != nil {
+			t.log.Error("LastSortValue", "err", err)
+		}
+		return lib.Checkpoint{Value: v}, found
+	}
+	return cp, false
+}
+
+func (t *jobTarget) checkpoint() lib.Checkpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cp
+}
+
+// saveCheckpoint 保存进度，期间进度被重置过(gen 变了)，或者本实例不再是开始写这一批时的 leader、
+// 分区已经交出去又认领回来(term 变了)、租约已经过期时不保存，避免写完手上的批次后覆盖接手实例的进度
+func (t *jobTarget) saveCheckpoint(cp lib.Checkpoint, gen int, term int64) bool {
+	if !t.in.writable(time.Now()) || t.in.term() != term {
+		return false
+	}
+	t.mu.Lock()
+	if t.gen != gen {
+		t.mu.Unlock()
+		return false
+	}
+	t.cp = cp
+	t.mu.Unlock()
+	if err := checkpoints.Set(t.key, cp); err != nil {
+		t.log.Error("checkpoint set", "err", err)
+	}
+	return true
+}
+
+// detach 目标脱离扇出，之后自己追赶
+func (t *jobTarget) detach(job *syncJob, reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.behind {
+		t.log.Warn("target detached", "reason", reason)
+		lib.MetricAdd("essync_target_detached_total", t.labels(job), 1)
+	}
+	t.behind = true
+	t.caughtUp = false
+}
+
+// reportLag 把目标相对来源的同步延迟写到指标
+func (j *syncJob) reportLag(t *jobTarget) {
+	j.reportLags([]*jobTarget{t})
+}
+
+// reportLags 统计同一来源的一组目标的延迟，进度相同的目标(扇出里没有脱离的)共用一次统计
+func (j *syncJob) reportLags(targets []*jobTarget) {
+	type measured struct {
+		cp  lib.Checkpoint
+		lag lib.Lag
+		err error
+	}
+	var done []measured
+	for _, t := range targets {
+		cp := t.checkpoint()
+		i := 0
+		for i < len(done) && !done[i].cp.Equal(cp) {
+			i++
+		}
+		if i == len(done) {
+			lag, err := t.in.source.Lag(cp)
+			done = append(done, measured{cp: cp, lag: lag, err: err})
+		}
+		if err := done[i].err; err != nil {
+			t.log.Error("Source.Lag", "err", err)
+			continue
+		}
+		j.setLag(t, cp, done[i].lag)
+	}
+}
+
+func (j *syncJob) setLag(t *jobTarget, cp lib.Checkpoint, lag lib.Lag) {
+	now := time.Now()
+	lagSec, ageSec := -1.0, -1.0
+	cpTime, cpOk := lib.SortTime(cp.Value)
+	if latest, ok := lib.SortTime(lag.Latest); ok && cpOk {
+		lagSec = math.Max(latest.Sub(cpTime).Seconds(), 0)
+	}
+	if lag.Docs == 0 {
+		lagSec = 0
+	}
+	if cpOk {
+		ageSec = math.Max(now.Sub(cpTime).Seconds(), 0)
+	}
+	t.mu.Lock()
+	t.lag = lag
+	t.lagAt = now
+	t.lagSec = lagSec
+	t.ageSec = ageSec
+	t.mu.Unlock()
+	lib.MetricSet("essync_source_lag_docs", t.labels(j), float64(lag.Docs))
+	lib.MetricSet("essync_source_lag_bytes", t.labels(j), float64(lag.Bytes))
+	if lagSec >= 0 {
+		lib.MetricSet("essync_source_lag_seconds", t.labels(j), lagSec)
+	}
+	if ageSec >= 0 {
+		lib.MetricSet("essync_checkpoint_age_seconds", t.labels(j), ageSec)
+	}
+}
+
+func (t *jobTarget) isBehind() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.behind
+}
+
+// fetch 从来源读一批，返回抽样后的文档和抽样前读到的条数；
+// 扇入时给文档标记来源，并在 _id 前加来源名避免不同来源的 id 冲突
+func (j *syncJob) fetch(ctx context.Context, in *jobInput, cp lib.Checkpoint) ([]lib.Doc, lib.Checkpoint, int, error) {
+	_, span := tracer.Start(ctx, "source.fetch", trace.WithAttributes(in.attrs...))
+	docs, next, err := in.source.Fetch(cp, j.cfg.SyncCount)
+	fetched := len(docs)
+	span.SetAttributes(attribute.Int("docs.read", fetched))
+	endSpan(span, err)
+	if j.sampler != nil && len(docs) > 0 {
+		// 抽样按原始 _id，在加来源前缀之前
+		n := len(docs)
+		docs = j.sampler.Filter(docs)
+		lib.MetricAdd("essync_sample_dropped_total", j.labels(), float64(n-len(docs)))
+	}
+	if len(j.cfg.Sources) == 0 {
+		return docs, next, fetched, err
+	}
+	p := j.cfg.Provenance
+	field := p.Field
+	if field == "" {
+		field = "origin"
+	}
+	for i := range docs {
+		origin := map[string]interface{}{"source": in.name}
+		if in.cluster != "" {
+			origin["cluster"] = in.cluster
+		}
+		if docs[i].Index != "" {
+			origin["index"] = docs[i].Index
+		}
+		lib.SetField(docs[i].Source, field, origin)
+		if !p.KeepId && docs[i].Id != "" {
+			docs[i].Id = in.name + ":" + docs[i].Id
+		}
+	}
+	return docs, next, fetched, err
+}
+
+// dispatch 把一批文档交给来源所有在扇出中的目标，缓冲满的目标最多等一个 sync_interval，
+// 之后脱离扇出自己追赶；返回是否还有目标在扇出中
+func (j *syncJob) dispatch(in *jobInput, b targetBatch) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*j.cfg.SyncInterval)
+	defer cancel()
+	attached := 0
+	// 倒序发送，第一个目标拿原始文档，其他目标拿副本，各自转换互不影响
+	for i := len(in.targets) - 1; i >= 0; i-- {
+		t := in.targets[i]
+		if t.isBehind() {
+			continue
+		}
+		tb := b
+		if i > 0 {
+			tb.docs = lib.CopyDocs(b.docs)
+		}
+		select {
+		case t.queue <- tb:
+			attached++
+			continue
+		default:
+		}
+		select {
+		case t.queue <- tb:
+			attached++
+		case <-ctx.Done():
+			t.detach(j, "buffer full")
+		}
+	}
+	return attached > 0
+}
+
+// rejoinTargets 追上来源的目标回到扇出；没有目标在扇出中时从第一个追上的目标的进度继续读
+func (j *syncJob) rejoinTargets(in *jobInput, pos lib.Checkpoint, reading bool) (lib.Checkpoint, bool) {
+	attached := 0
+	for _, t := range in.targets {
+		t.mu.Lock()
+		if t.behind && t.caughtUp && len(t.queue) == 0 {
+			if !reading {
+				pos = t.cp
+				reading = true
+			}
+			if t.cp.Equal(pos) {
+				t.behind = false
+				t.log.Info("target rejoined")
+			}
+		}
+		if !t.behind {
+			attached++
+		}
+		t.mu.Unlock()
+	}
+	return pos, attached > 0
+}
+
+// runTarget 目标的写入循环：写扇出来的批次，脱离扇出时自己读来源追赶
+func runTarget(job *syncJob, t *jobTarget) {
+	interval := time.Second * job.cfg.SyncInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	for {
+		touch(&t.beat)
+		select {
+		case b := <-t.queue:
+			job.writeBatch(t, b)
+		case <-time.After(interval):
+			if t.isBehind() && job.running(t.in) {
+				job.catchUp(t)
+			}
+		case <-job.wakeChan():
+			if t.isBehind() && job.running(t.in) {
+				job.catchUp(t)
+			}
+		}
+	}
+}
+
+// writeBatch 写一批并保存进度；批次接不上目标的进度(之前的批次失败或被丢弃)时不写
+func (j *syncJob) writeBatch(t *jobTarget, b targetBatch) bool {
+	term := t.in.term()
+	if !t.in.writable(time.Now()) {
+		// 已经不是 leader、分区交给了其他实例或租约快要过期，缓冲里剩下的批次由接手的实例重新同步
+		return false
+	}
+	t.mu.Lock()
+	cp, gen := t.cp, t.gen
+	t.mu.Unlock()
+	if !b.from.Equal(cp) {
+		t.detach(j, "checkpoint gap")
+		return false
+	}
+	begin := time.Now()
+	batchId := newBatchId()
+	parent := b.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, span := tracer.Start(parent, "sync.write", trace.WithAttributes(t.out.attrs...))
+	span.SetAttributes(attribute.String("batch_id", batchId), attribute.Int("docs", len(b.docs)))
+	b.ctx = ctx
+	var res lib.BulkResult
+	if len(b.docs) > 0 {
+		var err error
+		res, err = writeDocs(ctx, j, t.out, t.log, t.labels(j), batchId, b.docs)
+		if err != nil {
+			j.recordError(t.key, err)
+			j.batchEvent(t, b, batchId, res, err, time.Since(begin))
+			endSpan(span, err)
+			t.detach(j, "write failed")
+			return false
+		}
+		atomic.AddInt64(&t.synced, int64(res.Succeeded))
+		if retry := res.RetryDocs(); len(retry) > 0 {
+			// 重试后目标仍然拒绝的文档不能跳过，不保存进度，脱离扇出后从当前进度重读这一批
+			err := fmt.Errorf("%d docs still rejected by the target after %d retries", len(retry), writeRetries)
+			j.recordError(t.key, err)
+			j.batchEvent(t, b, batchId, res, err, time.Since(begin))
+			endSpan(span, err)
+			t.detach(j, "write rejected")
+			return false
+		}
+	}
+	span.SetAttributes(attribute.Int("docs.written", res.Succeeded), attribute.Int("docs.failed", res.Failed))
+	span.End()
+	if !t.saveCheckpoint(b.next, gen, term) {
+		return false
+	}
+	j.batchEvent(t, b, batchId, res, nil, time.Since(begin))
+	j.reportLag(t)
+	return true
+}
+
+// catchUp 脱离扇出的目标从自己的进度读来源，读到最新时标记为已追上
+func (j *syncJob) catchUp(t *jobTarget) {
+	for len(t.queue) == 0 && j.running(t.in) {
+		touch(&t.beat)
+		cp := t.checkpoint()
+		begin := time.Now()
+		ctx, span := tracer.Start(context.Background(), "sync.catch_up", trace.WithAttributes(t.in.attrs...))
+		span.SetAttributes(attribute.String("target", t.out.key))
+		docs, next, fetched, err := j.fetch(ctx, t.in, cp)
+		if err != nil {
+			withTrace(t.log, ctx).Error("Source.Fetch", "err", err)
+			j.recordError(t.key, err)
+			j.readErrorEvent(ctx, t.in, cp, err, time.Since(begin))
+			endSpan(span, err)
+			return
+		}
+		t.mu.Lock()
+		t.caughtUp = fetched == 0 && next.Equal(cp)
+		t.mu.Unlock()
+		if fetched == 0 && next.Equal(cp) {
+			span.End()
+			return
+		}
+		ok := j.writeBatch(t, targetBatch{docs: docs, from: cp, next: next, read: fetched, ctx: ctx})
+		span.End()
+		if !ok {
+			return
+		}
+	}
+}
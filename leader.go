@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"essync/lib"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"os"
+	"sync"
+	"time"
+)
+
+// leaseDoc 租约文档，holder 为空表示 leader 已主动释放
+type leaseDoc struct {
+	Type       string    `json:"type"`
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	RenewedAt  time.Time `json:"renewed_at"`
+	TtlSeconds float64   `json:"ttl_seconds"`
+}
+
+// leaderElector 通过租约文档选主：写入都带 if_seq_no/if_primary_term，同时只有一个实例能写成功。
+// 备用实例看到租约版本 ttl 内没有变化就接管，不依赖各实例的时钟一致；
+// leader 超过 ttl - renew_interval 没有续约成功时主动退出，保证在备用实例接管之前停止写入
+type leaderElector struct {
+	client   *elasticsearch.Client
+	index    string
+	lease    string
+	identity string
+	ttl      time.Duration
+	renew    time.Duration
+	log      *lib.Logger
+
+	mu         sync.Mutex
+	leader     bool
+	stopped    bool
+	term       int64            // 每次成为 leader 加一，读取循环据此重新加载进度
+	doc        lib.VersionedDoc // 最近一次看到或写入的租约
+	holder     string
+	acquiredAt time.Time
+	lastRenew  time.Time
+	seenAt     time.Time // 租约版本最近一次变化的时间(本机时钟)
+	changed    chan struct{}
+}
+
+// election 没有开启 leader_election 时为 nil，本实例总是 leader
+var election *leaderElector
+
+func initElection() error {
+	cfg := yaml_conf.LeaderElection
+	if !cfg.Enabled {
+		return nil
+	}
+	esCfg := cfg.TargetEs
+	if len(esCfg.Hosts) == 0 {
+		esCfg = yaml_conf.TargetEs
+	}
+	client, err := getTargetClient(esCfg)
+	if err != nil {
+		return err
+	}
+	e := &leaderElector{
+		client:   client,
+		index:    cfg.Index,
+		lease:    cfg.Lease,
+		identity: cfg.Identity,
+		ttl:      time.Second * cfg.Ttl,
+		renew:    time.Second * cfg.RenewInterval,
+		changed:  make(chan struct{}),
+	}
+	if e.index == "" {
+		e.index = "essync-leader"
+	}
+	if e.lease == "" {
+		e.lease = "essync"
+	}
+	if e.identity == "" {
+		e.identity = defaultIdentity()
+	}
+	if e.ttl <= 0 {
+		e.ttl = 30 * time.Second
+	}
+	if e.renew <= 0 {
+		e.renew = e.ttl / 3
+	}
+	if e.renew >= e.ttl {
+		return errors.New("leader_election.renew_interval must be less than ttl")
+	}
+	e.log = lib.NewLogger("leader").With("lease", e.lease, "identity", e.identity)
+	lib.MetricSet("essync_leader", nil, 0)
+	election = e
+	return nil
+}
+
+// defaultIdentity 没有配置 identity 时用 主机名:pid
+func defaultIdentity() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// isLeader 本实例是否可以同步和清理
+func isLeader() bool {
+	if election == nil {
+		return true
+	}
+	election.mu.Lock()
+	defer election.mu.Unlock()
+	return election.leader
+}
+
+// leaseValidUntil 本实例作为 leader 最晚写到什么时候：最近一次续约之后 ttl - renew_interval，
+// 过了这个时间备用实例可能已经接管；ok 为 false 表示没有开启选主
+func leaseValidUntil() (until time.Time, ok bool) {
+	if election == nil {
+		return until, false
+	}
+	election.mu.Lock()
+	defer election.mu.Unlock()
+	return election.lastRenew.Add(election.ttl - election.renew), true
+}
+
+// leaderTerm 本实例成为 leader 的次数，没有开启选主时为 0
+func leaderTerm() int64 {
+	if election == nil {
+		return 0
+	}
+	election.mu.Lock()
+	defer election.mu.Unlock()
+	return election.term
+}
+
+// waitLeader 等到本实例成为 leader
+func waitLeader() {
+	for election != nil {
+		election.mu.Lock()
+		leader, changed := election.leader, election.changed
+		election.mu.Unlock()
+		if leader {
+			return
+		}
+		<-changed
+	}
+}
+
+func (e *leaderElector) run() {
+	e.log.Info("leader election started", "index", e.index, "ttl", e.ttl.String(), "renew_interval", e.renew.String())
+	for {
+		e.step(time.Now())
+		time.Sleep(e.renew)
+	}
+}
+
+// callContext 租约请求的超时：不超过 ttl - renew_interval，是 leader 时也不超过必须续约成功的时间，
+// 请求卡住时能及时退出 leader，不会在备用实例接管后还在写
+func (e *leaderElector) callContext(now time.Time) (context.Context, context.CancelFunc) {
+	deadline := now.Add(e.ttl - e.renew)
+	e.mu.Lock()
+	if e.leader {
+		if d := e.lastRenew.Add(e.ttl - e.renew); d.Before(deadline) {
+			deadline = d
+		}
+	}
+	e.mu.Unlock()
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+// step 读租约：自己持有就续约，释放了或 ttl 内没有变化就接管，否则作为备用
+func (e *leaderElector) step(now time.Time) {
+	ctx, cancel := e.callContext(now)
+	defer cancel()
+	doc, err := lib.GetVersioned(ctx, e.client, e.index, e.lease)
+	if err != nil {
+		e.log.Error("get lease", "err", err)
+		e.checkRenewed(time.Now())
+		return
+	}
+	var lease leaseDoc
+	if doc.Found {
+		if err := json.Unmarshal(doc.Source, &lease); err != nil {
+			e.log.Error("decode lease", "err", err)
+			return
+		}
+	}
+	e.mu.Lock()
+	if e.stopped {
+		e.mu.Unlock()
+		return
+	}
+	if doc.Found != e.doc.Found || doc.SeqNo != e.doc.SeqNo || doc.PrimaryTerm != e.doc.PrimaryTerm || e.seenAt.IsZero() {
+		e.seenAt = now
+	}
+	e.doc = doc
+	e.holder = lease.Holder
+	seenAt := e.seenAt
+	e.mu.Unlock()
+	switch {
+	case doc.Found && lease.Holder == e.identity:
+		lease.RenewedAt = now
+		lease.TtlSeconds = e.ttl.Seconds()
+		e.write(ctx, doc, lease, now)
+	case !doc.Found || lease.Holder == "" || now.Sub(seenAt) >= e.ttl:
+		if lease.Holder != "" {
+			e.log.Warn("lease expired, taking over", "holder", lease.Holder, "unchanged", now.Sub(seenAt).String())
+		}
+		e.write(ctx, doc, leaseDoc{Type: "lease", Holder: e.identity, AcquiredAt: now, RenewedAt: now, TtlSeconds: e.ttl.Seconds()}, now)
+	default:
+		e.setLeader(false, "lease held by "+lease.Holder)
+	}
+}
+
+// write 带版本写租约，冲突说明别的实例先写了
+func (e *leaderElector) write(ctx context.Context, prev lib.VersionedDoc, lease leaseDoc, now time.Time) {
+	next, err := lib.PutVersioned(ctx, e.client, e.index, e.lease, lease, prev)
+	if err == lib.ErrVersionConflict {
+		e.setLeader(false, "lease taken by another instance")
+		return
+	}
+	if err != nil {
+		e.log.Error("write lease", "err", err)
+		e.checkRenewed(time.Now())
+		return
+	}
+	e.mu.Lock()
+	e.doc = next
+	e.holder = lease.Holder
+	e.acquiredAt = lease.AcquiredAt
+	e.lastRenew = now
+	e.seenAt = now
+	e.mu.Unlock()
+	e.setLeader(true, "")
+}
+
+// checkRenewed 续约失败时，超过 ttl - renew_interval 没有续约成功就退出 leader
+func (e *leaderElector) checkRenewed(now time.Time) {
+	e.mu.Lock()
+	expired := e.leader && now.Sub(e.lastRenew) >= e.ttl-e.renew
+	e.mu.Unlock()
+	if expired {
+		e.setLeader(false, "lease not renewed in time")
+	}
+}
+
+// setLeader 切换状态后唤醒所有任务，让读取循环和清理循环重新检查
+func (e *leaderElector) setLeader(leader bool, reason string) {
+	e.mu.Lock()
+	if e.leader == leader {
+		e.mu.Unlock()
+		return
+	}
+	e.leader = leader
+	if leader {
+		e.term++
+	}
+	close(e.changed)
+	e.changed = make(chan struct{})
+	e.mu.Unlock()
+	if leader {
+		e.log.Info("became leader")
+		lib.MetricSet("essync_leader", nil, 1)
+		lib.MetricAdd("essync_leader_transitions_total", nil, 1)
+	} else {
+		e.log.Warn("lost leadership", "reason", reason)
+		lib.MetricSet("essync_leader", nil, 0)
+	}
+	for _, job := range jobs {
+		job.wakeAll()
+	}
+}
+
+// release 退出前释放租约，备用实例不用等 ttl 就能接管
+func (e *leaderElector) release() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.stopped = true
+	leader, doc, acquiredAt := e.leader, e.doc, e.acquiredAt
+	e.mu.Unlock()
+	if !leader {
+		return
+	}
+	e.setLeader(false, "shutdown")
+	now := time.Now()
+	lease := leaseDoc{Type: "lease", AcquiredAt: acquiredAt, RenewedAt: now, TtlSeconds: e.ttl.Seconds()}
+	ctx, cancel := context.WithTimeout(context.Background(), e.ttl-e.renew)
+	defer cancel()
+	if _, err := lib.PutVersioned(ctx, e.client, e.index, e.lease, lease, doc); err != nil {
+		e.log.Error("release lease", "err", err)
+		return
+	}
+	e.log.Info("lease released")
+}
+
+type leaderStatus struct {
+	Enabled    bool       `json:"enabled"`
+	Identity   string     `json:"identity,omitempty"`
+	Leader     bool       `json:"leader"`
+	Holder     string     `json:"holder,omitempty"`
+	Term       int64      `json:"term"`
+	AcquiredAt *time.Time `json:"acquired_at,omitempty"`
+	LastRenew  *time.Time `json:"last_renew,omitempty"`
+	Ttl        float64    `json:"ttl_seconds,omitempty"`
+}
+
+func leaderView() leaderStatus {
+	if election == nil {
+		return leaderStatus{Leader: true}
+	}
+	e := election
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s := leaderStatus{
+		Enabled:   true,
+		Identity:  e.identity,
+		Leader:    e.leader,
+		Holder:    e.holder,
+		Term:      e.term,
+		LastRenew: timePtr(e.lastRenew),
+		Ttl:       e.ttl.Seconds(),
+	}
+	if e.leader {
+		s.AcquiredAt = timePtr(e.acquiredAt)
+	}
+	return s
+}
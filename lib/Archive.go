@@ -0,0 +1,462 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const ArchiveManifestName = "manifest.json"
+
+type ArchiveFile struct {
+	Day       string `json:"day"`
+	Count     int64  `json:"count"`
+	Sha256    string `json:"sha256"`
+	Bytes     int64  `json:"bytes"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+type ArchiveManifest struct {
+	Files map[string]*ArchiveFile `json:"files"`
+}
+
+// ArchivedDoc 已经归档、等待删除的文档，写入时带了 routing 的删除时也要带上
+type ArchivedDoc struct {
+	Index   string `json:"_index"`
+	Id      string `json:"_id"`
+	Routing string `json:"routing,omitempty"`
+}
+
+type ArchiveResult struct {
+	Count int64
+	Days  map[string]int64
+	Docs  []ArchivedDoc // 要删除的文档：这一轮归档的，加上之前归档了但没有删掉的
+}
+
+// ArchiveExpired exports every document matching query into dir as gzip NDJSON,
+// one file per day of dateField. Each run is written to a part file and verified, then appended
+// day by day to the day file as a new gzip member, read back, and recorded in the manifest.
+// Only the returned Docs may be deleted afterwards (DeleteArchived); they are kept in a pending
+// file until deleted, so a later run does not archive them a second time.
+func ArchiveExpired(es *elasticsearch.Client, indexName string, query EsQuery, dateField string, dir string, scrollSize int) (ArchiveResult, error) {
+	result := ArchiveResult{Days: map[string]int64{}}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return result, err
+	}
+	pending, err := readArchivePending(dir, indexName)
+	if err != nil {
+		return result, err
+	}
+	skip := make(map[ArchivedDoc]bool, len(pending))
+	for _, d := range pending {
+		skip[d] = true
+	}
+	archivedDays := map[string][]ArchivedDoc{}
+	runId := strconv.FormatInt(time.Now().UnixNano(), 10)
+	writers := map[string]*NdjsonWriter{}
+	parts := map[string]string{}
+	cleanup := func() {
+		for day, w := range writers {
+			w.Close()
+			os.Remove(parts[day])
+		}
+	}
+	_, err = Scroll(es, indexName, query, scrollSize, time.Minute, func(hits []*SearchResponseHitsHits) error {
+		for _, hit := range hits {
+			ref := ArchivedDoc{Index: hit.Index, Id: hit.ID, Routing: hit.Routing}
+			if skip[ref] {
+				// 上一轮已经归档，只是没有删掉
+				continue
+			}
+			day := docDay(hit.Source, dateField)
+			archivedDays[day] = append(archivedDays[day], ref)
+			w, ok := writers[day]
+			if !ok {
+				part := filepath.Join(dir, archiveFileName(indexName, day)+"."+runId+".part")
+				nw, err := NewNdjsonWriter(part, true)
+				if err != nil {
+					return err
+				}
+				w = nw
+				writers[day] = w
+				parts[day] = part
+			}
+			if err := w.Write(hit); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		cleanup()
+		return result, err
+	}
+	// 先全部落盘并校验，任何一天失败都不动正式文件
+	for day, w := range writers {
+		if err := w.Close(); err != nil {
+			cleanup()
+			return result, err
+		}
+		count, sum, err := NdjsonDigest(parts[day])
+		if err != nil {
+			cleanup()
+			return result, err
+		}
+		if count != w.Count() || sum != w.Sum() {
+			cleanup()
+			return result, fmt.Errorf("archive verify %s: wrote %d docs (%s), read back %d (%s)", parts[day], w.Count(), w.Sum(), count, sum)
+		}
+	}
+	manifest, err := ReadArchiveManifest(dir)
+	if err != nil {
+		cleanup()
+		return result, err
+	}
+	days := make([]string, 0, len(writers))
+	for day := range writers {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	result.Docs = pending
+	// 一天一天追加，每追加成功一天就记到待删除列表和 manifest 里，后面的天失败时前面的不会再归档一次
+	for i, day := range days {
+		name := archiveFileName(indexName, day)
+		path := filepath.Join(dir, name)
+		undo, err := appendArchive(path, parts[day])
+		if err == nil {
+			err = recordArchiveDay(dir, indexName, manifest, name, day, writers[day].Count(), append(result.Docs, archivedDays[day]...))
+			if err != nil {
+				undo()
+				// 待删除列表可能已经写了这一天，换回之前的
+				writeArchivePending(dir, indexName, result.Docs)
+			}
+		}
+		if err != nil {
+			for _, d := range days[i:] {
+				os.Remove(parts[d])
+			}
+			return result, err
+		}
+		os.Remove(parts[day])
+		result.Docs = append(result.Docs, archivedDays[day]...)
+		result.Days[day] = writers[day].Count()
+		result.Count += writers[day].Count()
+	}
+	return result, nil
+}
+
+// recordArchiveDay 在 manifest 里记下追加到 name 的 count 条，先写待删除列表 docs 再写 manifest
+func recordArchiveDay(dir string, indexName string, manifest *ArchiveManifest, name string, day string, count int64, docs []ArchivedDoc) error {
+	sum, size, err := FileSha256(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	if err := writeArchivePending(dir, indexName, docs); err != nil {
+		return err
+	}
+	entry, ok := manifest.Files[name]
+	if !ok {
+		entry = &ArchiveFile{Day: day}
+		manifest.Files[name] = entry
+	}
+	prev := *entry
+	entry.Count += count
+	entry.Sha256 = sum
+	entry.Bytes = size
+	entry.UpdatedAt = time.Now().Format(time.RFC3339)
+	if err := writeArchiveManifest(dir, manifest); err != nil {
+		if ok {
+			*entry = prev
+		} else {
+			delete(manifest.Files, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// DeleteArchived deletes exactly the given documents with _bulk, so documents indexed after the archive ran
+// are left for the next run. Documents that could not be deleted stay in the pending file;
+// it returns how many were deleted and how many are still pending.
+func DeleteArchived(es *elasticsearch.Client, dir string, indexName string, docs []ArchivedDoc) (int64, int, error) {
+	var deleted int64
+	var failed []ArchivedDoc
+	var err error
+	for start := 0; start < len(docs); start += archiveDeleteBatch {
+		end := start + archiveDeleteBatch
+		if end > len(docs) {
+			end = len(docs)
+		}
+		var n int64
+		var left []ArchivedDoc
+		if n, left, err = bulkDelete(es, docs[start:end]); err != nil {
+			failed = append(failed, docs[start:]...)
+			break
+		}
+		deleted += n
+		failed = append(failed, left...)
+	}
+	if werr := writeArchivePending(dir, indexName, failed); err == nil {
+		err = werr
+	}
+	return deleted, len(failed), err
+}
+
+const archiveDeleteBatch = 1000
+
+// bulkDelete 删除一批文档，已经不存在的也算删除成功，返回没有删掉的
+func bulkDelete(es *elasticsearch.Client, docs []ArchivedDoc) (int64, []ArchivedDoc, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, d := range docs {
+		if err := enc.Encode(map[string]interface{}{"delete": d}); err != nil {
+			return 0, nil, err
+		}
+	}
+	res, err := es.Bulk(&buf, es.Bulk.WithContext(context.Background()))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return 0, nil, errors.New("bulk delete: " + res.String())
+	}
+	var r struct {
+		Items []map[string]struct {
+			Status int `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return 0, nil, err
+	}
+	var deleted int64
+	var left []ArchivedDoc
+	for i, item := range r.Items {
+		for _, v := range item {
+			switch {
+			case v.Status >= 200 && v.Status < 300:
+				deleted++
+			case v.Status == 404:
+			default:
+				if i < len(docs) {
+					left = append(left, docs[i])
+				}
+			}
+		}
+	}
+	return deleted, left, nil
+}
+
+func archivePendingName(indexName string) string {
+	return indexName + ".pending.ndjson"
+}
+
+func readArchivePending(dir string, indexName string) ([]ArchivedDoc, error) {
+	var docs []ArchivedDoc
+	f, err := os.Open(filepath.Join(dir, archivePendingName(indexName)))
+	if os.IsNotExist(err) {
+		return docs, nil
+	}
+	if err != nil {
+		return docs, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	for {
+		var d ArchivedDoc
+		if err := dec.Decode(&d); err == io.EOF {
+			return docs, nil
+		} else if err != nil {
+			return docs, err
+		}
+		docs = append(docs, d)
+	}
+}
+
+// writeArchivePending 替换待删除列表，为空时删掉文件
+func writeArchivePending(dir string, indexName string, docs []ArchivedDoc) error {
+	path := filepath.Join(dir, archivePendingName(indexName))
+	if len(docs) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, d := range docs {
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func ReadArchiveManifest(dir string) (*ArchiveManifest, error) {
+	manifest := &ArchiveManifest{Files: map[string]*ArchiveFile{}}
+	data, err := ioutil.ReadFile(filepath.Join(dir, ArchiveManifestName))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return manifest, err
+	}
+	if manifest.Files == nil {
+		manifest.Files = map[string]*ArchiveFile{}
+	}
+	return manifest, nil
+}
+
+func writeArchiveManifest(dir string, manifest *ArchiveManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, ArchiveManifestName+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, ArchiveManifestName))
+}
+
+func archiveFileName(indexName string, day string) string {
+	return indexName + "-" + day + ".ndjson.gz"
+}
+
+// appendArchive 把校验过的 part 作为新的 gzip member 追加到 path，再读回追加的部分和 part 逐字节比对。
+// 失败时把 path 截回追加前的大小(原来没有就删掉)；成功时返回撤销追加的函数
+func appendArchive(path string, part string) (func() error, error) {
+	var prev int64
+	info, err := os.Stat(path)
+	existed := err == nil
+	if existed {
+		prev = info.Size()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	undo := func() error {
+		if !existed {
+			return os.Remove(path)
+		}
+		return os.Truncate(path, prev)
+	}
+	want, size, err := FileSha256(part)
+	if err != nil {
+		return nil, err
+	}
+	err = appendFile(path, part)
+	if err == nil {
+		got, n, rerr := fileSha256From(path, prev)
+		if err = rerr; err == nil && (n != size || got != want) {
+			err = fmt.Errorf("archive verify %s: appended %d bytes (%s), read back %d (%s)", path, size, want, n, got)
+		}
+	}
+	if err != nil {
+		if uerr := undo(); uerr != nil {
+			err = fmt.Errorf("%v; truncate back to %d bytes: %v", err, prev, uerr)
+		}
+		return nil, err
+	}
+	return undo, nil
+}
+
+// appendFile 把 part 追加到 path，gzip 允许多个 member 直接拼接
+func appendFile(path string, part string) error {
+	src, err := os.Open(part)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// fileSha256From path 从 offset 开始到结尾的 sha256 和字节数
+func fileSha256From(path string, offset int64) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// docDay 取文档日期字段所在的日期，数值按秒或毫秒时间戳处理
+func docDay(source json.RawMessage, dateField string) string {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(source))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return "unknown"
+	}
+	switch v := doc[dateField].(type) {
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			f, ferr := v.Float64()
+			if ferr != nil {
+				return "unknown"
+			}
+			n = int64(f)
+		}
+		return EpochTime(n).Format("2006-01-02")
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"} {
+			if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+				return t.Local().Format("2006-01-02")
+			}
+		}
+		// 其他格式只认开头的 YYYY-MM-DD，日期会用在文件名里
+		if len(v) >= 10 {
+			if _, err := time.Parse("2006-01-02", v[:10]); err == nil {
+				return v[:10]
+			}
+		}
+	}
+	return "unknown"
+}
+
+// EpochTime 把秒或毫秒时间戳转成时间，大于 1e11 的按毫秒处理
+func EpochTime(n int64) time.Time {
+	if n > 1e11 || n < -1e11 {
+		return time.Unix(n/1000, (n%1000)*int64(time.Millisecond))
+	}
+	return time.Unix(n, 0)
+}
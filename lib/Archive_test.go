@@ -0,0 +1,211 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// scrollEs 一页返回索引里的全部文档
+type scrollEs struct {
+	mu   sync.Mutex
+	hits []map[string]interface{}
+}
+
+func (f *scrollEs) set(docs map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hits = nil
+	for id, day := range docs {
+		f.hits = append(f.hits, map[string]interface{}{
+			"_index": "logs", "_id": id, "_source": map[string]string{"ts": day + " 10:00:00"},
+		})
+	}
+}
+
+func (f *scrollEs) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.URL.Path == "/logs/_search":
+		writeJson(w, 200, map[string]interface{}{"_scroll_id": "s1", "hits": map[string]interface{}{"hits": f.hits}})
+	case r.URL.Path == "/_search/scroll" && r.Method != http.MethodDelete:
+		writeJson(w, 200, map[string]interface{}{"_scroll_id": "s1", "hits": map[string]interface{}{"hits": []interface{}{}}})
+	default:
+		writeJson(w, 200, map[string]interface{}{})
+	}
+}
+
+func archiveDays(t *testing.T, dir string) map[string]int64 {
+	t.Helper()
+	days := map[string]int64{}
+	for _, day := range []string{"2024-01-01", "2024-01-02"} {
+		path := filepath.Join(dir, archiveFileName("logs", day))
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		count, _, err := NdjsonDigest(path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		days[day] = count
+	}
+	return days
+}
+
+func TestArchiveExpired(t *testing.T) {
+	f := &scrollEs{}
+	es := newTestEs(t, f.handle)
+	dir := t.TempDir()
+	archive := func() (ArchiveResult, error) {
+		return ArchiveExpired(es, "logs", EsQuery{}, "ts", dir, 100)
+	}
+	f.set(map[string]string{"a": "2024-01-01", "b": "2024-01-01", "c": "2024-01-02"})
+
+	// 第二天追加失败：第一天已经追加的要记下，第二天什么都不留
+	blocker := filepath.Join(dir, archiveFileName("logs", "2024-01-02"))
+	if err := os.Mkdir(blocker, 0755); err != nil {
+		t.Fatal(err)
+	}
+	res, err := archive()
+	if err == nil {
+		t.Fatal("append to a directory succeeded")
+	}
+	if res.Count != 2 || len(res.Docs) != 2 {
+		t.Fatalf("partial run archived %d, docs %v", res.Count, res.Docs)
+	}
+	pending, _ := readArchivePending(dir, "logs")
+	manifest, _ := ReadArchiveManifest(dir)
+	if len(pending) != 2 || len(manifest.Files) != 1 || manifest.Files[archiveFileName("logs", "2024-01-01")].Count != 2 {
+		t.Fatalf("after partial run pending %v, manifest %+v", pending, manifest.Files)
+	}
+	parts, _ := filepath.Glob(filepath.Join(dir, "*.part"))
+	if len(parts) != 0 {
+		t.Fatalf("part files left: %v", parts)
+	}
+	os.Remove(blocker)
+
+	// 重跑只归档第二天，第一天不重复
+	res, err = archive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Count != 1 || len(res.Docs) != 3 {
+		t.Fatalf("second run archived %d, docs %v", res.Count, res.Docs)
+	}
+	if days := archiveDays(t, dir); days["2024-01-01"] != 2 || days["2024-01-02"] != 1 {
+		t.Fatalf("day files hold %v", days)
+	}
+	manifest, _ = ReadArchiveManifest(dir)
+	for name, entry := range manifest.Files {
+		sum, size, _ := FileSha256(filepath.Join(dir, name))
+		if entry.Sha256 != sum || entry.Bytes != size {
+			t.Errorf("manifest %s: %+v, file %s %d", name, entry, sum, size)
+		}
+	}
+
+	// 删掉之后新的文档接着追加成新的 gzip member
+	if _, left, err := DeleteArchived(newTestEs(t, deleteAll), dir, "logs", res.Docs); err != nil || left != 0 {
+		t.Fatalf("delete: %d left, %v", left, err)
+	}
+	f.set(map[string]string{"d": "2024-01-01"})
+	if _, err := archive(); err != nil {
+		t.Fatal(err)
+	}
+	if days := archiveDays(t, dir); days["2024-01-01"] != 3 {
+		t.Fatalf("day files hold %v", days)
+	}
+}
+
+// deleteAll 回答 _bulk 删除，每条都成功
+func deleteAll(w http.ResponseWriter, r *http.Request) {
+	var items []interface{}
+	dec := json.NewDecoder(r.Body)
+	for {
+		var action map[string]interface{}
+		if dec.Decode(&action) != nil {
+			break
+		}
+		items = append(items, map[string]interface{}{"delete": map[string]int{"status": 200}})
+	}
+	writeJson(w, 200, map[string]interface{}{"items": items})
+}
+
+func TestAppendArchiveUndo(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "day.ndjson.gz")
+	part := filepath.Join(dir, "day.part")
+	ioutil.WriteFile(path, []byte("first"), 0644)
+	ioutil.WriteFile(part, []byte("second"), 0644)
+	undo, err := appendArchive(path, part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "firstsecond" {
+		t.Fatalf("appended %q", data)
+	}
+	if err := undo(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "first" {
+		t.Fatalf("after undo %q", data)
+	}
+	if _, err := appendArchive(filepath.Join(dir, "new.ndjson.gz"), filepath.Join(dir, "missing.part")); err == nil {
+		t.Fatal("missing part appended")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new.ndjson.gz")); !os.IsNotExist(err) {
+		t.Fatalf("failed append left a day file: %v", err)
+	}
+}
+
+func TestDocDay(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{`{"ts": "2024-01-02 10:00:00"}`, "2024-01-02"},
+		{`{"ts": "2024-01-02"}`, "2024-01-02"},
+		{`{"ts": "2024-01-02T10:00:00 CST"}`, "2024-01-02"},
+		{`{"ts": "not a date"}`, "unknown"},
+		{`{"ts": "../../etc/x"}`, "unknown"},
+		{`{}`, "unknown"},
+		{`not json`, "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			if got := docDay(json.RawMessage(tt.source), "ts"); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if got := docDay(json.RawMessage(fmt.Sprintf(`{"ts": %d}`, EpochTime(1700000000).Unix())), "ts"); !strings.HasPrefix(got, "2023-11-") {
+		t.Fatalf("epoch seconds: %q", got)
+	}
+}
+
+func TestDeleteArchivedRouting(t *testing.T) {
+	var actions []string
+	es := newTestEs(t, func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		actions = strings.Split(strings.TrimSpace(string(data)), "\n")
+		writeJson(w, 200, map[string]interface{}{"items": []interface{}{
+			map[string]interface{}{"delete": map[string]int{"status": 200}},
+			map[string]interface{}{"delete": map[string]int{"status": 404}},
+		}})
+	})
+	docs := []ArchivedDoc{{Index: "logs", Id: "a", Routing: "tenant1"}, {Index: "logs", Id: "b"}}
+	deleted, left, err := DeleteArchived(es, t.TempDir(), "logs", docs)
+	if err != nil || deleted != 1 || left != 0 {
+		t.Fatalf("deleted %d, left %d, %v", deleted, left, err)
+	}
+	want := []string{`{"delete":{"_index":"logs","_id":"a","routing":"tenant1"}}`, `{"delete":{"_index":"logs","_id":"b"}}`}
+	if strings.Join(actions, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("bulk body %q", actions)
+	}
+}
@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Checkpoint 同步进度，elasticsearch 来源用 Value 记录已写入的最大 sort_field 值，Ids 为这个值上已经写入的 _id，
+// 文件来源用 Path/Inode/Offset 记录读到的位置
+type Checkpoint struct {
+	Value     interface{} `json:"value,omitempty"`
+	Ids       []string    `json:"ids,omitempty"`
+	Path      string      `json:"path,omitempty"`
+	Inode     uint64      `json:"inode,omitempty"`
+	Offset    int64       `json:"offset,omitempty"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// Equal compares the position, ignoring UpdatedAt.
+func (c Checkpoint) Equal(o Checkpoint) bool {
+	return c.Path == o.Path && c.Inode == o.Inode && c.Offset == o.Offset && FieldString(c.Value) == FieldString(o.Value) && sameIds(c.Ids, o.Ids)
+}
+
+func sameIds(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckpointStore 以 json 文件保存每个任务的同步进度，文件名为 key.checkpoint.json
+type CheckpointStore struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+func NewCheckpointStore(dir string) (*CheckpointStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &CheckpointStore{Dir: dir}, nil
+}
+
+func (s *CheckpointStore) path(key string) string {
+	key = strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(key)
+	return filepath.Join(s.Dir, key+".checkpoint.json")
+}
+
+// Get returns the stored checkpoint; found is false when none was saved yet.
+func (s *CheckpointStore) Get(key string) (Checkpoint, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cp Checkpoint
+	data, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return cp, false, nil
+	}
+	if err != nil {
+		return cp, false, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&cp); err != nil {
+		return cp, false, err
+	}
+	return cp, true, nil
+}
+
+func (s *CheckpointStore) Set(key string, cp Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp.UpdatedAt = time.Now()
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := s.path(key) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(key))
+}
+
+func (s *CheckpointStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Health checks that the store directory is writable.
+func (s *CheckpointStore) Health(ctx context.Context) error {
+	f, err := ioutil.TempFile(s.Dir, ".health")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/elastic/go-elasticsearch/v7"
+	"time"
+)
+
+// Checkpoints 保存同步进度的地方：本地 json 文件(CheckpointStore)或 elasticsearch 索引(EsCheckpointStore)
+type Checkpoints interface {
+	Get(key string) (Checkpoint, bool, error)
+	Set(key string, cp Checkpoint) error
+	Delete(key string) error
+	Health(ctx context.Context) error
+}
+
+// EsCheckpointStore 把同步进度存到 elasticsearch 索引，多个 essync 实例共用；
+// 文档 id 为 checkpoint:key，进度以 json 字符串保存，避免不同来源的值类型在索引里冲突。
+// 索引里没有时从 Fallback 读，方便从本地文件迁移
+type EsCheckpointStore struct {
+	Client   *elasticsearch.Client
+	Index    string
+	Fallback Checkpoints
+}
+
+type esCheckpointDoc struct {
+	Type       string    `json:"type"`
+	Key        string    `json:"key"`
+	Checkpoint string    `json:"checkpoint"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func NewEsCheckpointStore(es *elasticsearch.Client, indexName string, fallback Checkpoints) *EsCheckpointStore {
+	return &EsCheckpointStore{Client: es, Index: indexName, Fallback: fallback}
+}
+
+func (s *EsCheckpointStore) id(key string) string {
+	return "checkpoint:" + key
+}
+
+func (s *EsCheckpointStore) Get(key string) (Checkpoint, bool, error) {
+	var cp Checkpoint
+	doc, err := GetVersioned(context.Background(), s.Client, s.Index, s.id(key))
+	if err != nil {
+		return cp, false, err
+	}
+	if !doc.Found {
+		if s.Fallback != nil {
+			return s.Fallback.Get(key)
+		}
+		return cp, false, nil
+	}
+	var d esCheckpointDoc
+	if err := json.Unmarshal(doc.Source, &d); err != nil {
+		return cp, false, err
+	}
+	dec := json.NewDecoder(bytes.NewReader([]byte(d.Checkpoint)))
+	dec.UseNumber()
+	if err := dec.Decode(&cp); err != nil {
+		return cp, false, err
+	}
+	return cp, true, nil
+}
+
+func (s *EsCheckpointStore) Set(key string, cp Checkpoint) error {
+	cp.UpdatedAt = time.Now()
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	d := esCheckpointDoc{Type: "checkpoint", Key: key, Checkpoint: string(data), UpdatedAt: cp.UpdatedAt}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(d); err != nil {
+		return err
+	}
+	res, err := s.Client.Index(s.Index, &buf, s.Client.Index.WithDocumentID(s.id(key)))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return errors.New("index: " + res.String())
+	}
+	return nil
+}
+
+func (s *EsCheckpointStore) Delete(key string) error {
+	res, err := s.Client.Delete(s.Index, s.id(key))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != 404 {
+		return errors.New("delete: " + res.String())
+	}
+	return nil
+}
+
+// Health checks that the cluster is reachable and the index accepts writes.
+func (s *EsCheckpointStore) Health(ctx context.Context) error {
+	if err := ClusterHealth(ctx, s.Client); err != nil {
+		return err
+	}
+	return IndexWritable(ctx, s.Client, s.Index)
+}
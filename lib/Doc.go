@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// Doc 同步过程中的一条文档，Index 是读取来源的索引，TargetIndex 为空时写入任务配置的目标索引
+type Doc struct {
+	Index       string
+	Id          string
+	Source      map[string]interface{}
+	TargetIndex string
+}
+
+// DocError 单条文档的错误，日志里 Id 作为 doc_id 字段输出。
+// Doc 是没写进去或转换失败的文档，Retriable 表示目标暂时拒绝(429)，稍后重写可能成功
+type DocError struct {
+	Id        string
+	Err       string
+	Retriable bool
+	Doc       *Doc
+}
+
+func (e DocError) Error() string {
+	return e.Id + ": " + e.Err
+}
+
+// DecodeSource decodes a _source keeping numbers as json.Number so int64 values survive the round trip.
+func DecodeSource(raw []byte) (map[string]interface{}, error) {
+	var source map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&source); err != nil {
+		return nil, err
+	}
+	if source == nil {
+		source = map[string]interface{}{}
+	}
+	return source, nil
+}
+
+// GetField 按路径取字段，先匹配完整字段名，再按 . 逐级查找
+func GetField(doc map[string]interface{}, path string) (interface{}, bool) {
+	if v, ok := doc[path]; ok {
+		return v, true
+	}
+	idx := strings.IndexByte(path, '.')
+	for idx > 0 {
+		if child, ok := doc[path[:idx]].(map[string]interface{}); ok {
+			if v, ok := GetField(child, path[idx+1:]); ok {
+				return v, true
+			}
+		}
+		next := strings.IndexByte(path[idx+1:], '.')
+		if next < 0 {
+			break
+		}
+		idx += next + 1
+	}
+	return nil, false
+}
+
+// SetField 按路径写字段，中间层不存在时创建
+func SetField(doc map[string]interface{}, path string, v interface{}) {
+	if _, ok := doc[path]; ok || !strings.Contains(path, ".") {
+		doc[path] = v
+		return
+	}
+	parts := strings.Split(path, ".")
+	cur := doc
+	for _, p := range parts[:len(parts)-1] {
+		child, ok := cur[p].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			cur[p] = child
+		}
+		cur = child
+	}
+	cur[parts[len(parts)-1]] = v
+}
+
+// DeleteField 按路径删除字段，返回字段是否存在
+func DeleteField(doc map[string]interface{}, path string) bool {
+	if _, ok := doc[path]; ok {
+		delete(doc, path)
+		return true
+	}
+	idx := strings.IndexByte(path, '.')
+	for idx > 0 {
+		if child, ok := doc[path[:idx]].(map[string]interface{}); ok {
+			if DeleteField(child, path[idx+1:]) {
+				return true
+			}
+		}
+		next := strings.IndexByte(path[idx+1:], '.')
+		if next < 0 {
+			break
+		}
+		idx += next + 1
+	}
+	return false
+}
+
+// FieldString 把字段值转成字符串，用于生成 id、路由等
+func FieldString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	default:
+		b, err := json.Marshal(t)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
+
+// CopyDocs deep-copies docs so several targets can transform the same batch independently.
+func CopyDocs(docs []Doc) []Doc {
+	out := make([]Doc, len(docs))
+	for i, doc := range docs {
+		doc.Source = copyValue(doc.Source).(map[string]interface{})
+		out[i] = doc
+	}
+	return out
+}
+
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, child := range t {
+			m[k] = copyValue(child)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, child := range t {
+			s[i] = copyValue(child)
+		}
+		return s
+	default:
+		return v
+	}
+}
@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"essync/conf"
+	"fmt"
+	"strings"
+)
+
+// idTransform 按 doc_id 配置生成写入目标的 _id，放在转换链的最后执行
+type idTransform struct {
+	strategy string
+	parts    []idPart
+	fields   []string
+}
+
+// idPart 模板的一段，field 为空时是原样输出的文本
+type idPart struct {
+	text  string
+	field string
+}
+
+// NewIdTransform builds the id strategy of a target; it returns nil for "source", which keeps the source _id.
+func NewIdTransform(cfg conf.DocId) (Transform, error) {
+	switch cfg.Strategy {
+	case "", "source":
+		return nil, nil
+	case "auto":
+		return &idTransform{strategy: "auto"}, nil
+	case "template":
+		parts, err := parseIdTemplate(cfg.Template)
+		if err != nil {
+			return nil, err
+		}
+		return &idTransform{strategy: "template", parts: parts}, nil
+	case "hash":
+		return &idTransform{strategy: "hash", fields: cfg.Fields}, nil
+	}
+	return nil, fmt.Errorf("doc_id: unknown strategy %q", cfg.Strategy)
+}
+
+func parseIdTemplate(tpl string) ([]idPart, error) {
+	if tpl == "" {
+		return nil, errors.New("doc_id: template is required")
+	}
+	var parts []idPart
+	for tpl != "" {
+		start := strings.IndexByte(tpl, '{')
+		if start < 0 {
+			parts = append(parts, idPart{text: tpl})
+			break
+		}
+		end := strings.IndexByte(tpl[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("doc_id: unclosed { in template %q", tpl)
+		}
+		if start > 0 {
+			parts = append(parts, idPart{text: tpl[:start]})
+		}
+		field := tpl[start+1 : start+end]
+		if field == "" {
+			return nil, errors.New("doc_id: empty {} in template")
+		}
+		parts = append(parts, idPart{field: field})
+		tpl = tpl[start+end+1:]
+	}
+	return parts, nil
+}
+
+func (t *idTransform) Apply(doc *Doc) (bool, error) {
+	switch t.strategy {
+	case "auto":
+		doc.Id = ""
+	case "template":
+		var b strings.Builder
+		for _, p := range t.parts {
+			if p.field == "" {
+				b.WriteString(p.text)
+				continue
+			}
+			v, ok := GetField(doc.Source, p.field)
+			if !ok || v == nil {
+				return false, errors.New("doc_id: missing field " + p.field)
+			}
+			b.WriteString(FieldString(v))
+		}
+		doc.Id = b.String()
+	case "hash":
+		// 同样内容的文档得到同样的 id，重复记录的调用写入时去重
+		var data []byte
+		var err error
+		if len(t.fields) == 0 {
+			data, err = json.Marshal(doc.Source)
+		} else {
+			values := make([]interface{}, len(t.fields))
+			for i, f := range t.fields {
+				values[i], _ = GetField(doc.Source, f)
+			}
+			data, err = json.Marshal(values)
+		}
+		if err != nil {
+			return false, err
+		}
+		sum := sha256.Sum256(data)
+		doc.Id = hex.EncodeToString(sum[:])
+	}
+	return true, nil
+}
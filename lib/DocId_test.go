@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"essync/conf"
+	"reflect"
+	"testing"
+)
+
+func TestParseIdTemplate(t *testing.T) {
+	tests := []struct {
+		tpl   string
+		parts []idPart
+		fail  bool
+	}{
+		{tpl: "{appId}", parts: []idPart{{field: "appId"}}},
+		{tpl: "{appId}-{callDate}", parts: []idPart{{field: "appId"}, {text: "-"}, {field: "callDate"}}},
+		{tpl: "call:{a.b}:x", parts: []idPart{{text: "call:"}, {field: "a.b"}, {text: ":x"}}},
+		{tpl: "static", parts: []idPart{{text: "static"}}},
+		{tpl: "", fail: true},
+		{tpl: "{appId", fail: true},
+		{tpl: "a{}b", fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tpl, func(t *testing.T) {
+			parts, err := parseIdTemplate(tt.tpl)
+			if tt.fail {
+				if err == nil {
+					t.Fatalf("parsed %v", parts)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(parts, tt.parts) {
+				t.Fatalf("got %v %v, want %v", parts, err, tt.parts)
+			}
+		})
+	}
+}
+
+func TestIdTransform(t *testing.T) {
+	source := func(s string) map[string]interface{} {
+		m, err := DecodeSource([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	apply := func(cfg conf.DocId, src string) (string, error) {
+		tr, err := NewIdTransform(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc := Doc{Id: "orig", Source: source(src)}
+		_, err = tr.Apply(&doc)
+		return doc.Id, err
+	}
+	tpl := conf.DocId{Strategy: "template", Template: "{appId}-{a.b}"}
+	if id, err := apply(tpl, `{"appId": "x", "a": {"b": 12}}`); err != nil || id != "x-12" {
+		t.Fatalf("template: %q %v", id, err)
+	}
+	if _, err := apply(tpl, `{"appId": "x"}`); err == nil {
+		t.Fatal("template with a missing field succeeded")
+	}
+	if id, _ := apply(conf.DocId{Strategy: "auto"}, `{}`); id != "" {
+		t.Fatalf("auto: %q", id)
+	}
+
+	// 同样内容同样的 id，只按 fields 计算时其他字段不影响
+	hash := conf.DocId{Strategy: "hash", Fields: []string{"appId", "callDate"}}
+	a, _ := apply(hash, `{"appId": "x", "callDate": 1, "result": "ok"}`)
+	b, _ := apply(hash, `{"result": "fail", "callDate": 1, "appId": "x"}`)
+	c, _ := apply(hash, `{"appId": "x", "callDate": 2}`)
+	if len(a) != 64 || a != b || a == c {
+		t.Fatalf("hash fields: %s %s %s", a, b, c)
+	}
+	whole := conf.DocId{Strategy: "hash"}
+	a, _ = apply(whole, `{"appId": "x", "callDate": 1}`)
+	b, _ = apply(whole, `{"callDate": 1, "appId": "x"}`)
+	c, _ = apply(whole, `{"appId": "x", "callDate": 1, "result": "ok"}`)
+	if a != b || a == c {
+		t.Fatalf("hash source: %s %s %s", a, b, c)
+	}
+
+	if tr, err := NewIdTransform(conf.DocId{Strategy: "source"}); tr != nil || err != nil {
+		t.Fatalf("source: %v %v", tr, err)
+	}
+	if _, err := NewIdTransform(conf.DocId{Strategy: "uuid"}); err == nil {
+		t.Fatal("unknown strategy accepted")
+	}
+}
@@ -8,20 +8,27 @@ import (
 	"essync/conf"
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/elastic/go-elasticsearch/v7/esapi"
-	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+var esLog = NewLogger("es")
+
 type DocQuery map[string]interface{}
 type EsQuery map[string]interface{}
 type MatchQuery map[string]interface{}
 
 type ResLists []conf.EsDoc
 type SearchResponseHitsHits struct {
-	Index  string          `json:"_index"`
-	Type   string          `json:"_type"`
-	ID     string          `json:"_id"`
-	Score  float64         `json:"_score"`
-	Source json.RawMessage `json:"_source"`
+	Index   string            `json:"_index"`
+	Type    string            `json:"_type"`
+	ID      string            `json:"_id"`
+	Score   float64           `json:"_score"`
+	Routing string            `json:"_routing,omitempty"`
+	Source  json.RawMessage   `json:"_source"`
+	Sort    []json.RawMessage `json:"sort,omitempty"`
 }
 type SearchResponseHits struct {
 	Total struct {
@@ -32,6 +39,8 @@ type SearchResponseHits struct {
 	Hits     []*SearchResponseHitsHits `json:"hits"`
 }
 type SearchResponse struct {
+	ScrollId string `json:"_scroll_id"`
+	PitId    string `json:"pit_id"`
 	Took     uint64 `json:"took"`
 	TimedOut bool   `json:"timed_out"`
 	Shards   struct {
@@ -75,17 +84,6 @@ type resData struct {
 	Total  uint64   `json:"total"`
 	IdList IdList   `json:"idList"`
 }
-type resCreate struct {
-	IndexName string `json:"_index"`
-	Type      string `json:"_type"`
-	Id        string `json:"_id"`
-	Result    string `json:"result"`
-	Shards    struct {
-		Total      int `json:"total"`
-		Successful int `json:"successful"`
-		Failed     int `json:"failed"`
-	}
-}
 type resInfo struct {
 	IndexName string          `json:"_index"`
 	Type      string          `json:"_type"`
@@ -216,47 +214,667 @@ func PageSort(es *elasticsearch.Client, indexName string, matchQuery MatchQuery,
 	}, nil
 }
 
-func Create(es *elasticsearch.Client, indexName string, doc conf.EsDoc, docId string, docType string) (string, error) {
-	docType = "_doc"
-	// Create creates a new document in the index.
-	// Returns a 409 response when a document with a same ID already exists in the index.
+// Scroll walks every document matching query, handing each page of hits to fn.
+func Scroll(es *elasticsearch.Client, indexName string, query EsQuery, size int, keepAlive time.Duration, fn func(hits []*SearchResponseHitsHits) error) (uint64, error) {
+	var total uint64
 	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(doc); err != nil {
-		return "", err
+	if err := json.NewEncoder(&buf).Encode(query); err != nil {
+		return total, err
 	}
-	res, err := es.Create(indexName, docId, &buf, es.Create.WithDocumentType(docType))
-	//fmt.Println(res)
+	res, err := es.Search(
+		es.Search.WithContext(context.Background()),
+		es.Search.WithIndex(indexName),
+		es.Search.WithBody(&buf),
+		es.Search.WithSize(size),
+		es.Search.WithScroll(keepAlive),
+	)
+	if err != nil {
+		return total, err
+	}
+	r, err := decodeSearchPage(res)
+	if err != nil {
+		return total, err
+	}
+	scrollId := r.ScrollId
+	defer func() {
+		if scrollId == "" {
+			return
+		}
+		res, err := es.ClearScroll(es.ClearScroll.WithScrollID(scrollId))
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	for len(r.Hits.Hits) > 0 {
+		total += uint64(len(r.Hits.Hits))
+		if err := fn(r.Hits.Hits); err != nil {
+			return total, err
+		}
+		res, err = es.Scroll(
+			es.Scroll.WithContext(context.Background()),
+			es.Scroll.WithScrollID(scrollId),
+			es.Scroll.WithScroll(keepAlive),
+		)
+		if err != nil {
+			return total, err
+		}
+		r, err = decodeSearchPage(res)
+		if err != nil {
+			return total, err
+		}
+		if r.ScrollId != "" {
+			scrollId = r.ScrollId
+		}
+	}
+	return total, nil
+}
+
+// SearchAfter walks every document matching query inside a point in time, paging with
+// search_after on sortField plus _shard_doc so ties never repeat or skip documents.
+func SearchAfter(es *elasticsearch.Client, indexName string, query EsQuery, sortField string, size int, keepAlive time.Duration, fn func(hits []*SearchResponseHitsHits) error) (uint64, error) {
+	var total uint64
+	keepAliveStr := strconv.Itoa(int(keepAlive/time.Second)) + "s"
+	pitId, err := openPointInTime(es, indexName, keepAliveStr, "")
+	if err != nil {
+		return total, err
+	}
+	if pitId == "" {
+		return total, errors.New("no such index: " + indexName)
+	}
+	defer func() { closePointInTime(es, pitId) }()
+	sort := []interface{}{}
+	if sortField != "" {
+		sort = append(sort, map[string]string{sortField: "asc"})
+	}
+	sort = append(sort, map[string]string{"_shard_doc": "asc"})
+	var searchAfter []json.RawMessage
+	for {
+		body := map[string]interface{}{}
+		for k, v := range query {
+			body[k] = v
+		}
+		body["size"] = size
+		body["sort"] = sort
+		body["pit"] = map[string]string{"id": pitId, "keep_alive": keepAliveStr}
+		if searchAfter != nil {
+			body["search_after"] = searchAfter
+		}
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return total, err
+		}
+		res, err := es.Search(es.Search.WithContext(context.Background()), es.Search.WithBody(&buf))
+		if err != nil {
+			return total, err
+		}
+		r, err := decodeSearchPage(res)
+		if err != nil {
+			return total, err
+		}
+		if r.PitId != "" {
+			pitId = r.PitId
+		}
+		if len(r.Hits.Hits) == 0 {
+			return total, nil
+		}
+		total += uint64(len(r.Hits.Hits))
+		if err := fn(r.Hits.Hits); err != nil {
+			return total, err
+		}
+		searchAfter = r.Hits.Hits[len(r.Hits.Hits)-1].Sort
+	}
+}
+
+// openPointInTime 索引不存在时返回空 id
+func openPointInTime(es *elasticsearch.Client, indexName string, keepAlive string, preference string) (string, error) {
+	opts := []func(*esapi.OpenPointInTimeRequest){es.OpenPointInTime.WithContext(context.Background())}
+	if preference != "" {
+		opts = append(opts, es.OpenPointInTime.WithPreference(preference))
+	}
+	res, err := es.OpenPointInTime([]string{indexName}, keepAlive, opts...)
 	if err != nil {
 		return "", err
 	}
 	defer res.Body.Close()
-	var r resCreate
-	err1 := json.NewDecoder(res.Body).Decode(&r)
-	if err1 != nil {
-		return "id", err1
+	if res.StatusCode == 404 {
+		return "", nil
+	}
+	if res.IsError() {
+		return "", errors.New("open_point_in_time: " + res.String())
+	}
+	var pit struct {
+		Id string `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&pit); err != nil {
+		return "", err
+	}
+	return pit.Id, nil
+}
+
+func closePointInTime(es *elasticsearch.Client, pitId string) {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(map[string]string{"id": pitId})
+	res, err := es.ClosePointInTime(es.ClosePointInTime.WithBody(&buf))
+	if err == nil {
+		res.Body.Close()
+	}
+}
+
+func decodeSearchPage(res *esapi.Response) (SearchResponse, error) {
+	var r SearchResponse
+	defer res.Body.Close()
+	if res.IsError() {
+		return r, errors.New("search: " + res.String())
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return r, err
+	}
+	if r.Hits == nil {
+		r.Hits = &SearchResponseHits{}
+	}
+	return r, nil
+}
+
+// SearchDocs is PageSort returning generic documents instead of conf.EsDoc.
+func SearchDocs(es *elasticsearch.Client, indexName string, matchQuery MatchQuery, sortField string, sortType string, from int, size int) ([]Doc, uint64, error) {
+	begin := time.Now()
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(matchQuery); err != nil {
+		return nil, 0, err
+	}
+	res, err := es.Search(
+		es.Search.WithContext(context.Background()),
+		es.Search.WithIndex(indexName),
+		es.Search.WithBody(&buf),
+		es.Search.WithSort(sortField+":"+sortType),
+		es.Search.WithFrom(from),
+		es.Search.WithSize(size),
+		es.Search.WithTrackTotalHits(true),
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	esLog.Debug("search", "index", indexName, "size", size, "status", res.StatusCode, "latency_ms", time.Since(begin))
+	if res.StatusCode == 404 {
+		return nil, 0, nil
+	}
+	if res.IsError() {
+		return nil, 0, errors.New("search: " + res.String())
+	}
+	var r SearchResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, 0, err
+	}
+	docs, err := HitsToDocs(r.Hits.Hits)
+	if err != nil {
+		return nil, 0, err
+	}
+	return docs, r.Hits.Total.Value, nil
+}
+
+// Partition 来源的一个分区：By 为 shard 时只读第 Id 个主分片，id_hash 时用 point in time 的 slice 按 _id 哈希分成 Max 份读第 Id 份
+type Partition struct {
+	By  string
+	Id  int
+	Max int
+}
+
+// OpenScan opens the point in time a sorted scan of indexName pages through, the id is empty when the index
+// doesn't exist. A shard partition opens it on that shard only, a point in time search can't take a preference.
+func OpenScan(es *elasticsearch.Client, indexName string, keepAlive string, p *Partition) (string, error) {
+	preference := ""
+	if p != nil && p.By == "shard" {
+		preference = "_shards:" + strconv.Itoa(p.Id)
+	}
+	return openPointInTime(es, indexName, keepAlive, preference)
+}
+
+// CloseScan releases a point in time opened by OpenScan.
+func CloseScan(es *elasticsearch.Client, pitId string) {
+	closePointInTime(es, pitId)
+}
+
+// SearchSorted reads one page of the point in time pitId ordered by sortField, then _shard_doc as a tiebreaker,
+// so documents sharing one sort value are never skipped or repeated between pages of the same point in time.
+// after is the sort of the previous page's last hit, nil for the first page. An id_hash partition restricts the
+// page to one slice. It returns the hits and the point in time id to use for the next page.
+func SearchSorted(es *elasticsearch.Client, pitId string, keepAlive string, matchQuery MatchQuery, sortField string, sortType string, after []json.RawMessage, size int, p *Partition) ([]*SearchResponseHitsHits, string, error) {
+	begin := time.Now()
+	body := MatchQuery{}
+	for k, v := range matchQuery {
+		body[k] = v
+	}
+	body["size"] = size
+	body["sort"] = []interface{}{map[string]string{sortField: sortType}, map[string]string{"_shard_doc": sortType}}
+	body["pit"] = map[string]string{"id": pitId, "keep_alive": keepAlive}
+	if after != nil {
+		body["search_after"] = after
+	}
+	if p != nil {
+		switch p.By {
+		case "shard":
+			// 分片在打开 point in time 时已经选定
+		case "id_hash":
+			// slice.max 必须大于 1，只有一份时就是整个索引。不指定 field 时按分片和 Lucene 文档号切分，
+			// 换了 point in time 就可能变，按 _id 哈希切分每个文档始终在同一份里
+			if p.Max > 1 {
+				body["slice"] = map[string]interface{}{"field": "_id", "id": p.Id, "max": p.Max}
+			}
+		default:
+			return nil, pitId, errors.New("unknown partition type: " + p.By)
+		}
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return nil, pitId, err
+	}
+	res, err := es.Search(es.Search.WithContext(context.Background()), es.Search.WithBody(&buf))
+	if err != nil {
+		return nil, pitId, err
+	}
+	esLog.Debug("search", "pit", true, "size", size, "status", res.StatusCode, "latency_ms", time.Since(begin))
+	r, err := decodeSearchPage(res)
+	if err != nil {
+		return nil, pitId, err
+	}
+	if r.PitId != "" {
+		pitId = r.PitId
+	}
+	return r.Hits.Hits, pitId, nil
+}
+
+func HitsToDocs(hits []*SearchResponseHitsHits) ([]Doc, error) {
+	docs := make([]Doc, 0, len(hits))
+	for _, hit := range hits {
+		source, err := DecodeSource(hit.Source)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, Doc{Index: hit.Index, Id: hit.ID, Source: source})
+	}
+	return docs, nil
+}
+
+type BulkResult struct {
+	Succeeded int
+	Conflicts int
+	Failed    int
+	Errors    []DocError
+}
+
+// RetryDocs 失败里可以重写的文档
+func (r BulkResult) RetryDocs() []Doc {
+	var docs []Doc
+	for _, e := range r.Errors {
+		if e.Retriable && e.Doc != nil {
+			docs = append(docs, *e.Doc)
+		}
+	}
+	return docs
+}
+
+// Retried 合并重写 RetryDocs 的结果 again，替换掉之前可重写的失败
+func (r BulkResult) Retried(again BulkResult) BulkResult {
+	errs := make([]DocError, 0, len(r.Errors))
+	for _, e := range r.Errors {
+		if e.Retriable && e.Doc != nil {
+			r.Failed--
+			continue
+		}
+		errs = append(errs, e)
+	}
+	r.Errors = append(errs, again.Errors...)
+	r.Succeeded += again.Succeeded
+	r.Conflicts += again.Conflicts
+	r.Failed += again.Failed
+	return r
+}
+
+// WriteOptions 写入目标时带的参数。RoutingField 按文档字段路由，取不到时用固定的 Routing
+type WriteOptions struct {
+	Routing             string
+	RoutingField        string
+	Pipeline            string
+	Refresh             string // true、false、wait_for
+	WaitForActiveShards string
+	Timeout             time.Duration
+}
+
+func (o WriteOptions) routing(doc Doc) string {
+	if o.RoutingField != "" {
+		if v, ok := GetField(doc.Source, o.RoutingField); ok && v != nil {
+			return FieldString(v)
+		}
 	}
-	return r.Id, nil
+	return o.Routing
 }
 
-func DeleteByQuery(es *elasticsearch.Client, indexName string, query EsQuery) (*esapi.Response, error) {
-	// DeleteByQuery deletes documents matching the provided query
-	resTmp := &esapi.Response{}
+// Bulk writes docs with one _bulk request. action is "create" or "index";
+// with "create" documents that already exist are counted as Conflicts, not failures.
+func Bulk(es *elasticsearch.Client, indexName string, docs []Doc, action string, opts WriteOptions) (BulkResult, error) {
+	result := BulkResult{}
+	if len(docs) == 0 {
+		return result, nil
+	}
+	if action == "" {
+		action = "create"
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, doc := range docs {
+		meta := map[string]string{}
+		if doc.TargetIndex != "" && doc.TargetIndex != indexName {
+			meta["_index"] = doc.TargetIndex
+		}
+		if doc.Id != "" {
+			meta["_id"] = doc.Id
+		}
+		if routing := opts.routing(doc); routing != "" {
+			meta["routing"] = routing
+		}
+		if err := enc.Encode(map[string]interface{}{action: meta}); err != nil {
+			return result, err
+		}
+		if err := enc.Encode(doc.Source); err != nil {
+			return result, err
+		}
+	}
+	reqOpts := []func(*esapi.BulkRequest){es.Bulk.WithContext(context.Background()), es.Bulk.WithIndex(indexName)}
+	if opts.Pipeline != "" {
+		reqOpts = append(reqOpts, es.Bulk.WithPipeline(opts.Pipeline))
+	}
+	if opts.Refresh != "" {
+		reqOpts = append(reqOpts, es.Bulk.WithRefresh(opts.Refresh))
+	}
+	if opts.WaitForActiveShards != "" {
+		reqOpts = append(reqOpts, es.Bulk.WithWaitForActiveShards(opts.WaitForActiveShards))
+	}
+	if opts.Timeout > 0 {
+		reqOpts = append(reqOpts, es.Bulk.WithTimeout(opts.Timeout))
+	}
+	begin := time.Now()
+	res, err := es.Bulk(&buf, reqOpts...)
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+	esLog.Debug("bulk", "index", indexName, "docs", len(docs), "status", res.StatusCode, "latency_ms", time.Since(begin))
+	if res.IsError() {
+		return result, errors.New("bulk: " + res.String())
+	}
+	var r struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Id     string          `json:"_id"`
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return result, err
+	}
+	for i, item := range r.Items {
+		for _, v := range item {
+			switch {
+			case v.Status >= 200 && v.Status < 300:
+				result.Succeeded++
+			case v.Status == 409 && action == "create":
+				result.Conflicts++
+			default:
+				result.Failed++
+				e := DocError{Id: v.Id, Err: string(v.Error)}
+				// 写入队列满(es_rejected_execution_exception)时返回 429，过一会儿重写即可
+				e.Retriable = v.Status == 429 || bytes.Contains(v.Error, []byte("es_rejected_execution_exception"))
+				if i < len(docs) {
+					e.Doc = &docs[i]
+				}
+				result.Errors = append(result.Errors, e)
+			}
+		}
+	}
+	return result, nil
+}
+
+type DeleteByQueryOptions struct {
+	WaitForCompletion bool
+	Slices            string // "auto" 或切片数量
+	RequestsPerSecond int    // 0 表示不限速
+	Conflicts         string // "proceed" 或 "abort"
+}
+
+type DeleteByQueryResult struct {
+	Task             string            `json:"task"`
+	Took             int64             `json:"took"`
+	TimedOut         bool              `json:"timed_out"`
+	Total            int64             `json:"total"`
+	Deleted          int64             `json:"deleted"`
+	Batches          int64             `json:"batches"`
+	VersionConflicts int64             `json:"version_conflicts"`
+	Failures         []json.RawMessage `json:"failures"`
+}
+
+type TaskStatus struct {
+	Completed bool `json:"completed"`
+	Task      struct {
+		Node               string              `json:"node"`
+		Id                 int64               `json:"id"`
+		Action             string              `json:"action"`
+		Description        string              `json:"description"`
+		RunningTimeInNanos int64               `json:"running_time_in_nanos"`
+		Cancelled          bool                `json:"cancelled"`
+		Status             DeleteByQueryResult `json:"status"`
+	} `json:"task"`
+	Response DeleteByQueryResult `json:"response"`
+	Error    json.RawMessage     `json:"error"`
+}
+
+// DeleteByQuery deletes documents matching the provided query.
+// With WaitForCompletion false only Task is filled in and the caller polls GetTask.
+func DeleteByQuery(es *elasticsearch.Client, indexName string, query EsQuery, opts DeleteByQueryOptions) (DeleteByQueryResult, error) {
+	resTmp := DeleteByQueryResult{}
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(query); err != nil {
 		return resTmp, err
 	}
 	index := []string{indexName}
-	res, err := es.DeleteByQuery(index, &buf)
+	reqOpts := []func(*esapi.DeleteByQueryRequest){
+		es.DeleteByQuery.WithContext(context.Background()),
+		es.DeleteByQuery.WithWaitForCompletion(opts.WaitForCompletion),
+	}
+	if opts.Slices != "" {
+		reqOpts = append(reqOpts, es.DeleteByQuery.WithSlices(opts.Slices))
+	}
+	if opts.RequestsPerSecond > 0 {
+		reqOpts = append(reqOpts, es.DeleteByQuery.WithRequestsPerSecond(opts.RequestsPerSecond))
+	}
+	if opts.Conflicts != "" {
+		reqOpts = append(reqOpts, es.DeleteByQuery.WithConflicts(opts.Conflicts))
+	}
+	res, err := es.DeleteByQuery(index, &buf, reqOpts...)
 	if err != nil {
 		return resTmp, err
 	}
 	defer res.Body.Close()
-	/*var r resData
-	err1 := json.NewDecoder(res.Body).Decode(&r)
-	if err1 != nil {
-		return resTmp, err1
-	}*/
-	return res, nil
+	if res.IsError() {
+		return resTmp, errors.New("delete_by_query: " + res.String())
+	}
+	var r DeleteByQueryResult
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return resTmp, err
+	}
+	return r, nil
+}
+
+// GetTask fetches the state of a task started with wait_for_completion=false.
+func GetTask(es *elasticsearch.Client, taskId string) (TaskStatus, error) {
+	resTmp := TaskStatus{}
+	res, err := es.Tasks.Get(taskId, es.Tasks.Get.WithContext(context.Background()))
+	if err != nil {
+		return resTmp, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return resTmp, errors.New("tasks.get: " + res.String())
+	}
+	var r TaskStatus
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return resTmp, err
+	}
+	return r, nil
+}
+
+// RunningDeleteByQuery returns the id of a delete_by_query task still running against indexName, or "".
+func RunningDeleteByQuery(es *elasticsearch.Client, indexName string) (string, error) {
+	res, err := es.Tasks.List(
+		es.Tasks.List.WithContext(context.Background()),
+		es.Tasks.List.WithActions("indices:data/write/delete/byquery"),
+		es.Tasks.List.WithDetailed(true),
+	)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return "", errors.New("tasks.list: " + res.String())
+	}
+	var r struct {
+		Nodes map[string]struct {
+			Tasks map[string]struct {
+				Description  string `json:"description"`
+				ParentTaskId string `json:"parent_task_id"`
+			} `json:"tasks"`
+		} `json:"nodes"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return "", err
+	}
+	for _, node := range r.Nodes {
+		for id, task := range node.Tasks {
+			// 切片任务的子任务带 parent_task_id，只认父任务
+			if task.ParentTaskId != "" {
+				continue
+			}
+			if strings.Contains(task.Description, "["+indexName+"]") {
+				return id, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// ClusterName returns the cluster_name reported by the root endpoint.
+func ClusterName(es *elasticsearch.Client) (string, error) {
+	res, err := es.Info(es.Info.WithContext(context.Background()))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return "", errors.New("info: " + res.String())
+	}
+	var r struct {
+		ClusterName string `json:"cluster_name"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return "", err
+	}
+	return r.ClusterName, nil
+}
+
+// ClusterHealth fails when the cluster is unreachable or its health is red.
+func ClusterHealth(ctx context.Context, es *elasticsearch.Client) error {
+	res, err := es.Cluster.Health(es.Cluster.Health.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return errors.New("cluster health: " + res.String())
+	}
+	var r struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return err
+	}
+	if r.Status == "red" {
+		return errors.New("cluster health is red")
+	}
+	return nil
+}
+
+// IndexWritable fails when the index has a write or read_only block.
+// An index that does not exist yet counts as writable, the first write creates it.
+func IndexWritable(ctx context.Context, es *elasticsearch.Client, indexName string) error {
+	res, err := es.Indices.GetSettings(
+		es.Indices.GetSettings.WithContext(ctx),
+		es.Indices.GetSettings.WithIndex(indexName),
+		es.Indices.GetSettings.WithName("index.blocks.*"),
+		es.Indices.GetSettings.WithFlatSettings(true),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil
+	}
+	if res.IsError() {
+		return errors.New("index settings: " + res.String())
+	}
+	var r map[string]struct {
+		Settings map[string]interface{} `json:"settings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return err
+	}
+	for index, idx := range r {
+		for _, block := range []string{"index.blocks.write", "index.blocks.read_only", "index.blocks.read_only_allow_delete"} {
+			if FieldString(idx.Settings[block]) == "true" {
+				return errors.New(index + ": " + block + " is set")
+			}
+		}
+	}
+	return nil
+}
+
+// PrimaryShards returns the number of primary shards of indexName, which must be a concrete index:
+// an alias or pattern can later resolve to indices with more shards, whose extra shards no partition would read.
+func PrimaryShards(es *elasticsearch.Client, indexName string) (int, error) {
+	res, err := es.Indices.GetSettings(
+		es.Indices.GetSettings.WithContext(context.Background()),
+		es.Indices.GetSettings.WithIndex(indexName),
+		es.Indices.GetSettings.WithName("index.number_of_shards"),
+		es.Indices.GetSettings.WithFlatSettings(true),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return 0, errors.New("index settings: " + res.String())
+	}
+	var r map[string]struct {
+		Settings map[string]interface{} `json:"settings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return 0, err
+	}
+	idx, ok := r[indexName]
+	if !ok || len(r) != 1 {
+		names := make([]string, 0, len(r))
+		for name := range r {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return 0, errors.New(indexName + " is not a single concrete index, it resolves to [" + strings.Join(names, ",") + "]")
+	}
+	shards, err := strconv.Atoi(FieldString(idx.Settings["index.number_of_shards"]))
+	if err != nil || shards == 0 {
+		return 0, errors.New("no number_of_shards for " + indexName)
+	}
+	return shards, nil
 }
 
 func Delete(es *elasticsearch.Client, indexName string, id string) (resData, error) {
@@ -277,7 +895,6 @@ func Get(es *elasticsearch.Client, indexName string, id string) (resInfo, error)
 	}
 	defer res.Body.Close()
 	var rp resInfo
-	log.Println(res.Body)
 	err1 := json.NewDecoder(res.Body).Decode(&rp)
 	if err1 != nil {
 		return resTmp, err
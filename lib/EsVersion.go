@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"net/http"
+)
+
+// ErrVersionConflict 文档在读取之后被别人改过(if_seq_no/if_primary_term 不匹配)或者 create 时已经存在
+var ErrVersionConflict = errors.New("version conflict")
+
+// VersionedDoc 带 _seq_no 和 _primary_term 的文档，写回时用来做乐观并发控制
+type VersionedDoc struct {
+	Found       bool
+	SeqNo       int64
+	PrimaryTerm int64
+	Source      json.RawMessage
+}
+
+type versionedResponse struct {
+	Found       bool            `json:"found"`
+	SeqNo       int64           `json:"_seq_no"`
+	PrimaryTerm int64           `json:"_primary_term"`
+	Source      json.RawMessage `json:"_source"`
+}
+
+// GetVersioned reads a document in real time; Found is false when it or the index does not exist.
+// ctx bounds the request, lease holders pass a deadline so a hung call cannot outlive the lease.
+func GetVersioned(ctx context.Context, es *elasticsearch.Client, indexName string, id string) (VersionedDoc, error) {
+	res, err := es.Get(indexName, id, es.Get.WithContext(ctx), es.Get.WithRealtime(true))
+	if err != nil {
+		return VersionedDoc{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return VersionedDoc{}, nil
+	}
+	if res.IsError() {
+		return VersionedDoc{}, errors.New("get: " + res.String())
+	}
+	var r versionedResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return VersionedDoc{}, err
+	}
+	return VersionedDoc{Found: r.Found, SeqNo: r.SeqNo, PrimaryTerm: r.PrimaryTerm, Source: r.Source}, nil
+}
+
+// PutVersioned writes source as document id. With prev.Found false the document must not exist yet,
+// otherwise it must still be at prev's _seq_no/_primary_term; both fail with ErrVersionConflict.
+// The returned VersionedDoc is the written version.
+func PutVersioned(ctx context.Context, es *elasticsearch.Client, indexName string, id string, source interface{}, prev VersionedDoc) (VersionedDoc, error) {
+	data, err := json.Marshal(source)
+	if err != nil {
+		return VersionedDoc{}, err
+	}
+	opts := []func(*esapi.IndexRequest){
+		es.Index.WithContext(ctx),
+		es.Index.WithDocumentID(id),
+		es.Index.WithRefresh("true"),
+	}
+	if prev.Found {
+		opts = append(opts, es.Index.WithIfSeqNo(int(prev.SeqNo)), es.Index.WithIfPrimaryTerm(int(prev.PrimaryTerm)))
+	} else {
+		opts = append(opts, es.Index.WithOpType("create"))
+	}
+	res, err := es.Index(indexName, bytes.NewReader(data), opts...)
+	if err != nil {
+		return VersionedDoc{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusConflict {
+		return VersionedDoc{}, ErrVersionConflict
+	}
+	if res.IsError() {
+		return VersionedDoc{}, errors.New("index: " + res.String())
+	}
+	var r versionedResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return VersionedDoc{}, err
+	}
+	return VersionedDoc{Found: true, SeqNo: r.SeqNo, PrimaryTerm: r.PrimaryTerm, Source: data}, nil
+}
+
+// DeleteVersioned deletes document id if it is still at prev's version.
+func DeleteVersioned(ctx context.Context, es *elasticsearch.Client, indexName string, id string, prev VersionedDoc) error {
+	res, err := es.Delete(indexName, id,
+		es.Delete.WithContext(ctx),
+		es.Delete.WithIfSeqNo(int(prev.SeqNo)),
+		es.Delete.WithIfPrimaryTerm(int(prev.PrimaryTerm)),
+		es.Delete.WithRefresh("true"),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusConflict:
+		return ErrVersionConflict
+	case res.StatusCode == http.StatusNotFound:
+		return nil
+	case res.IsError():
+		return errors.New("delete: " + res.String())
+	}
+	return nil
+}
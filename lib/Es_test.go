@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestEs 把 handler 包成 elasticsearch 客户端，补上客户端检查的 X-Elastic-Product 响应头
+func newTestEs(t *testing.T, handler http.HandlerFunc) *elasticsearch.Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodGet && r.URL.Path == "/" {
+			w.Write([]byte(`{"version":{"number":"7.16.0"},"tagline":"You Know, for Search"}`))
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	es, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return es
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// 集群卡住时健康检查随 ctx 结束，不会一直挂着
+func TestClusterHealthContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	es := newTestEs(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	if err := ClusterHealth(ctx, es); err == nil {
+		t.Fatal("health of a hung cluster passed")
+	}
+	if took := time.Since(begin); took > 2*time.Second {
+		t.Fatalf("health check took %v", took)
+	}
+}
+
+// bulkStatuses 按顺序给每条文档回 statuses 里的状态
+func bulkStatuses(statuses ...int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var items []interface{}
+		for _, s := range statuses {
+			item := map[string]interface{}{"status": s}
+			switch s {
+			case 400:
+				item["error"] = map[string]string{"type": "mapper_parsing_exception"}
+			case 429:
+				item["error"] = map[string]string{"type": "es_rejected_execution_exception"}
+			case 500:
+				item["error"] = map[string]string{"type": "es_rejected_execution_exception", "reason": "queue full"}
+			}
+			items = append(items, map[string]interface{}{"create": item})
+		}
+		writeJson(w, 200, map[string]interface{}{"errors": true, "items": items})
+	}
+}
+
+func TestBulkRetryDocs(t *testing.T) {
+	docs := []Doc{{Id: "ok"}, {Id: "dup"}, {Id: "busy"}, {Id: "bad"}, {Id: "queue"}}
+	tests := []struct {
+		name     string
+		statuses []int
+		retry    []string
+	}{
+		{"mixed", []int{201, 409, 429, 400, 500}, []string{"busy", "queue"}},
+		{"none rejected", []int{201, 201, 409, 400, 201}, nil},
+		{"all rejected", []int{429, 429, 429, 429, 429}, []string{"ok", "dup", "busy", "bad", "queue"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Bulk(newTestEs(t, bulkStatuses(tt.statuses...)), "logs", docs, "create", WriteOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, d := range res.RetryDocs() {
+				ids = append(ids, d.Id)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.retry) {
+				t.Fatalf("retry %v, want %v", ids, tt.retry)
+			}
+		})
+	}
+
+	// 重写的结果替换掉原来可重写的失败，不可重写的失败保留
+	res, _ := Bulk(newTestEs(t, bulkStatuses(201, 409, 429, 400, 429)), "logs", docs, "create", WriteOptions{})
+	retry := res.RetryDocs()
+	again, _ := Bulk(newTestEs(t, bulkStatuses(201, 429)), "logs", retry, "create", WriteOptions{})
+	res = res.Retried(again)
+	if res.Succeeded != 2 || res.Conflicts != 1 || res.Failed != 2 || len(res.Errors) != 2 {
+		t.Fatalf("merged %+v", res)
+	}
+	if left := res.RetryDocs(); len(left) != 1 || left[0].Id != "queue" {
+		t.Fatalf("still rejected %v", left)
+	}
+}
@@ -1,15 +1,273 @@
 package lib
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
+	"github.com/phachon/go-logger"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func MyLogFunc() *log.Logger {
-	file := "./mylog.txt"
-	logFile, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0766)
+// 日志级别，按组件配置，低于组件级别的日志不输出
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// ParseLogLevel parses debug, info, warn or error.
+func ParseLogLevel(s string) (int, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) || (name == "warn" && strings.EqualFold(s, "warning")) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// logSettings 所有 Logger 共用的输出：格式 text、json 或 logfmt，写到 go-logger 的 console 和 file 适配器
+var logSettings = struct {
+	sync.RWMutex
+	out    *go_logger.Logger
+	format string
+	level  int
+	levels map[string]int
+}{format: "text", level: LevelDebug}
+
+// SetLogOutput sets where and how every Logger writes. out nil writes to stderr.
+// levels overrides level per component.
+func SetLogOutput(out *go_logger.Logger, format string, level string, levels map[string]string) error {
+	switch format {
+	case "":
+		format = "text"
+	case "text", "json", "logfmt":
+	default:
+		return fmt.Errorf("unknown log format %q, want text, json or logfmt", format)
+	}
+	lv := LevelInfo
+	if level != "" {
+		var err error
+		if lv, err = ParseLogLevel(level); err != nil {
+			return err
+		}
+	}
+	perComponent := map[string]int{}
+	for component, l := range levels {
+		v, err := ParseLogLevel(l)
+		if err != nil {
+			return fmt.Errorf("log level of %s: %v", component, err)
+		}
+		perComponent[component] = v
+	}
+	logSettings.Lock()
+	defer logSettings.Unlock()
+	logSettings.out = out
+	logSettings.format = format
+	logSettings.level = lv
+	logSettings.levels = perComponent
+	return nil
+}
+
+// LogFormat returns the configured format, text, json or logfmt.
+func LogFormat() string {
+	logSettings.RLock()
+	defer logSettings.RUnlock()
+	return logSettings.format
+}
+
+// LogLineTime 按配置的格式取一行日志的时间：text 行首是本地时间，json 取 time 字段，logfmt 取 time= 的值
+func LogLineTime(line string) (time.Time, bool) {
+	switch LogFormat() {
+	case "json":
+		var r struct {
+			Time time.Time `json:"time"`
+		}
+		if err := json.Unmarshal([]byte(line), &r); err != nil || r.Time.IsZero() {
+			return time.Time{}, false
+		}
+		return r.Time, true
+	case "logfmt":
+		if !strings.HasPrefix(line, "time=") {
+			return time.Time{}, false
+		}
+		v := line[len("time="):]
+		if i := strings.IndexByte(v, ' '); i >= 0 {
+			v = v[:i]
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	default:
+		if len(line) < 19 {
+			return time.Time{}, false
+		}
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", line[:19], time.Local)
+		return t, err == nil
+	}
+}
+
+// Logger 带组件名和固定字段的结构化日志，字段以 key, value 成对传入
+type Logger struct {
+	component string
+	fields    []interface{}
+}
+
+func NewLogger(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// With returns a logger that adds the key, value pairs to every entry.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &Logger{component: l.component, fields: fields}
+}
+
+func (l *Logger) Enabled(level int) bool {
+	logSettings.RLock()
+	defer logSettings.RUnlock()
+	min, ok := logSettings.levels[l.component]
+	if !ok {
+		min = logSettings.level
+	}
+	return level >= min
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, msg, kv)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+}
+
+func (l *Logger) log(level int, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	logSettings.RLock()
+	out, format := logSettings.out, logSettings.format
+	logSettings.RUnlock()
+	fields := l.fields
+	if len(kv) > 0 {
+		fields = append(append(make([]interface{}, 0, len(fields)+len(kv)), fields...), kv...)
+	}
+	var line string
+	switch format {
+	case "json":
+		line = l.jsonLine(level, msg, fields)
+	case "logfmt":
+		line = l.logfmtLine(level, msg, fields)
+	default:
+		line = l.textLine(msg, fields)
+	}
+	if out == nil {
+		fmt.Fprintln(os.Stderr, time.Now().Format("2006-01-02 15:04:05.000")+" ["+levelNames[level]+"] "+line)
+		return
+	}
+	switch level {
+	case LevelDebug:
+		out.Debug(line)
+	case LevelInfo:
+		out.Info(line)
+	case LevelWarn:
+		out.Warning(line)
+	default:
+		out.Error(line)
+	}
+}
+
+// logValue 把字段值转成适合输出的形式：error 取消息，Duration 换成毫秒
+func logValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case error:
+		return t.Error()
+	case time.Duration:
+		return float64(t.Microseconds()) / 1000
+	case fmt.Stringer:
+		return t.String()
+	}
+	return v
+}
+
+// textLine 消息后面跟 logfmt 格式的字段，时间和级别由 go-logger 的 Format 输出
+func (l *Logger) textLine(msg string, fields []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	writeLogfmtFields(&b, fields)
+	return b.String()
+}
+
+func (l *Logger) logfmtLine(level int, msg string, fields []interface{}) string {
+	var b strings.Builder
+	b.WriteString("time=" + time.Now().Format(time.RFC3339Nano))
+	b.WriteString(" level=" + levelNames[level])
+	b.WriteString(" component=" + logfmtValue(l.component))
+	b.WriteString(" msg=" + logfmtValue(msg))
+	writeLogfmtFields(&b, fields)
+	return b.String()
+}
+
+func writeLogfmtFields(b *strings.Builder, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(fields[i]))
+		b.WriteByte('=')
+		if i+1 < len(fields) {
+			b.WriteString(logfmtValue(logValue(fields[i+1])))
+		}
+	}
+}
+
+func logfmtValue(v interface{}) string {
+	s, ok := v.(string)
+	if !ok {
+		s = FieldString(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// jsonLine 一行一个 json 对象，字段按传入的顺序输出
+func (l *Logger) jsonLine(level int, msg string, fields []interface{}) string {
+	var b strings.Builder
+	b.WriteString(`{"time":"` + time.Now().Format(time.RFC3339Nano) + `","level":"` + levelNames[level] + `"`)
+	writeJsonField(&b, "component", l.component)
+	writeJsonField(&b, "msg", msg)
+	for i := 0; i < len(fields); i += 2 {
+		var v interface{}
+		if i+1 < len(fields) {
+			v = logValue(fields[i+1])
+		}
+		writeJsonField(&b, fmt.Sprint(fields[i]), v)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func writeJsonField(b *strings.Builder, key string, v interface{}) {
+	k, _ := json.Marshal(key)
+	val, err := json.Marshal(v)
 	if err != nil {
-		panic(err)
+		val, _ = json.Marshal(fmt.Sprint(v))
 	}
-	return log.New(logFile, "[essync]", log.LstdFlags|log.Lshortfile|log.LUTC)
+	b.WriteByte(',')
+	b.Write(k)
+	b.WriteByte(':')
+	b.Write(val)
 }
@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 简单的指标注册表，/exporter 以 prometheus 文本格式输出
+var metrics = struct {
+	sync.Mutex
+	values map[string]float64
+}{values: map[string]float64{}}
+
+func metricKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name + "{}"
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+strconv.Quote(labels[k]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// MetricAdd adds v to a counter.
+func MetricAdd(name string, labels map[string]string, v float64) {
+	key := metricKey(name, labels)
+	metrics.Lock()
+	metrics.values[key] += v
+	metrics.Unlock()
+}
+
+// MetricSet sets a gauge to v.
+func MetricSet(name string, labels map[string]string, v float64) {
+	key := metricKey(name, labels)
+	metrics.Lock()
+	metrics.values[key] = v
+	metrics.Unlock()
+}
+
+// MetricsText renders every metric, one "name{labels} value" per line.
+func MetricsText() string {
+	metrics.Lock()
+	defer metrics.Unlock()
+	keys := make([]string, 0, len(metrics.values))
+	for k := range metrics.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(metrics.values[k], 'f', -1, 64))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
@@ -0,0 +1,255 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// NdjsonWriter 写 NDJSON 文件（可选 gzip），同时统计行数和未压缩内容的 sha256
+type NdjsonWriter struct {
+	file  *os.File
+	gz    *gzip.Writer
+	buf   *bufio.Writer
+	hash  hash.Hash
+	count int64
+	bytes int64
+}
+
+func NewNdjsonWriter(path string, compress bool) (*NdjsonWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &NdjsonWriter{file: f, hash: sha256.New()}
+	if compress {
+		w.gz = gzip.NewWriter(f)
+		w.buf = bufio.NewWriter(w.gz)
+	} else {
+		w.buf = bufio.NewWriter(f)
+	}
+	return w, nil
+}
+
+// Write encodes v as one line.
+func (w *NdjsonWriter) Write(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.WriteLine(line)
+}
+
+// WriteLine writes an already encoded JSON document followed by a newline.
+func (w *NdjsonWriter) WriteLine(line []byte) error {
+	line = append(bytes.TrimRight(line, "\r\n"), '\n')
+	if _, err := w.buf.Write(line); err != nil {
+		return err
+	}
+	w.hash.Write(line)
+	w.count++
+	w.bytes += int64(len(line))
+	return nil
+}
+
+func (w *NdjsonWriter) Count() int64 {
+	return w.count
+}
+
+// Bytes returns the uncompressed size written so far.
+func (w *NdjsonWriter) Bytes() int64 {
+	return w.bytes
+}
+
+// Sum returns the hex sha256 of the uncompressed content.
+func (w *NdjsonWriter) Sum() string {
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
+
+// Flush pushes buffered lines to the file; for gzip this ends the current deflate block.
+func (w *NdjsonWriter) Flush() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if w.gz != nil {
+		return w.gz.Flush()
+	}
+	return nil
+}
+
+func (w *NdjsonWriter) Close() error {
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// RotatingNdjsonWriter 按条数或大小切分的 NDJSON 文件，文件名为 prefix-00001.ndjson[.gz]
+type RotatingNdjsonWriter struct {
+	Dir      string
+	Prefix   string
+	Compress bool
+	MaxDocs  int64 // 0 表示不限制
+	MaxBytes int64 // 未压缩字节数，0 表示不限制
+	seq      int
+	cur      *NdjsonWriter
+	files    []string
+}
+
+func (w *RotatingNdjsonWriter) Write(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if w.cur != nil && ((w.MaxDocs > 0 && w.cur.Count() >= w.MaxDocs) ||
+		(w.MaxBytes > 0 && w.cur.Bytes()+int64(len(line))+1 > w.MaxBytes && w.cur.Count() > 0)) {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	if w.cur == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	return w.cur.WriteLine(line)
+}
+
+func (w *RotatingNdjsonWriter) open() error {
+	if err := os.MkdirAll(w.Dir, 0755); err != nil {
+		return err
+	}
+	ext := ".ndjson"
+	if w.Compress {
+		ext += ".gz"
+	}
+	for {
+		w.seq++
+		path := filepath.Join(w.Dir, fmt.Sprintf("%s-%05d%s", w.Prefix, w.seq, ext))
+		// 不覆盖已有文件，重启后接着编号
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		cur, err := NewNdjsonWriter(path, w.Compress)
+		if err != nil {
+			return err
+		}
+		w.cur = cur
+		w.files = append(w.files, path)
+		return nil
+	}
+}
+
+func (w *RotatingNdjsonWriter) rotate() error {
+	if w.cur == nil {
+		return nil
+	}
+	err := w.cur.Close()
+	w.cur = nil
+	return err
+}
+
+// Files returns every file opened so far.
+func (w *RotatingNdjsonWriter) Files() []string {
+	return w.files
+}
+
+// Flush pushes buffered lines to the current file.
+func (w *RotatingNdjsonWriter) Flush() error {
+	if w.cur == nil {
+		return nil
+	}
+	return w.cur.Flush()
+}
+
+func (w *RotatingNdjsonWriter) Close() error {
+	return w.rotate()
+}
+
+// ReadNdjson calls fn for every non-empty line of path, gzip is detected from the file header.
+// Lines before offset (0-based line number) are skipped; fn receives the line number.
+func ReadNdjson(path string, offset int64, fn func(lineNo int64, line []byte) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	br := bufio.NewReaderSize(f, 64*1024)
+	var r io.Reader = br
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	reader := bufio.NewReaderSize(r, 64*1024)
+	var lineNo int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			if lineNo >= offset {
+				if ferr := fn(lineNo, line); ferr != nil {
+					return lineNo, ferr
+				}
+			}
+			lineNo++
+		}
+		if err == io.EOF {
+			return lineNo, nil
+		}
+		if err != nil {
+			return lineNo, err
+		}
+	}
+}
+
+// NdjsonDigest returns line count and sha256 of the uncompressed content of path.
+func NdjsonDigest(path string) (int64, string, error) {
+	h := sha256.New()
+	count, err := ReadNdjson(path, 0, func(lineNo int64, line []byte) error {
+		line = append(bytes.TrimRight(line, "\r\n"), '\n')
+		h.Write(line)
+		return nil
+	})
+	if err != nil {
+		return count, "", err
+	}
+	return count, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FileSha256 returns the sha256 and size of the raw bytes of path.
+func FileSha256(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
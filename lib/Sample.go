@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sampler 按百分比抽样，对 _id 或指定字段做哈希，同一条文档每次的结果都一样
+type Sampler struct {
+	Percent float64
+	By      string // _id 或字段路径，字段取不到时用 _id
+	kept    int64
+	dropped int64
+}
+
+func NewSampler(percent float64, by string) *Sampler {
+	if by == "" {
+		by = "_id"
+	}
+	return &Sampler{Percent: percent, By: by}
+}
+
+func (s *Sampler) Keep(doc Doc) bool {
+	key := doc.Id
+	if s.By != "_id" {
+		if v, ok := GetField(doc.Source, s.By); ok && v != nil {
+			key = FieldString(v)
+		}
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	keep := float64(h.Sum64()%1000000) < s.Percent*10000
+	if keep {
+		atomic.AddInt64(&s.kept, 1)
+	} else {
+		atomic.AddInt64(&s.dropped, 1)
+	}
+	return keep
+}
+
+// Filter returns the sampled documents, reusing the docs slice.
+func (s *Sampler) Filter(docs []Doc) []Doc {
+	kept := docs[:0]
+	for _, doc := range docs {
+		if s.Keep(doc) {
+			kept = append(kept, doc)
+		}
+	}
+	return kept
+}
+
+// Counts returns the documents kept and dropped so far.
+func (s *Sampler) Counts() (int64, int64) {
+	return atomic.LoadInt64(&s.kept), atomic.LoadInt64(&s.dropped)
+}
+
+// RateLimiter 限制每秒写入的文档数，每批按条数往后排，批次之间平均分布
+type RateLimiter struct {
+	Rate   float64
+	mu     sync.Mutex
+	next   time.Time
+	waited int64
+}
+
+func NewRateLimiter(rate float64) *RateLimiter {
+	return &RateLimiter{Rate: rate}
+}
+
+// Wait blocks until n more documents may be written and returns how long it waited.
+func (l *RateLimiter) Wait(n int) time.Duration {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.Rate * float64(time.Second)))
+	l.mu.Unlock()
+	if wait > 0 {
+		atomic.AddInt64(&l.waited, int64(wait))
+		time.Sleep(wait)
+	}
+	return wait
+}
+
+// Waited returns the total time spent waiting.
+func (l *RateLimiter) Waited() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.waited))
+}
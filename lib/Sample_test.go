@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSampler(t *testing.T) {
+	docs := make([]Doc, 10000)
+	for i := range docs {
+		docs[i] = Doc{Id: fmt.Sprintf("id%d", i), Source: map[string]interface{}{"user": fmt.Sprintf("u%d", i%100)}}
+	}
+	tests := []struct {
+		percent float64
+		by      string
+	}{
+		{10, "_id"},
+		{50, ""},
+		{1, "_id"},
+		{25, "user"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v %s", tt.percent, tt.by), func(t *testing.T) {
+			a, b := NewSampler(tt.percent, tt.by), NewSampler(tt.percent, tt.by)
+			kept := 0
+			for _, d := range docs {
+				// 同一条文档在不同实例上结果一样
+				keep := a.Keep(d)
+				if keep != b.Keep(d) {
+					t.Fatalf("%s kept by one sampler only", d.Id)
+				}
+				if keep {
+					kept++
+				}
+			}
+			if k, d := a.Counts(); k != int64(kept) || k+d != int64(len(docs)) {
+				t.Fatalf("counts %d %d, kept %d", k, d, kept)
+			}
+			// 按字段抽样时只有 100 个不同的值，误差放宽
+			tolerance := 0.02
+			if tt.by == "user" {
+				tolerance = 0.1
+			}
+			if got := float64(kept) / float64(len(docs)); math.Abs(got-tt.percent/100) > tolerance {
+				t.Fatalf("kept %.3f, want about %.2f", got, tt.percent/100)
+			}
+		})
+	}
+
+	// 按字段抽样时同一个值的文档一起保留或丢弃，字段取不到时按 _id
+	s := NewSampler(50, "user")
+	byUser := map[string]bool{}
+	for _, d := range docs {
+		user := d.Source["user"].(string)
+		keep := s.Keep(d)
+		if prev, seen := byUser[user]; seen && prev != keep {
+			t.Fatalf("documents of %s sampled differently", user)
+		}
+		byUser[user] = keep
+	}
+	noField := Doc{Id: "id1", Source: map[string]interface{}{}}
+	if s.Keep(noField) != NewSampler(50, "_id").Keep(noField) {
+		t.Fatal("missing field not sampled by _id")
+	}
+	if kept := NewSampler(50, "_id").Filter(append([]Doc(nil), docs[:100]...)); len(kept) == 0 || len(kept) == 100 {
+		t.Fatalf("filter kept %d of 100", len(kept))
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(1000)
+	begin := time.Now()
+	if wait := l.Wait(50); wait != 0 {
+		t.Fatalf("first batch waited %s", wait)
+	}
+	// 前一批 50 条占了 50ms，下一批排在它后面；100 条再占 100ms
+	wait := l.Wait(100)
+	if wait < 30*time.Millisecond || wait > 50*time.Millisecond {
+		t.Fatalf("second batch waited %s", wait)
+	}
+	wait = l.Wait(1)
+	if wait < 80*time.Millisecond || wait > 100*time.Millisecond {
+		t.Fatalf("third batch waited %s", wait)
+	}
+	if elapsed := time.Since(begin); elapsed < 150*time.Millisecond {
+		t.Fatalf("three batches took %s", elapsed)
+	}
+	if l.Waited() < 120*time.Millisecond {
+		t.Fatalf("waited %s in total", l.Waited())
+	}
+
+	// 空闲之后不能攒额度
+	l = NewRateLimiter(1000)
+	l.Wait(10)
+	time.Sleep(30 * time.Millisecond)
+	if wait := l.Wait(10); wait != 0 {
+		t.Fatalf("waited %s after idling", wait)
+	}
+	if wait := l.Wait(10); wait < 5*time.Millisecond {
+		t.Fatalf("idle time was saved up: waited %s", wait)
+	}
+}
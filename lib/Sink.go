@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/elastic/go-elasticsearch/v7"
+	"io"
+	"sync"
+)
+
+// Sink 同步的写入目标，getData 读到的每批文档经过转换后交给 Sink
+type Sink interface {
+	// Write 写入一批文档，返回成功、冲突和失败条数；error 表示整批都没有写入
+	Write(docs []Doc) (BulkResult, error)
+	Flush() error
+	Close() error
+	// Health 目标是否可写，ctx 结束时放弃检查
+	Health(ctx context.Context) error
+}
+
+// CheckpointSink 能从已写入的数据推算同步进度，没有保存的进度时用来初始化
+type CheckpointSink interface {
+	LastSortValue(sortField string) (interface{}, bool, error)
+}
+
+// Purger 能按日期字段清理过期数据的 Sink，log_keep_day 对非 elasticsearch 目标通过它生效
+type Purger interface {
+	Purge(dateField string, before interface{}) (int64, error)
+}
+
+// NdjsonLine 文件类 Sink 的行格式，和 export 的输出一致，可以直接 import
+type NdjsonLine struct {
+	Index  string      `json:"_index,omitempty"`
+	Id     string      `json:"_id,omitempty"`
+	Source interface{} `json:"_source"`
+}
+
+func docLine(doc Doc) NdjsonLine {
+	index := doc.TargetIndex
+	if index == "" {
+		index = doc.Index
+	}
+	return NdjsonLine{Index: index, Id: doc.Id, Source: doc.Source}
+}
+
+type EsSink struct {
+	Client    *elasticsearch.Client
+	IndexName string
+	WriteMode string // create 或 index
+	Options   WriteOptions
+}
+
+func NewEsSink(es *elasticsearch.Client, indexName string, writeMode string, opts WriteOptions) *EsSink {
+	if writeMode == "" {
+		writeMode = "create"
+	}
+	return &EsSink{Client: es, IndexName: indexName, WriteMode: writeMode, Options: opts}
+}
+
+func (s *EsSink) Write(docs []Doc) (BulkResult, error) {
+	return Bulk(s.Client, s.IndexName, docs, s.WriteMode, s.Options)
+}
+
+func (s *EsSink) Flush() error {
+	return nil
+}
+
+func (s *EsSink) Close() error {
+	return nil
+}
+
+// Health fails when the cluster is unreachable or red, or the index does not accept writes.
+func (s *EsSink) Health(ctx context.Context) error {
+	if err := ClusterHealth(ctx, s.Client); err != nil {
+		return err
+	}
+	return IndexWritable(ctx, s.Client, s.IndexName)
+}
+
+func (s *EsSink) LastSortValue(sortField string) (interface{}, bool, error) {
+	docs, _, err := SearchDocs(s.Client, s.IndexName, MatchQuery{}, sortField, "desc", 0, 1)
+	if err != nil || len(docs) == 0 {
+		return nil, false, err
+	}
+	v, ok := GetField(docs[0].Source, sortField)
+	return v, ok, nil
+}
+
+// StdoutSink 把文档按 NDJSON 打印到标准输出
+type StdoutSink struct {
+	mu  sync.Mutex
+	out *bufio.Writer
+}
+
+func NewStdoutSink(w io.Writer) *StdoutSink {
+	return &StdoutSink{out: bufio.NewWriter(w)}
+}
+
+func (s *StdoutSink) Write(docs []Doc) (BulkResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := BulkResult{}
+	enc := json.NewEncoder(s.out)
+	for i, doc := range docs {
+		if err := enc.Encode(docLine(doc)); err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, DocError{Id: doc.Id, Err: err.Error(), Doc: &docs[i]})
+			continue
+		}
+		result.Succeeded++
+	}
+	return result, s.out.Flush()
+}
+
+func (s *StdoutSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.out.Flush()
+}
+
+func (s *StdoutSink) Close() error {
+	return s.Flush()
+}
+
+func (s *StdoutSink) Health(ctx context.Context) error {
+	return nil
+}
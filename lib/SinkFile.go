@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// FileSink 把文档写成按条数或大小切分的 NDJSON 文件
+type FileSink struct {
+	mu     sync.Mutex
+	writer *RotatingNdjsonWriter
+}
+
+func NewFileSink(dir string, prefix string, compress bool, maxDocs int64, maxBytes int64) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileSink{writer: &RotatingNdjsonWriter{
+		Dir:      dir,
+		Prefix:   prefix,
+		Compress: compress,
+		MaxDocs:  maxDocs,
+		MaxBytes: maxBytes,
+	}}, nil
+}
+
+func (s *FileSink) Write(docs []Doc) (BulkResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := BulkResult{}
+	for _, doc := range docs {
+		if err := s.writer.Write(docLine(doc)); err != nil {
+			return result, err
+		}
+		result.Succeeded++
+	}
+	// 每批落盘，保存进度前数据已经在文件里
+	return result, s.writer.Flush()
+}
+
+func (s *FileSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writer.Flush()
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writer.Close()
+}
+
+// Health checks that the output directory is writable.
+func (s *FileSink) Health(ctx context.Context) error {
+	f, err := ioutil.TempFile(s.writer.Dir, ".health")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
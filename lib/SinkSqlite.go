@@ -0,0 +1,337 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	_ "modernc.org/sqlite"
+	"strings"
+	"time"
+)
+
+// SqliteColumn 一个表字段，Field 是文档里的字段路径，Column 为空时取 Field 把 . 换成 _
+type SqliteColumn struct {
+	Field  string
+	Column string
+	Type   string // TEXT、INTEGER、REAL
+}
+
+// SqliteSink 把文档按 _id upsert 到 sqlite 表。
+// JsonColumn 为 true 时整条文档存在 doc 列，Columns 是从 doc 生成的虚拟列；否则 Columns 是普通列。
+type SqliteSink struct {
+	Path       string
+	Table      string
+	Columns    []SqliteColumn
+	JsonColumn bool
+	db         *sql.DB
+	upsert     string
+}
+
+func NewSqliteSink(path string, table string, columns []SqliteColumn, jsonColumn bool) (*SqliteSink, error) {
+	if table == "" {
+		return nil, errors.New("sqlite sink: table is required")
+	}
+	if !jsonColumn && len(columns) == 0 {
+		return nil, errors.New("sqlite sink: columns are required without json_column")
+	}
+	s := &SqliteSink{Path: path, Table: table, JsonColumn: jsonColumn}
+	for _, c := range columns {
+		if c.Column == "" {
+			c.Column = strings.Replace(c.Field, ".", "_", -1)
+		}
+		switch strings.ToUpper(c.Type) {
+		case "", "TEXT":
+			c.Type = "TEXT"
+		case "INTEGER", "REAL":
+			c.Type = strings.ToUpper(c.Type)
+		default:
+			return nil, fmt.Errorf("sqlite sink: column %s has unsupported type %s", c.Field, c.Type)
+		}
+		s.Columns = append(s.Columns, c)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// 单连接写入，WAL 模式下分析人员可以同时读
+	db.SetMaxOpenConns(1)
+	s.db = db
+	if err := s.init(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func (s *SqliteSink) init() error {
+	for _, pragma := range []string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000", "PRAGMA synchronous=NORMAL"} {
+		if _, err := s.db.Exec(pragma); err != nil {
+			return err
+		}
+	}
+	defs := []string{`"_id" TEXT PRIMARY KEY`}
+	insertCols := []string{`"_id"`}
+	if s.JsonColumn {
+		defs = append(defs, `"doc" TEXT`)
+		insertCols = append(insertCols, `"doc"`)
+	}
+	for _, c := range s.Columns {
+		if s.JsonColumn {
+			defs = append(defs, fmt.Sprintf("%s %s GENERATED ALWAYS AS (json_extract(doc, '$.%s')) VIRTUAL",
+				quoteIdent(c.Column), c.Type, strings.Replace(c.Field, "'", "''", -1)))
+		} else {
+			defs = append(defs, quoteIdent(c.Column)+" "+c.Type)
+			insertCols = append(insertCols, quoteIdent(c.Column))
+		}
+	}
+	defs = append(defs, `"_synced_at" INTEGER`)
+	insertCols = append(insertCols, `"_synced_at"`)
+	create := func(table string) string {
+		return fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdent(table), strings.Join(defs, ", "))
+	}
+	if err := s.migrate(create, insertCols); err != nil {
+		return err
+	}
+	for _, c := range s.Columns {
+		index := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)",
+			quoteIdent("idx_"+s.Table+"_"+c.Column), quoteIdent(s.Table), quoteIdent(c.Column))
+		if _, err := s.db.Exec(index); err != nil {
+			return err
+		}
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(insertCols)), ", ")
+	updates := make([]string, 0, len(insertCols)-1)
+	for _, c := range insertCols[1:] {
+		updates = append(updates, c+" = excluded."+c)
+	}
+	s.upsert = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT(\"_id\") DO UPDATE SET %s",
+		quoteIdent(s.Table), strings.Join(insertCols, ", "), placeholders, strings.Join(updates, ", "))
+	return nil
+}
+
+// sqliteSchemaVersion 记在 PRAGMA user_version 里的表结构版本，文件的版本比它新时不打开
+const sqliteSchemaVersion = 1
+
+// migrate 建表。表已经存在但定义和配置不同(改了 columns、列类型或 json_column)时在一个事务里重建：
+// 按新定义建临时表，拷贝两边都有的普通列，生成列从 doc 按新定义重新计算，再删掉旧表(连同索引)换成新表
+func (s *SqliteSink) migrate(create func(table string) string, insertCols []string) error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > sqliteSchemaVersion {
+		return fmt.Errorf("sqlite sink: %s has schema version %d, this essync supports up to %d", s.Path, version, sqliteSchemaVersion)
+	}
+	setVersion := fmt.Sprintf("PRAGMA user_version = %d", sqliteSchemaVersion)
+	var current string
+	err := s.db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", s.Table).Scan(&current)
+	if err == sql.ErrNoRows {
+		if _, err := s.db.Exec(create(s.Table)); err != nil {
+			return err
+		}
+		_, err = s.db.Exec(setVersion)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	// sqlite_master 里存的是去掉 IF NOT EXISTS 之后的建表语句
+	if current == create(s.Table) {
+		if version < sqliteSchemaVersion {
+			_, err = s.db.Exec(setVersion)
+		}
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_xinfo(%s)", quoteIdent(s.Table)))
+	if err != nil {
+		return err
+	}
+	old := map[string]bool{}
+	for rows.Next() {
+		var cid, notNull, pk, hidden int
+		var name, typ string
+		var dflt interface{}
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk, &hidden); err != nil {
+			rows.Close()
+			return err
+		}
+		// hidden 为 2、3 的是生成列，不能也不用拷贝
+		if hidden == 0 {
+			old[quoteIdent(name)] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	var common []string
+	for _, c := range insertCols {
+		if old[c] {
+			common = append(common, c)
+		}
+	}
+	tmp := s.Table + "_migrate"
+	cols := strings.Join(common, ", ")
+	for _, stmt := range []string{
+		"DROP TABLE IF EXISTS " + quoteIdent(tmp),
+		create(tmp),
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", quoteIdent(tmp), cols, cols, quoteIdent(s.Table)),
+		"DROP TABLE " + quoteIdent(s.Table),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", quoteIdent(tmp), quoteIdent(s.Table)),
+		setVersion,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("sqlite sink: migrate table %s: %v", s.Table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// sqliteValue 把文档字段转成 sqlite 能存的值，对象和数组存 json 文本
+func sqliteValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil, string, bool, int64, float64:
+		return t
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		if f, err := t.Float64(); err == nil {
+			return f
+		}
+		return t.String()
+	default:
+		b, err := json.Marshal(t)
+		if err != nil {
+			return nil
+		}
+		return string(b)
+	}
+}
+
+func (s *SqliteSink) Write(docs []Doc) (BulkResult, error) {
+	result := BulkResult{}
+	if len(docs) == 0 {
+		return result, nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return result, err
+	}
+	stmt, err := tx.Prepare(s.upsert)
+	if err != nil {
+		tx.Rollback()
+		return result, err
+	}
+	defer stmt.Close()
+	now := time.Now().Unix()
+	for i, doc := range docs {
+		args := make([]interface{}, 0, len(s.Columns)+3)
+		raw, err := json.Marshal(doc.Source)
+		if err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, DocError{Id: doc.Id, Err: err.Error(), Doc: &docs[i]})
+			continue
+		}
+		id := doc.Id
+		if id == "" {
+			// 没有 id 的文档按内容生成，重复写入时不会产生重复行
+			sum := sha1.Sum(raw)
+			id = hex.EncodeToString(sum[:])
+		}
+		args = append(args, id)
+		if s.JsonColumn {
+			args = append(args, string(raw))
+		} else {
+			for _, c := range s.Columns {
+				v, _ := GetField(doc.Source, c.Field)
+				args = append(args, sqliteValue(v))
+			}
+		}
+		args = append(args, now)
+		if _, err := stmt.Exec(args...); err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, DocError{Id: id, Err: err.Error(), Doc: &docs[i]})
+			continue
+		}
+		result.Succeeded++
+	}
+	if err := tx.Commit(); err != nil {
+		return BulkResult{}, err
+	}
+	return result, nil
+}
+
+// fieldExpr 字段在 sql 中的表达式：配置了列就用列，否则从 doc 里取
+func (s *SqliteSink) fieldExpr(field string) (string, error) {
+	for _, c := range s.Columns {
+		if c.Field == field {
+			return quoteIdent(c.Column), nil
+		}
+	}
+	if s.JsonColumn {
+		return fmt.Sprintf("json_extract(doc, '$.%s')", strings.Replace(field, "'", "''", -1)), nil
+	}
+	return "", errors.New("sqlite sink: field " + field + " is not a column")
+}
+
+func (s *SqliteSink) LastSortValue(sortField string) (interface{}, bool, error) {
+	expr, err := s.fieldExpr(sortField)
+	if err != nil {
+		return nil, false, err
+	}
+	var v interface{}
+	err = s.db.QueryRow(fmt.Sprintf("SELECT MAX(%s) FROM %s", expr, quoteIdent(s.Table))).Scan(&v)
+	if err != nil || v == nil {
+		return nil, false, err
+	}
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	return v, true, nil
+}
+
+// Purge deletes rows whose dateField is before the given value, for log_keep_day retention.
+// A time.Time is compared with julianday() so date texts with a T or a space, fractions and
+// time zone offsets all compare as instants; rows whose date sqlite can't parse are kept.
+func (s *SqliteSink) Purge(dateField string, before interface{}) (int64, error) {
+	expr, err := s.fieldExpr(dateField)
+	if err != nil {
+		return 0, err
+	}
+	where := expr + " < ?"
+	if t, ok := before.(time.Time); ok {
+		where = fmt.Sprintf("julianday(%s) < julianday(?)", expr)
+		before = t.UTC().Format("2006-01-02 15:04:05.000")
+	}
+	res, err := s.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", quoteIdent(s.Table), where), before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SqliteSink) Flush() error {
+	return nil
+}
+
+func (s *SqliteSink) Close() error {
+	return s.db.Close()
+}
+
+func (s *SqliteSink) Health(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openSqlite(t *testing.T, path string, columns []SqliteColumn, jsonColumn bool) *SqliteSink {
+	t.Helper()
+	s, err := NewSqliteSink(path, "logs", columns, jsonColumn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func sqliteIds(t *testing.T, s *SqliteSink, query string) []string {
+	t.Helper()
+	rows, err := s.db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestSqlitePurgeDates(t *testing.T) {
+	s := openSqlite(t, filepath.Join(t.TempDir(), "a.db"), []SqliteColumn{{Field: "ts"}}, true)
+	defer s.Close()
+	docs := []Doc{
+		{Id: "space", Source: map[string]interface{}{"ts": "2024-01-01 23:00:00"}},
+		{Id: "offset", Source: map[string]interface{}{"ts": "2024-01-02T07:30:00+08:00"}}, // 2024-01-01 23:30 UTC
+		{Id: "zulu", Source: map[string]interface{}{"ts": "2024-01-02T00:30:00.250Z"}},
+		{Id: "later", Source: map[string]interface{}{"ts": "2024-01-02 10:00:00"}},
+		{Id: "garbage", Source: map[string]interface{}{"ts": "yesterday"}},
+	}
+	if _, err := s.Write(docs); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := s.Purge("ts", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil || deleted != 2 {
+		t.Fatalf("deleted %d, %v", deleted, err)
+	}
+	if ids := sqliteIds(t, s, `SELECT "_id" FROM "logs" ORDER BY "_id"`); len(ids) != 3 || ids[0] != "garbage" || ids[1] != "later" || ids[2] != "zulu" {
+		t.Fatalf("left %v", ids)
+	}
+	// int64 日期仍然按数值比较
+	s.Write([]Doc{{Id: "epoch", Source: map[string]interface{}{"ts": int64(100)}}})
+	if deleted, err := s.Purge("ts", int64(200)); err != nil || deleted != 1 {
+		t.Fatalf("epoch deleted %d, %v", deleted, err)
+	}
+}
+
+func TestSqliteSchemaMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.db")
+	s := openSqlite(t, path, []SqliteColumn{{Field: "app"}}, true)
+	s.Write([]Doc{{Id: "1", Source: map[string]interface{}{"app": "x", "took": 5}}})
+	s.Close()
+
+	// 改了生成列：表重建，新列从 doc 算出来，数据保留
+	s = openSqlite(t, path, []SqliteColumn{{Field: "app"}, {Field: "took", Type: "integer"}}, true)
+	var took int64
+	if err := s.db.QueryRow(`SELECT "took" FROM "logs" WHERE "_id" = '1'`).Scan(&took); err != nil || took != 5 {
+		t.Fatalf("took %d, %v", took, err)
+	}
+	if ids := sqliteIds(t, s, `SELECT name FROM sqlite_master WHERE type = 'index' AND name LIKE 'idx_%' ORDER BY name`); len(ids) != 2 {
+		t.Fatalf("indexes %v", ids)
+	}
+	var version int
+	s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if version != sqliteSchemaVersion {
+		t.Fatalf("user_version %d", version)
+	}
+	var create string
+	s.db.QueryRow("SELECT sql FROM sqlite_master WHERE name = 'logs'").Scan(&create)
+	s.Close()
+
+	// 配置没变时不再重建
+	s = openSqlite(t, path, []SqliteColumn{{Field: "app"}, {Field: "took", Type: "integer"}}, true)
+	var again string
+	s.db.QueryRow("SELECT sql FROM sqlite_master WHERE name = 'logs'").Scan(&again)
+	if again != create {
+		t.Fatalf("table changed without a config change:\n%s\n%s", create, again)
+	}
+	s.db.Exec("PRAGMA user_version = 99")
+	s.Close()
+	if _, err := NewSqliteSink(path, "logs", []SqliteColumn{{Field: "app"}}, true); err == nil {
+		t.Fatal("opened a file with a newer schema version")
+	}
+}
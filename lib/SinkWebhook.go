@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WebhookSink 把每批文档以 json 数组 POST 到 Url
+type WebhookSink struct {
+	Url     string
+	Headers map[string]string
+	client  *http.Client
+	mu      sync.Mutex
+	lastErr error
+}
+
+func NewWebhookSink(url string, headers map[string]string, timeout time.Duration) *WebhookSink {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &WebhookSink{Url: url, Headers: headers, client: &http.Client{Timeout: timeout}}
+}
+
+func (s *WebhookSink) Write(docs []Doc) (BulkResult, error) {
+	result := BulkResult{}
+	if len(docs) == 0 {
+		return result, nil
+	}
+	lines := make([]NdjsonLine, 0, len(docs))
+	for _, doc := range docs {
+		lines = append(lines, docLine(doc))
+	}
+	body, err := json.Marshal(lines)
+	if err != nil {
+		return result, err
+	}
+	err = s.post(body)
+	s.mu.Lock()
+	s.lastErr = err
+	s.mu.Unlock()
+	if err != nil {
+		return result, err
+	}
+	result.Succeeded = len(docs)
+	return result, nil
+}
+
+// Post sends a raw json body, used for alert notifications.
+func (s *WebhookSink) Post(body []byte) error {
+	return s.post(body)
+}
+
+func (s *WebhookSink) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("webhook %s: %s %s", s.Url, res.Status, string(msg))
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	return nil
+}
+
+func (s *WebhookSink) Flush() error {
+	return nil
+}
+
+func (s *WebhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// Health reports the error of the last delivery.
+func (s *WebhookSink) Health(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastErr
+}
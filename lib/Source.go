@@ -0,0 +1,305 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Source 同步的数据来源
+type Source interface {
+	// Fetch 读取 cp 之后最多 size 条文档，返回文档和读完这批之后的进度
+	Fetch(cp Checkpoint, size int) ([]Doc, Checkpoint, error)
+	// Lag 报告 cp 落后来源多少
+	Lag(cp Checkpoint) (Lag, error)
+	// Health 来源是否可读，ctx 结束时放弃检查
+	Health(ctx context.Context) error
+	Close() error
+}
+
+// Lag 同步延迟，Docs 为 -1 表示来源无法统计条数
+type Lag struct {
+	Docs   int64       `json:"docs"`
+	Bytes  int64       `json:"bytes"`
+	Latest interface{} `json:"latest,omitempty"`
+}
+
+// SortTime 把 sort_field 的值换成时间：数字大于 1e11 按毫秒，否则按秒；字符串按 RFC3339 解析
+func SortTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, !t.IsZero()
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, t)
+		return parsed, err == nil
+	}
+	n, err := strconv.ParseFloat(FieldString(v), 64)
+	if err != nil || n <= 0 {
+		return time.Time{}, false
+	}
+	if n > 1e11 {
+		return time.Unix(0, int64(n*float64(time.Millisecond))), true
+	}
+	return time.Unix(0, int64(n*float64(time.Second))), true
+}
+
+// EsSource 按 sort_field 升序增量读取 elasticsearch 索引，Partition 不为空时只读其中一个分区。
+// 一次扫描(读到一批不满为止)在同一个 point in time 里按 [sort_field, _shard_doc] 翻页
+type EsSource struct {
+	Client    *elasticsearch.Client
+	IndexName string
+	SortField string
+	Partition *Partition
+	mu        sync.Mutex
+	scans     []*esScan
+}
+
+// esScan 进行中的扫描，next 为读完上一页后返回的进度，同一个进度再来读时接着翻页
+type esScan struct {
+	pitId string
+	query MatchQuery
+	after []json.RawMessage
+	next  Checkpoint
+}
+
+const (
+	scanKeepAlive = "5m"
+	// 扇出的目标脱离后各自追赶，每个都有自己的扫描
+	maxScans = 4
+)
+
+func NewEsSource(es *elasticsearch.Client, indexName string, sortField string) *EsSource {
+	return &EsSource{Client: es, IndexName: indexName, SortField: sortField}
+}
+
+func (s *EsSource) afterQuery(cp Checkpoint) MatchQuery {
+	if cp.Value == nil {
+		return MatchQuery{}
+	}
+	return MatchQuery{
+		"query": map[string]interface{}{
+			"range": map[string]interface{}{
+				s.SortField: map[string]interface{}{
+					"gt": cp.Value,
+				},
+			},
+		},
+	}
+}
+
+// scanQuery 新扫描从 cp 的值(含)开始，跳过这个值上已经读过的 Ids
+func (s *EsSource) scanQuery(cp Checkpoint) MatchQuery {
+	if cp.Value == nil {
+		return MatchQuery{}
+	}
+	b := map[string]interface{}{
+		"filter": map[string]interface{}{
+			"range": map[string]interface{}{
+				s.SortField: map[string]interface{}{"gte": cp.Value},
+			},
+		},
+	}
+	if len(cp.Ids) > 0 {
+		b["must_not"] = map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []interface{}{
+					map[string]interface{}{"term": map[string]interface{}{s.SortField: cp.Value}},
+					map[string]interface{}{"ids": map[string]interface{}{"values": cp.Ids}},
+				},
+			},
+		}
+	}
+	return MatchQuery{"query": map[string]interface{}{"bool": b}}
+}
+
+// NewEsPartitionSource 读索引的一个分区，每个分区单独保存进度
+func NewEsPartitionSource(es *elasticsearch.Client, indexName string, sortField string, p Partition) *EsSource {
+	return &EsSource{Client: es, IndexName: indexName, SortField: sortField, Partition: &p}
+}
+
+// takeScan 取出接着 cp 的扫描，没有时为 nil
+func (s *EsSource) takeScan(cp Checkpoint) *esScan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sc := range s.scans {
+		if sc.next.Equal(cp) {
+			s.scans = append(s.scans[:i], s.scans[i+1:]...)
+			return sc
+		}
+	}
+	return nil
+}
+
+// keepScan 放回没读完的扫描，超过 maxScans 时关掉最早的
+func (s *EsSource) keepScan(sc *esScan) {
+	s.mu.Lock()
+	s.scans = append(s.scans, sc)
+	var old []*esScan
+	if len(s.scans) > maxScans {
+		old = append(old, s.scans[:len(s.scans)-maxScans]...)
+		s.scans = append([]*esScan(nil), s.scans[len(s.scans)-maxScans:]...)
+	}
+	s.mu.Unlock()
+	for _, sc := range old {
+		CloseScan(s.Client, sc.pitId)
+	}
+}
+
+// Fetch 读 cp 之后的一批。进度接着上一批时在原来的 point in time 里 search_after 翻页，
+// 否则(第一次、上一批读完或没写成功重读)打开新的 point in time 从 cp 开始
+func (s *EsSource) Fetch(cp Checkpoint, size int) ([]Doc, Checkpoint, error) {
+	sc := s.takeScan(cp)
+	if sc != nil {
+		hits, err := s.page(sc, size)
+		if err == nil {
+			return s.advance(sc, cp, hits, size)
+		}
+		// point in time 过期等错误时重新扫描一次
+		esLog.Debug("scan", "index", s.IndexName, "restart", err)
+		CloseScan(s.Client, sc.pitId)
+	}
+	pitId, err := OpenScan(s.Client, s.IndexName, scanKeepAlive, s.Partition)
+	if err != nil || pitId == "" {
+		return nil, cp, err
+	}
+	sc = &esScan{pitId: pitId, query: s.scanQuery(cp)}
+	hits, err := s.page(sc, size)
+	if err != nil {
+		CloseScan(s.Client, sc.pitId)
+		return nil, cp, err
+	}
+	return s.advance(sc, cp, hits, size)
+}
+
+func (s *EsSource) page(sc *esScan, size int) ([]*SearchResponseHitsHits, error) {
+	hits, pitId, err := SearchSorted(s.Client, sc.pitId, scanKeepAlive, sc.query, s.SortField, "asc", sc.after, size, s.Partition)
+	sc.pitId = pitId
+	return hits, err
+}
+
+// advance 读到一页之后的进度：Value 为最后一条的 sort_field 值，Ids 为这个值上已经读过的 _id。
+// 一页不满说明扫描读完了，关掉 point in time，下次重新打开才能看到新写入的文档
+func (s *EsSource) advance(sc *esScan, cp Checkpoint, hits []*SearchResponseHitsHits, size int) ([]Doc, Checkpoint, error) {
+	docs, err := HitsToDocs(hits)
+	if err != nil || len(docs) == 0 {
+		CloseScan(s.Client, sc.pitId)
+		return docs, cp, err
+	}
+	next := NextCheckpoint(cp, docs, s.SortField)
+	if len(hits) < size {
+		CloseScan(s.Client, sc.pitId)
+		return docs, next, nil
+	}
+	sc.after = hits[len(hits)-1].Sort
+	sc.next = next
+	s.keepScan(sc)
+	return docs, next, nil
+}
+
+// NextCheckpoint 按 sort_field 升序读完 docs 之后的进度。最后一个值和 cp 相同时接着累积 cp.Ids，
+// 同一个值的文档很多时 Ids 会变长，值前进后就只剩这个值上的文档
+func NextCheckpoint(cp Checkpoint, docs []Doc, sortField string) Checkpoint {
+	next := cp
+	last, ok := GetField(docs[len(docs)-1].Source, sortField)
+	if !ok {
+		return next
+	}
+	key := FieldString(last)
+	var ids []string
+	if FieldString(cp.Value) == key {
+		ids = append(ids, cp.Ids...)
+	}
+	for _, d := range docs {
+		if v, ok := GetField(d.Source, sortField); ok && FieldString(v) == key {
+			ids = append(ids, d.Id)
+		}
+	}
+	next.Value = last
+	next.Ids = ids
+	return next
+}
+
+// Lag counts the documents after cp and reports the newest sort_field value.
+// id_hash partitions can't be counted, Docs is -1 for them.
+func (s *EsSource) Lag(cp Checkpoint) (Lag, error) {
+	lag := Lag{}
+	if s.Partition != nil && s.Partition.By == "id_hash" {
+		lag.Docs = -1
+		return lag, s.latest(&lag)
+	}
+	var buf bytes.Buffer
+	query := s.afterQuery(cp)
+	if len(query) == 0 {
+		query = MatchQuery{"query": map[string]interface{}{"match_all": map[string]interface{}{}}}
+	}
+	if err := json.NewEncoder(&buf).Encode(query); err != nil {
+		return lag, err
+	}
+	opts := []func(*esapi.CountRequest){
+		s.Client.Count.WithContext(context.Background()),
+		s.Client.Count.WithIndex(s.IndexName),
+		s.Client.Count.WithBody(&buf),
+	}
+	if s.Partition != nil {
+		opts = append(opts, s.Client.Count.WithPreference("_shards:"+strconv.Itoa(s.Partition.Id)))
+	}
+	res, err := s.Client.Count(opts...)
+	if err != nil {
+		return lag, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return lag, errors.New("count: " + res.String())
+	}
+	var r struct {
+		Count int64 `json:"count"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return lag, err
+	}
+	lag.Docs = r.Count
+	return lag, s.latest(&lag)
+}
+
+// latest 来源(分区)里最新的 sort_field 值
+func (s *EsSource) latest(lag *Lag) error {
+	pitId, err := OpenScan(s.Client, s.IndexName, "1m", s.Partition)
+	if err != nil || pitId == "" {
+		return err
+	}
+	hits, pitId, err := SearchSorted(s.Client, pitId, "1m", MatchQuery{}, s.SortField, "desc", nil, 1, s.Partition)
+	CloseScan(s.Client, pitId)
+	if err != nil {
+		return err
+	}
+	latest, err := HitsToDocs(hits)
+	if err != nil {
+		return err
+	}
+	if len(latest) > 0 {
+		lag.Latest, _ = GetField(latest[0].Source, s.SortField)
+	}
+	return nil
+}
+
+// Health fails when the cluster is unreachable or red.
+func (s *EsSource) Health(ctx context.Context) error {
+	return ClusterHealth(ctx, s.Client)
+}
+
+func (s *EsSource) Close() error {
+	s.mu.Lock()
+	scans := s.scans
+	s.scans = nil
+	s.mu.Unlock()
+	for _, sc := range scans {
+		CloseScan(s.Client, sc.pitId)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FileSource 跟踪一个 NDJSON 日志文件，支持 logrotate 改名轮转和 copytruncate 截断。
+// 进度记录文件的 inode 和偏移量，轮转后先把旧文件读完再切到新文件。
+type FileSource struct {
+	Path       string
+	IdField    string
+	StartAtEnd bool
+	mu         sync.Mutex
+	cur        *os.File
+	curInode   uint64
+}
+
+func NewFileSource(path string, idField string, startAtEnd bool) *FileSource {
+	return &FileSource{Path: path, IdField: idField, StartAtEnd: startAtEnd}
+}
+
+func (s *FileSource) Fetch(cp Checkpoint, size int) ([]Doc, Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, err := os.Stat(s.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, cp, err
+	}
+	if cp.Path != s.Path {
+		// 第一次读这个文件
+		if info == nil {
+			return nil, cp, nil
+		}
+		cp = Checkpoint{Path: s.Path, Inode: fileInode(s.Path, info)}
+		if s.StartAtEnd {
+			cp.Offset = info.Size()
+		}
+	}
+	if info == nil || fileInode(s.Path, info) != cp.Inode {
+		// 已轮转：旧文件还能找到就先读完
+		if f := s.openInode(cp.Inode); f != nil {
+			docs, offset, err := s.readLines(f, cp.Offset, size)
+			if err != nil || len(docs) > 0 || offset != cp.Offset {
+				cp.Offset = offset
+				return docs, cp, err
+			}
+		} else {
+			MetricAdd("essync_source_rotation_lost_total", map[string]string{"path": s.Path}, 1)
+		}
+		if info == nil {
+			return nil, cp, nil
+		}
+		s.closeCur()
+		cp = Checkpoint{Path: s.Path, Inode: fileInode(s.Path, info)}
+	}
+	if info.Size() < cp.Offset {
+		// copytruncate 之类的截断，从头读
+		MetricAdd("essync_source_truncated_total", map[string]string{"path": s.Path}, 1)
+		cp.Offset = 0
+	}
+	f := s.openInode(cp.Inode)
+	if f == nil {
+		return nil, cp, os.ErrNotExist
+	}
+	docs, offset, err := s.readLines(f, cp.Offset, size)
+	cp.Offset = offset
+	return docs, cp, err
+}
+
+// openInode 返回 inode 对应的文件：当前持有的句柄、当前路径，或同目录下轮转出来的文件
+func (s *FileSource) openInode(inode uint64) *os.File {
+	if s.cur != nil && s.curInode == inode {
+		return s.cur
+	}
+	candidates := []string{s.Path}
+	if matches, err := filepath.Glob(s.Path + "*"); err == nil {
+		candidates = append(candidates, matches...)
+	}
+	for _, path := range candidates {
+		if path != s.Path && strings.HasSuffix(path, ".gz") {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || fileInode(path, info) != inode {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		s.closeCur()
+		s.cur = f
+		s.curInode = inode
+		return f
+	}
+	return nil
+}
+
+func (s *FileSource) closeCur() {
+	if s.cur != nil {
+		s.cur.Close()
+		s.cur = nil
+		s.curInode = 0
+	}
+}
+
+// readLines 从 offset 开始读最多 size 行完整的行，不完整的最后一行留到下次
+func (s *FileSource) readLines(f *os.File, offset int64, size int) ([]Doc, int64, error) {
+	reader := bufio.NewReaderSize(io.NewSectionReader(f, offset, math.MaxInt64-offset), 64*1024)
+	var docs []Doc
+	for len(docs) < size {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return docs, offset, nil
+		}
+		if err != nil {
+			return docs, offset, err
+		}
+		offset += int64(len(line))
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		source, err := DecodeSource(line)
+		if err != nil {
+			MetricAdd("essync_source_bad_lines_total", map[string]string{"path": s.Path}, 1)
+			continue
+		}
+		doc := Doc{Source: source}
+		if s.IdField != "" {
+			if v, ok := GetField(source, s.IdField); ok {
+				doc.Id = FieldString(v)
+			}
+		}
+		docs = append(docs, doc)
+	}
+	return docs, offset, nil
+}
+
+// Lag reports the unread bytes of the current file and of a rotated file not yet drained.
+func (s *FileSource) Lag(cp Checkpoint) (Lag, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lag := Lag{Docs: -1}
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return lag, err
+	}
+	if cp.Path != s.Path || fileInode(s.Path, info) == cp.Inode {
+		if info.Size() > cp.Offset {
+			lag.Bytes = info.Size() - cp.Offset
+		}
+		return lag, nil
+	}
+	lag.Bytes = info.Size()
+	if s.cur != nil && s.curInode == cp.Inode {
+		if old, err := s.cur.Stat(); err == nil && old.Size() > cp.Offset {
+			lag.Bytes += old.Size() - cp.Offset
+		}
+	}
+	return lag, nil
+}
+
+// Health fails when the file cannot be opened. Between a rename rotation and the
+// new file being created only the directory has to exist.
+func (s *FileSource) Health(ctx context.Context) error {
+	f, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		_, err = os.Stat(filepath.Dir(s.Path))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (s *FileSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeCur()
+	return nil
+}
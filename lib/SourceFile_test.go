@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func appendLines(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, l := range lines {
+		if _, err := f.WriteString(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func idLine(id string) string {
+	return fmt.Sprintf("{\"id\": %q}\n", id)
+}
+
+// fetchIds 读一次，返回读到的 id
+func fetchIds(t *testing.T, s *FileSource, cp Checkpoint, size int) (string, Checkpoint) {
+	t.Helper()
+	docs, next, err := s.Fetch(cp, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, d := range docs {
+		ids = append(ids, d.Id)
+	}
+	return strings.Join(ids, ","), next
+}
+
+func TestFileSourceRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	s := NewFileSource(path, "id", false)
+	defer s.Close()
+	steps := []struct {
+		name   string
+		before func()
+		size   int
+		want   string
+	}{
+		{"missing file", func() {}, 10, ""},
+		{"first page", func() { appendLines(t, path, idLine("a"), idLine("b"), idLine("c")) }, 2, "a,b"},
+		// 不完整的最后一行留到下次
+		{"partial line", func() { appendLines(t, path, `{"id": "d"`) }, 10, "c"},
+		{"line completed", func() { appendLines(t, path, "}\n", "not json\n", "\n", idLine("e")) }, 10, "d,e"},
+		// logrotate 改名之后先把旧文件读完，再读新文件
+		{"renamed", func() {
+			appendLines(t, path, idLine("f"))
+			if err := os.Rename(path, path+".1"); err != nil {
+				t.Fatal(err)
+			}
+			appendLines(t, path, idLine("g"), idLine("h"))
+		}, 10, "f"},
+		{"new file", func() {}, 10, "g,h"},
+		{"idle", func() {}, 10, ""},
+		// copytruncate：文件比进度短时从头读
+		{"truncated", func() {
+			if err := os.Truncate(path, 0); err != nil {
+				t.Fatal(err)
+			}
+			appendLines(t, path, idLine("i"))
+		}, 10, "i"},
+	}
+	var cp Checkpoint
+	for _, step := range steps {
+		step.before()
+		var got string
+		got, cp = fetchIds(t, s, cp, step.size)
+		if got != step.want {
+			t.Fatalf("%s: read %q, want %q (checkpoint %+v)", step.name, got, step.want, cp)
+		}
+	}
+	info, _ := os.Stat(path)
+	if cp.Path != path || cp.Inode != fileInode(path, info) || cp.Offset != info.Size() {
+		t.Fatalf("checkpoint %+v, file size %d", cp, info.Size())
+	}
+}
+
+func TestFileSourceLag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendLines(t, path, idLine("a"), idLine("b"))
+	s := NewFileSource(path, "id", false)
+	defer s.Close()
+	_, cp := fetchIds(t, s, Checkpoint{}, 1)
+	lag, err := s.Lag(cp)
+	if err != nil || lag.Docs != -1 || lag.Bytes != int64(len(idLine("b"))) {
+		t.Fatalf("lag %+v, %v", lag, err)
+	}
+	// 轮转后旧文件没读完的部分也算
+	os.Rename(path, path+".1")
+	appendLines(t, path, idLine("c"))
+	if lag, _ = s.Lag(cp); lag.Bytes != int64(len(idLine("b"))+len(idLine("c"))) {
+		t.Fatalf("lag after rotation %+v", lag)
+	}
+
+	// start_at_end 从文件末尾开始
+	tail := NewFileSource(path, "id", true)
+	defer tail.Close()
+	got, cp := fetchIds(t, tail, Checkpoint{}, 10)
+	appendLines(t, path, idLine("d"))
+	if got2, _ := fetchIds(t, tail, cp, 10); got != "" || got2 != "d" {
+		t.Fatalf("start at end read %q then %q", got, got2)
+	}
+}
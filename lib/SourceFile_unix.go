@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package lib
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode 文件的 inode，轮转改名后不变，用来找到轮转出来的旧文件
+func fileInode(path string, info os.FileInfo) uint64 {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(st.Ino)
+}
@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package lib
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode Windows 上没有 inode，用 NTFS 的文件索引代替，改名后同样不变；打不开时为 0
+func fileInode(path string, info os.FileInfo) uint64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	var d syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(syscall.Handle(f.Fd()), &d); err != nil {
+		return 0
+	}
+	return uint64(d.FileIndexHigh)<<32 | uint64(d.FileIndexLow)
+}
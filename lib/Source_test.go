@@ -0,0 +1,243 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testDoc struct {
+	id string
+	ts float64
+}
+
+// pitEs 模拟 point in time 分页：每个 point in time 里文档的 _shard_doc 顺序不同(像段合并之后)，
+// 不指定 field 的 slice 按这个顺序切分，field 为 _id 时按 _id 哈希切分
+type pitEs struct {
+	mu       sync.Mutex
+	docs     []testDoc
+	pits     map[string][]int
+	opens    int
+	searches int
+}
+
+type pitSearch struct {
+	Pit struct {
+		Id string `json:"id"`
+	} `json:"pit"`
+	Size        int       `json:"size"`
+	SearchAfter []float64 `json:"search_after"`
+	Slice       *struct {
+		Field string `json:"field"`
+		Id    int    `json:"id"`
+		Max   int    `json:"max"`
+	} `json:"slice"`
+	Query struct {
+		Bool struct {
+			Filter struct {
+				Range map[string]struct {
+					Gte float64 `json:"gte"`
+				} `json:"range"`
+			} `json:"filter"`
+			MustNot struct {
+				Bool struct {
+					Filter []struct {
+						Ids struct {
+							Values []string `json:"values"`
+						} `json:"ids"`
+					} `json:"filter"`
+				} `json:"bool"`
+			} `json:"must_not"`
+		} `json:"bool"`
+	} `json:"query"`
+}
+
+func (f *pitEs) add(docs ...testDoc) {
+	f.mu.Lock()
+	f.docs = append(f.docs, docs...)
+	f.mu.Unlock()
+}
+
+func (f *pitEs) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/_pit") && r.Method == http.MethodPost:
+		f.opens++
+		id := fmt.Sprintf("pit-%d", f.opens)
+		f.pits[id] = rand.New(rand.NewSource(int64(f.opens))).Perm(len(f.docs))
+		writeJson(w, 200, map[string]string{"id": id})
+	case strings.HasSuffix(r.URL.Path, "/_pit"):
+		writeJson(w, 200, map[string]bool{"succeeded": true})
+	case r.URL.Path == "/_search":
+		f.searches++
+		var b pitSearch
+		json.NewDecoder(r.Body).Decode(&b)
+		pos, ok := f.pits[b.Pit.Id]
+		if !ok {
+			writeJson(w, 404, map[string]string{"error": "search_context_missing_exception"})
+			return
+		}
+		gte, ranged := b.Query.Bool.Filter.Range["ts"]
+		skip := map[string]bool{}
+		for _, c := range b.Query.Bool.MustNot.Bool.Filter {
+			for _, id := range c.Ids.Values {
+				skip[id] = true
+			}
+		}
+		var hits []int
+		// point in time 只看得到打开时的文档
+		for i := range pos {
+			d := f.docs[i]
+			if ranged && (d.ts < gte.Gte || d.ts == gte.Gte && skip[d.id]) {
+				continue
+			}
+			if s := b.Slice; s != nil {
+				part := pos[i] % s.Max
+				if s.Field == "_id" {
+					part = int(crc32.ChecksumIEEE([]byte(d.id))) % s.Max
+				}
+				if part != s.Id {
+					continue
+				}
+			}
+			hits = append(hits, i)
+		}
+		sort.Slice(hits, func(a, b int) bool {
+			da, db := f.docs[hits[a]], f.docs[hits[b]]
+			if da.ts != db.ts {
+				return da.ts < db.ts
+			}
+			return pos[hits[a]] < pos[hits[b]]
+		})
+		out := []map[string]interface{}{}
+		for _, i := range hits {
+			d := f.docs[i]
+			if a := b.SearchAfter; a != nil && (d.ts < a[0] || d.ts == a[0] && float64(pos[i]) <= a[1]) {
+				continue
+			}
+			if len(out) == b.Size {
+				break
+			}
+			out = append(out, map[string]interface{}{
+				"_index":  "src",
+				"_id":     d.id,
+				"_source": map[string]interface{}{"ts": d.ts},
+				"sort":    []float64{d.ts, float64(pos[i])},
+			})
+		}
+		writeJson(w, 200, map[string]interface{}{"pit_id": b.Pit.Id, "hits": map[string]interface{}{"hits": out}})
+	default:
+		writeJson(w, 400, map[string]string{"error": r.Method + " " + r.URL.Path})
+	}
+}
+
+func newPitEs(t *testing.T, docs ...testDoc) (*pitEs, *EsSource) {
+	f := &pitEs{docs: docs, pits: map[string][]int{}}
+	es := newTestEs(t, f.handle)
+	return f, NewEsSource(es, "src", "ts")
+}
+
+// readAll 从 cp 一直读到没有新文档
+func readAll(t *testing.T, s *EsSource, cp Checkpoint, size int) ([]string, Checkpoint) {
+	t.Helper()
+	var ids []string
+	for i := 0; i < 100; i++ {
+		docs, next, err := s.Fetch(cp, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(docs) == 0 {
+			return ids, next
+		}
+		for _, d := range docs {
+			ids = append(ids, d.Id)
+		}
+		cp = next
+	}
+	t.Fatal("source never ran dry")
+	return nil, cp
+}
+
+func TestEsSourceTies(t *testing.T) {
+	var docs []testDoc
+	for i := 0; i < 10; i++ {
+		docs = append(docs, testDoc{fmt.Sprintf("a%d", i), 1})
+	}
+	f, s := newPitEs(t, docs...)
+	ids, cp := readAll(t, s, Checkpoint{}, 3)
+	if len(ids) != 10 || len(cp.Ids) != 10 {
+		t.Fatalf("read %v, checkpoint ids %v", ids, cp.Ids)
+	}
+	// 同一个值上新写入的文档在新的扫描里读到，已经读过的不再重读
+	f.add(testDoc{"b0", 1}, testDoc{"b1", 1}, testDoc{"c0", 2})
+	ids, cp = readAll(t, s, cp, 3)
+	sort.Strings(ids)
+	if strings.Join(ids, ",") != "b0,b1,c0" {
+		t.Fatalf("second scan read %v", ids)
+	}
+	if FieldString(cp.Value) != "2" || strings.Join(cp.Ids, ",") != "c0" {
+		t.Fatalf("checkpoint %v %v", cp.Value, cp.Ids)
+	}
+}
+
+func TestEsSourceIdHashSlices(t *testing.T) {
+	var docs []testDoc
+	for i := 0; i < 40; i++ {
+		docs = append(docs, testDoc{fmt.Sprintf("d%02d", i), float64(i / 4)})
+	}
+	f, s := newPitEs(t, docs...)
+	seen := map[string]int{}
+	for p := 0; p < 3; p++ {
+		src := NewEsPartitionSource(s.Client, "src", "ts", Partition{By: "id_hash", Id: p, Max: 3})
+		opens, searches := f.opens, f.searches
+		ids, _ := readAll(t, src, Checkpoint{}, 3)
+		for _, id := range ids {
+			seen[id]++
+			if want := int(crc32.ChecksumIEEE([]byte(id))) % 3; want != p {
+				t.Errorf("%s read by slice %d, its _id hash is in slice %d", id, p, want)
+			}
+		}
+		// 一次扫描只打开一个 point in time，最后确认没有新文档时再打开一个
+		if n := f.opens - opens; n > 2 || f.searches-searches < 4 {
+			t.Errorf("slice %d opened %d points in time for %d searches", p, n, f.searches-searches)
+		}
+	}
+	for _, d := range docs {
+		if seen[d.id] != 1 {
+			t.Errorf("%s read %d times", d.id, seen[d.id])
+		}
+	}
+}
+
+func TestNextCheckpoint(t *testing.T) {
+	doc := func(id string, ts interface{}) Doc {
+		return Doc{Id: id, Source: map[string]interface{}{"ts": ts}}
+	}
+	tests := []struct {
+		name  string
+		cp    Checkpoint
+		docs  []Doc
+		value string
+		ids   string
+	}{
+		{"new value", Checkpoint{Value: 1, Ids: []string{"a"}}, []Doc{doc("b", 1), doc("c", 2)}, "2", "c"},
+		{"same value", Checkpoint{Value: 1, Ids: []string{"a"}}, []Doc{doc("b", 1), doc("c", 1)}, "1", "a,b,c"},
+		{"ties at the end", Checkpoint{}, []Doc{doc("a", 1), doc("b", 2), doc("c", 2)}, "2", "b,c"},
+		{"no sort field", Checkpoint{Value: 1, Ids: []string{"a"}}, []Doc{{Id: "b", Source: map[string]interface{}{}}}, "1", "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := NextCheckpoint(tt.cp, tt.docs, "ts")
+			if FieldString(next.Value) != tt.value || strings.Join(next.Ids, ",") != tt.ids {
+				t.Fatalf("got %v %v, want %s %s", next.Value, next.Ids, tt.value, tt.ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"essync/conf"
+	"fmt"
+)
+
+// Transform 对单条文档做修改，返回 false 表示丢弃该文档
+type Transform interface {
+	Apply(doc *Doc) (bool, error)
+}
+
+type renameTransform struct {
+	field string
+	to    string
+}
+
+func (t renameTransform) Apply(doc *Doc) (bool, error) {
+	if v, ok := GetField(doc.Source, t.field); ok {
+		DeleteField(doc.Source, t.field)
+		SetField(doc.Source, t.to, v)
+	}
+	return true, nil
+}
+
+type removeTransform struct {
+	field string
+}
+
+func (t removeTransform) Apply(doc *Doc) (bool, error) {
+	DeleteField(doc.Source, t.field)
+	return true, nil
+}
+
+type setTransform struct {
+	field string
+	value interface{}
+}
+
+func (t setTransform) Apply(doc *Doc) (bool, error) {
+	SetField(doc.Source, t.field, t.value)
+	return true, nil
+}
+
+// NewTransforms builds the transform chain from config, in order.
+func NewTransforms(cfg []conf.Transform) ([]Transform, error) {
+	transforms := make([]Transform, 0, len(cfg))
+	for i, c := range cfg {
+		if c.Field == "" && c.Type != "script" {
+			return nil, fmt.Errorf("transforms[%d]: field is required", i)
+		}
+		switch c.Type {
+		case "rename":
+			if c.To == "" {
+				return nil, fmt.Errorf("transforms[%d]: rename needs to", i)
+			}
+			transforms = append(transforms, renameTransform{field: c.Field, to: c.To})
+		case "remove":
+			transforms = append(transforms, removeTransform{field: c.Field})
+		case "set":
+			transforms = append(transforms, setTransform{field: c.Field, value: yamlToJson(c.Value)})
+		case "parse_json":
+			transforms = append(transforms, newParseJsonTransform(c))
+		case "script":
+			t, err := newScriptTransform(c, i)
+			if err != nil {
+				return nil, fmt.Errorf("transforms[%d]: %v", i, err)
+			}
+			transforms = append(transforms, t)
+		case "redact":
+			t, err := newRedactTransform(c)
+			if err != nil {
+				return nil, fmt.Errorf("transforms[%d]: %v", i, err)
+			}
+			transforms = append(transforms, t)
+		default:
+			return nil, fmt.Errorf("transforms[%d]: unknown type %q", i, c.Type)
+		}
+	}
+	return transforms, nil
+}
+
+// ApplyTransforms runs the chain over docs and returns the kept documents.
+// A document whose transform fails is skipped and returned alongside in a DocError, as it was when the transform failed.
+func ApplyTransforms(transforms []Transform, docs []Doc) ([]Doc, []error) {
+	if len(transforms) == 0 {
+		return docs, nil
+	}
+	kept := docs[:0]
+	var errs []error
+	for _, doc := range docs {
+		keep := true
+		for _, t := range transforms {
+			ok, err := t.Apply(&doc)
+			if err != nil {
+				failed := doc
+				errs = append(errs, DocError{Id: doc.Id, Err: err.Error(), Doc: &failed})
+				keep = false
+				break
+			}
+			if !ok {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			kept = append(kept, doc)
+		}
+	}
+	return kept, errs
+}
+
+// yamlToJson 把 yaml 解析出的 map[interface{}]interface{} 转成可以 json 编码的结构
+func yamlToJson(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[fmt.Sprint(k)] = yamlToJson(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range t {
+			t[i] = yamlToJson(val)
+		}
+		return t
+	default:
+		return v
+	}
+}
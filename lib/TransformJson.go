@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"essync/conf"
+	"fmt"
+)
+
+// parseJsonTransform 把存成字符串的 json 字段解析成对象，如调用日志的 parameter、result。
+// 解析失败、超过大小或层数限制时保留原字符串，并把字段名记到 failureField 里
+type parseJsonTransform struct {
+	field        string
+	to           string
+	maxDepth     int
+	maxBytes     int
+	flatten      bool
+	failureField string
+}
+
+func newParseJsonTransform(c conf.Transform) parseJsonTransform {
+	t := parseJsonTransform{
+		field:        c.Field,
+		to:           c.To,
+		maxDepth:     c.MaxDepth,
+		maxBytes:     c.MaxBytes,
+		flatten:      c.Flatten,
+		failureField: c.FailureField,
+	}
+	if t.to == "" {
+		t.to = t.field
+	}
+	if t.maxDepth <= 0 {
+		t.maxDepth = 20
+	}
+	if t.maxBytes <= 0 {
+		t.maxBytes = 1024 * 1024
+	}
+	if t.failureField == "" {
+		t.failureField = "json_parse_failed"
+	}
+	return t
+}
+
+func (t parseJsonTransform) Apply(doc *Doc) (bool, error) {
+	v, ok := GetField(doc.Source, t.field)
+	if !ok {
+		return true, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		// 已经是对象或不是字符串，不处理
+		return true, nil
+	}
+	parsed, err := t.parse(s)
+	if err != nil {
+		MetricAdd("essync_transform_json_failures_total", map[string]string{"field": t.field}, 1)
+		t.flag(doc)
+		return true, nil
+	}
+	if parsed == nil {
+		return true, nil
+	}
+	SetField(doc.Source, t.to, parsed)
+	return true, nil
+}
+
+// parse 只接受对象和数组，其他 json 值(数字、字符串等)返回 nil 保持原样
+func (t parseJsonTransform) parse(s string) (interface{}, error) {
+	if len(s) > t.maxBytes {
+		return nil, fmt.Errorf("%d bytes over max_bytes %d", len(s), t.maxBytes)
+	}
+	b := bytes.TrimSpace([]byte(s))
+	if len(b) == 0 || (b[0] != '{' && b[0] != '[') {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("trailing data after json value")
+	}
+	if jsonDepth(v) > t.maxDepth {
+		return nil, fmt.Errorf("nested deeper than max_depth %d", t.maxDepth)
+	}
+	if m, ok := v.(map[string]interface{}); ok && t.flatten {
+		flat := map[string]interface{}{}
+		flattenInto(flat, "", m)
+		return flat, nil
+	}
+	return v, nil
+}
+
+// flag 把解析失败的字段名追加到 failureField 列表
+func (t parseJsonTransform) flag(doc *Doc) {
+	failed, _ := GetField(doc.Source, t.failureField)
+	list, _ := failed.([]interface{})
+	for _, f := range list {
+		if f == t.field {
+			return
+		}
+	}
+	SetField(doc.Source, t.failureField, append(list, t.field))
+}
+
+func jsonDepth(v interface{}) int {
+	depth := 0
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for _, child := range t {
+			if d := jsonDepth(child); d > depth {
+				depth = d
+			}
+		}
+		return depth + 1
+	case []interface{}:
+		for _, child := range t {
+			if d := jsonDepth(child); d > depth {
+				depth = d
+			}
+		}
+		return depth + 1
+	}
+	return 0
+}
+
+// flattenInto 把嵌套对象展开成 a.b.c 形式的键，数组保持原样
+func flattenInto(out map[string]interface{}, prefix string, m map[string]interface{}) {
+	for k, v := range m {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if child, ok := v.(map[string]interface{}); ok && len(child) > 0 {
+			flattenInto(out, key, child)
+			continue
+		}
+		out[key] = v
+	}
+}
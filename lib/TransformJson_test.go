@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"encoding/json"
+	"essync/conf"
+	"testing"
+)
+
+func TestJsonDepth(t *testing.T) {
+	tests := []struct {
+		json  string
+		depth int
+	}{
+		{`1`, 0},
+		{`"s"`, 0},
+		{`{}`, 1},
+		{`[]`, 1},
+		{`{"a": 1}`, 1},
+		{`{"a": {"b": [1, {"c": 2}]}}`, 4},
+		{`[[[]], {"a": 1}]`, 3},
+	}
+	for _, tt := range tests {
+		var v interface{}
+		if err := json.Unmarshal([]byte(tt.json), &v); err != nil {
+			t.Fatal(err)
+		}
+		if got := jsonDepth(v); got != tt.depth {
+			t.Errorf("jsonDepth(%s) = %d, want %d", tt.json, got, tt.depth)
+		}
+	}
+}
+
+func TestFlattenInto(t *testing.T) {
+	var m map[string]interface{}
+	json.Unmarshal([]byte(`{"a": {"b": {"c": 1}, "d": [{"e": 2}]}, "f": {}, "g": "x"}`), &m)
+	out := map[string]interface{}{}
+	flattenInto(out, "", m)
+	got, _ := json.Marshal(out)
+	// 数组和空对象保持原样
+	if want := `{"a.b.c":1,"a.d":[{"e":2}],"f":{},"g":"x"}`; string(got) != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestParseJsonTransform(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  conf.Transform
+		doc  string
+		want string
+	}{
+		{"object", conf.Transform{Field: "p"}, `{"p": "{\"a\": {\"b\": 1}}"}`, `{"p":{"a":{"b":1}}}`},
+		{"to", conf.Transform{Field: "p", To: "q"}, `{"p": "[1, 2]"}`, `{"p":"[1, 2]","q":[1,2]}`},
+		{"flatten", conf.Transform{Field: "p", Flatten: true}, `{"p": "{\"a\": {\"b\": 1}}"}`, `{"p":{"a.b":1}}`},
+		{"scalar kept", conf.Transform{Field: "p"}, `{"p": "12"}`, `{"p":"12"}`},
+		{"not a string", conf.Transform{Field: "p"}, `{"p": {"a": 1}}`, `{"p":{"a":1}}`},
+		{"invalid", conf.Transform{Field: "p"}, `{"p": "{bad"}`, `{"json_parse_failed":["p"],"p":"{bad"}`},
+		{"trailing data", conf.Transform{Field: "p"}, `{"p": "{} {}"}`, `{"json_parse_failed":["p"],"p":"{} {}"}`},
+		{"too deep", conf.Transform{Field: "p", MaxDepth: 2}, `{"p": "{\"a\": {\"b\": {}}}"}`,
+			`{"json_parse_failed":["p"],"p":"{\"a\": {\"b\": {}}}"}`},
+		{"too big", conf.Transform{Field: "p", MaxBytes: 4, FailureField: "bad"}, `{"p": "{\"a\": 1}"}`, `{"bad":["p"],"p":"{\"a\": 1}"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := DecodeSource([]byte(tt.doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc := Doc{Source: source}
+			if keep, err := newParseJsonTransform(tt.cfg).Apply(&doc); !keep || err != nil {
+				t.Fatalf("keep %v, %v", keep, err)
+			}
+			if got, _ := json.Marshal(doc.Source); string(got) != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
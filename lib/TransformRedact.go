@@ -0,0 +1,199 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"essync/conf"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// redactTransform 脱敏字段：drop 删除、constant 替换成固定值、hmac 用密钥做 HMAC-SHA256、
+// regex 把匹配的部分替换掉、partial 只保留首尾几个字符。
+// 路径经过 json 字符串(如 parameter.phone)时先解析，脱敏后再写回字符串；经过数组时处理每个元素
+type redactTransform struct {
+	field       string
+	method      string
+	value       interface{}
+	key         []byte
+	pattern     *regexp.Regexp
+	replacement string
+	keepStart   int
+	keepEnd     int
+	maskChar    string
+}
+
+func newRedactTransform(c conf.Transform) (*redactTransform, error) {
+	t := &redactTransform{
+		field:       c.Field,
+		method:      c.Method,
+		value:       yamlToJson(c.Value),
+		replacement: c.Replacement,
+		keepStart:   c.KeepStart,
+		keepEnd:     c.KeepEnd,
+		maskChar:    c.MaskChar,
+	}
+	switch c.Method {
+	case "drop", "constant":
+	case "hmac":
+		// 密钥放在单独的文件里，同一个值每次得到同样的结果，可以跨索引关联
+		if c.KeyFile == "" {
+			return nil, errors.New("redact hmac needs key_file")
+		}
+		key, err := ioutil.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.key = bytes.TrimRight(key, "\r\n")
+		if len(t.key) == 0 {
+			return nil, errors.New("redact hmac: key_file " + c.KeyFile + " is empty")
+		}
+	case "regex":
+		if c.Pattern == "" {
+			return nil, errors.New("redact regex needs pattern")
+		}
+		re, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		t.pattern = re
+		if t.replacement == "" {
+			t.replacement = "***"
+		}
+	case "partial":
+		if t.keepStart < 0 || t.keepEnd < 0 {
+			return nil, errors.New("redact partial: keep_start and keep_end must not be negative")
+		}
+		if t.maskChar == "" {
+			t.maskChar = "*"
+		}
+	default:
+		return nil, errors.New("redact: unknown method " + c.Method)
+	}
+	return t, nil
+}
+
+func (t *redactTransform) Apply(doc *Doc) (bool, error) {
+	updateField(doc.Source, t.field, func(v interface{}) (interface{}, bool) {
+		if t.method == "drop" {
+			return nil, false
+		}
+		return t.redact(v), true
+	})
+	return true, nil
+}
+
+func (t *redactTransform) redact(v interface{}) interface{} {
+	if list, ok := v.([]interface{}); ok {
+		out := make([]interface{}, len(list))
+		for i, item := range list {
+			out[i] = t.redact(item)
+		}
+		return out
+	}
+	if v == nil {
+		return nil
+	}
+	switch t.method {
+	case "constant":
+		return t.value
+	case "hmac":
+		mac := hmac.New(sha256.New, t.key)
+		mac.Write([]byte(FieldString(v)))
+		return hex.EncodeToString(mac.Sum(nil))
+	case "regex":
+		// 数字、对象等按文本匹配，没有匹配时保持原来的类型
+		s := FieldString(v)
+		if !t.pattern.MatchString(s) {
+			return v
+		}
+		return t.pattern.ReplaceAllString(s, t.replacement)
+	case "partial":
+		return partialMask(FieldString(v), t.keepStart, t.keepEnd, t.maskChar)
+	}
+	return v
+}
+
+// partialMask 保留前 keepStart 和后 keepEnd 个字符，中间替换成 mask，如 138****5678
+func partialMask(s string, keepStart int, keepEnd int, mask string) string {
+	if keepStart < 0 {
+		keepStart = 0
+	}
+	if keepEnd < 0 {
+		keepEnd = 0
+	}
+	n := utf8.RuneCountInString(s)
+	if keepStart+keepEnd >= n {
+		// 太短时全部遮住，避免原样泄露
+		return strings.Repeat(mask, n)
+	}
+	runes := []rune(s)
+	return string(runes[:keepStart]) + strings.Repeat(mask, n-keepStart-keepEnd) + string(runes[n-keepEnd:])
+}
+
+// updateField 按路径找到字段交给 fn 修改，fn 返回 false 时删除字段；
+// 先匹配完整字段名，再按 . 逐级查找，中间经过 json 字符串和数组时继续往里找
+func updateField(doc map[string]interface{}, path string, fn func(v interface{}) (interface{}, bool)) bool {
+	if v, ok := doc[path]; ok {
+		if nv, keep := fn(v); keep {
+			doc[path] = nv
+		} else {
+			delete(doc, path)
+		}
+		return true
+	}
+	idx := strings.IndexByte(path, '.')
+	for idx > 0 {
+		if child, ok := doc[path[:idx]]; ok {
+			if updateValue(&child, path[idx+1:], fn) {
+				doc[path[:idx]] = child
+				return true
+			}
+		}
+		next := strings.IndexByte(path[idx+1:], '.')
+		if next < 0 {
+			break
+		}
+		idx += next + 1
+	}
+	return false
+}
+
+func updateValue(v *interface{}, rest string, fn func(v interface{}) (interface{}, bool)) bool {
+	switch t := (*v).(type) {
+	case map[string]interface{}:
+		return updateField(t, rest, fn)
+	case []interface{}:
+		found := false
+		for i := range t {
+			if updateValue(&t[i], rest, fn) {
+				found = true
+			}
+		}
+		return found
+	case string:
+		s := strings.TrimSpace(t)
+		if !strings.HasPrefix(s, "{") {
+			return false
+		}
+		parsed, err := DecodeSource([]byte(s))
+		if err != nil || !updateField(parsed, rest, fn) {
+			return false
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(parsed); err != nil {
+			return false
+		}
+		*v = strings.TrimRight(buf.String(), "\n")
+		return true
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"essync/conf"
+	"strings"
+	"testing"
+)
+
+func TestPartialMask(t *testing.T) {
+	tests := []struct {
+		s         string
+		keepStart int
+		keepEnd   int
+		want      string
+	}{
+		{"13812345678", 3, 4, "138****5678"},
+		{"13812345678", 0, 4, "*******5678"},
+		{"13812345678", 3, 0, "138********"},
+		{"张三丰", 1, 0, "张**"},
+		{"abc", 2, 2, "***"},
+		{"abcd", 2, 2, "****"},
+		{"", 1, 1, ""},
+		{"abcdef", -2, 2, "****ef"},
+		{"abcdef", 2, -1, "ab****"},
+	}
+	for _, tt := range tests {
+		if got := partialMask(tt.s, tt.keepStart, tt.keepEnd, "*"); got != tt.want {
+			t.Errorf("partialMask(%q, %d, %d) = %q, want %q", tt.s, tt.keepStart, tt.keepEnd, got, tt.want)
+		}
+	}
+	for _, c := range []conf.Transform{
+		{Type: "redact", Field: "phone", Method: "partial", KeepStart: -1},
+		{Type: "redact", Field: "phone", Method: "partial", KeepEnd: -1},
+	} {
+		if _, err := newRedactTransform(c); err == nil {
+			t.Errorf("negative keep accepted: %+v", c)
+		}
+	}
+}
+
+func TestUpdateField(t *testing.T) {
+	mask := func(v interface{}) (interface{}, bool) { return "x", true }
+	drop := func(v interface{}) (interface{}, bool) { return nil, false }
+	tests := []struct {
+		name  string
+		doc   string
+		path  string
+		fn    func(v interface{}) (interface{}, bool)
+		found bool
+		want  string
+	}{
+		{"top level", `{"phone": "1"}`, "phone", mask, true, `{"phone":"x"}`},
+		{"dotted name first", `{"a.b": "1", "a": {"b": "2"}}`, "a.b", mask, true, `{"a":{"b":"2"},"a.b":"x"}`},
+		{"nested", `{"a": {"b": {"c": "1"}}}`, "a.b.c", mask, true, `{"a":{"b":{"c":"x"}}}`},
+		{"array", `{"a": [{"b": "1"}, {"c": "2"}, {"b": "3"}]}`, "a.b", mask, true, `{"a":[{"b":"x"},{"c":"2"},{"b":"x"}]}`},
+		{"json string", `{"parameter": "{\"phone\": \"1\", \"url\": \"a&b\"}"}`, "parameter.phone", mask, true,
+			`{"parameter":"{\"phone\":\"x\",\"url\":\"a&b\"}"}`},
+		{"drop", `{"a": {"b": "1", "c": "2"}}`, "a.b", drop, true, `{"a":{"c":"2"}}`},
+		{"missing", `{"a": {"c": "1"}}`, "a.b", mask, false, `{"a":{"c":"1"}}`},
+		{"plain string", `{"a": "b=1"}`, "a.b", mask, false, `{"a":"b=1"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := DecodeSource([]byte(tt.doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := updateField(doc, tt.path, tt.fn)
+			var out bytes.Buffer
+			enc := json.NewEncoder(&out)
+			enc.SetEscapeHTML(false)
+			enc.Encode(doc)
+			if found != tt.found || strings.TrimSpace(out.String()) != tt.want {
+				t.Fatalf("got %v %s, want %v %s", found, out.String(), tt.found, tt.want)
+			}
+		})
+	}
+}
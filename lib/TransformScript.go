@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"essync/conf"
+	"fmt"
+	"github.com/dop251/goja"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// scriptTransform 用内嵌的 JavaScript 解释器处理文档，脚本里定义 function process(doc, meta)：
+// doc 是 _source，可以直接修改；meta 有 id、index、target_index，改 id 换文档 id，改 target_index 写到别的索引；
+// 返回 false 丢弃文档，返回对象时用它替换 _source。
+// 解释器不能访问文件和网络，每条文档的执行时间超过 timeout 毫秒会被中断
+type scriptTransform struct {
+	name    string
+	timeout time.Duration
+	mu      sync.Mutex
+	vm      *goja.Runtime
+	process goja.Callable
+	parse   goja.Callable
+	// imu 保护 gen：每次执行一个新的 gen，超时回调只中断自己那一次
+	imu sync.Mutex
+	gen int64
+}
+
+func newScriptTransform(c conf.Transform, i int) (*scriptTransform, error) {
+	src := c.Script
+	if c.ScriptFile != "" {
+		data, err := ioutil.ReadFile(c.ScriptFile)
+		if err != nil {
+			return nil, err
+		}
+		src = string(data)
+	}
+	if src == "" {
+		return nil, errors.New("script needs script or script_file")
+	}
+	t := &scriptTransform{name: c.Name, timeout: time.Duration(c.Timeout) * time.Millisecond, vm: goja.New()}
+	if t.name == "" {
+		t.name = fmt.Sprintf("script%d", i)
+	}
+	if t.timeout <= 0 {
+		t.timeout = 100 * time.Millisecond
+	}
+	// 加载脚本本身也受超时限制，防止顶层死循环卡住启动
+	stop := t.interruptAfter(t.timeout*10, "load timeout")
+	_, err := t.vm.RunScript(t.name, src)
+	stop()
+	if err != nil {
+		return nil, err
+	}
+	process, ok := goja.AssertFunction(t.vm.Get("process"))
+	if !ok {
+		return nil, errors.New("script must define function process(doc, meta)")
+	}
+	t.process = process
+	t.parse, _ = goja.AssertFunction(t.vm.Get("JSON").ToObject(t.vm).Get("parse"))
+	return t, nil
+}
+
+func (t *scriptTransform) Apply(doc *Doc) (bool, error) {
+	// goja 的运行时不能并发使用，多个来源共用目标时串行执行
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	labels := map[string]string{"script": t.name}
+	MetricAdd("essync_script_runs_total", labels, 1)
+	fail := func(err error) (bool, error) {
+		MetricAdd("essync_script_errors_total", labels, 1)
+		return false, fmt.Errorf("script %s: %v", t.name, err)
+	}
+	// 文档以 JSON.parse 的结果交给脚本，数组、对象都是原生的 JavaScript 值；超过 2^53 的整数会丢精度
+	raw, err := json.Marshal(doc.Source)
+	if err != nil {
+		return fail(err)
+	}
+	source, err := t.parse(goja.Undefined(), t.vm.ToValue(string(raw)))
+	if err != nil {
+		return fail(err)
+	}
+	meta := t.vm.NewObject()
+	meta.Set("id", doc.Id)
+	meta.Set("index", doc.Index)
+	meta.Set("target_index", doc.TargetIndex)
+	stop := t.interruptAfter(t.timeout, "timeout")
+	res, err := t.process(goja.Undefined(), source, meta)
+	stop()
+	if err != nil {
+		return fail(err)
+	}
+	if res != nil && res.ExportType() != nil {
+		switch v := res.Export().(type) {
+		case bool:
+			if !v {
+				MetricAdd("essync_script_dropped_total", labels, 1)
+				return false, nil
+			}
+		case map[string]interface{}:
+			source = res
+		}
+	}
+	out, ok := source.Export().(map[string]interface{})
+	if !ok {
+		return fail(errors.New("doc is not an object"))
+	}
+	doc.Source = out
+	doc.Id = scriptString(meta.Get("id"))
+	doc.TargetIndex = scriptString(meta.Get("target_index"))
+	return true, nil
+}
+
+// afterFunc 测试里换掉它来控制超时回调触发的时机
+var afterFunc = time.AfterFunc
+
+// interruptAfter 超过 d 还在执行时中断脚本。stop 之后才触发的回调不再中断，
+// 已经设置的中断也清掉，不会落到下一条文档上
+func (t *scriptTransform) interruptAfter(d time.Duration, reason string) (stop func()) {
+	t.imu.Lock()
+	t.gen++
+	gen := t.gen
+	t.imu.Unlock()
+	timer := afterFunc(d, func() {
+		t.imu.Lock()
+		defer t.imu.Unlock()
+		if t.gen == gen {
+			t.vm.Interrupt(reason)
+		}
+	})
+	return func() {
+		timer.Stop()
+		t.imu.Lock()
+		t.gen++
+		t.imu.Unlock()
+		t.vm.ClearInterrupt()
+	}
+}
+
+func scriptString(v goja.Value) string {
+	if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+		return ""
+	}
+	return v.String()
+}
@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"essync/conf"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScriptTransformTimeout(t *testing.T) {
+	tr, err := newScriptTransform(conf.Transform{Timeout: 20, Script: `
+function process(doc, meta) {
+  if (doc.loop) { for (;;) {} }
+  doc.seen = true;
+}`}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.Apply(&Doc{Id: "a", Source: map[string]interface{}{"loop": true}})
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("endless loop: %v", err)
+	}
+	doc := &Doc{Id: "b", Source: map[string]interface{}{}}
+	if ok, err := tr.Apply(doc); !ok || err != nil || doc.Source["seen"] != true {
+		t.Fatalf("doc after a timeout: %v %v %v", ok, err, doc.Source)
+	}
+}
+
+// 超时回调在 stop 之后才执行(Stop 返回时回调已经开始)也不能中断下一条文档
+func TestScriptTransformStaleInterrupt(t *testing.T) {
+	tr, err := newScriptTransform(conf.Transform{Script: `function process(doc, meta) { doc.seen = true; }`}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fire func()
+	afterFunc = func(d time.Duration, f func()) *time.Timer {
+		fire = f
+		return time.NewTimer(time.Hour)
+	}
+	defer func() { afterFunc = time.AfterFunc }()
+	stop := tr.interruptAfter(time.Millisecond, "stale")
+	stop()
+	fire()
+	if _, err := tr.Apply(&Doc{Id: "a", Source: map[string]interface{}{}}); err != nil {
+		t.Fatalf("doc after a late timeout callback: %v", err)
+	}
+	// 执行中触发的回调照样中断
+	stop = tr.interruptAfter(time.Millisecond, "timeout")
+	fire()
+	_, err = tr.vm.RunString(`for (;;) {}`)
+	stop()
+	if err == nil {
+		t.Fatal("interrupt while running was lost")
+	}
+}
@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+)
+
+// failTransform 对指定 _id 的文档报错
+type failTransform struct {
+	id string
+}
+
+func (t failTransform) Apply(doc *Doc) (bool, error) {
+	if doc.Id == t.id {
+		return false, errors.New("boom")
+	}
+	return true, nil
+}
+
+func TestApplyTransformsFailedDoc(t *testing.T) {
+	docs := []Doc{
+		{Id: "a", Source: map[string]interface{}{}},
+		{Id: "b", Source: map[string]interface{}{}},
+		{Id: "c", Source: map[string]interface{}{}},
+	}
+	chain := []Transform{setTransform{field: "seen", value: true}, failTransform{id: "b"}}
+	kept, errs := ApplyTransforms(chain, docs)
+	if len(kept) != 2 || kept[0].Id != "a" || kept[1].Id != "c" {
+		t.Fatalf("kept %v", kept)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("errors %v", errs)
+	}
+	e, ok := errs[0].(DocError)
+	if !ok || e.Id != "b" || e.Err != "boom" || e.Doc == nil || e.Doc.Id != "b" {
+		t.Fatalf("error %#v", errs[0])
+	}
+	// 死信里是出错时的文档，前面的转换已经执行
+	if v, _ := GetField(e.Doc.Source, "seen"); v != true {
+		t.Fatalf("failed doc source %v", e.Doc.Source)
+	}
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"essync/conf"
 	"essync/lib"
+	"fmt"
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/gin-gonic/gin"
 	"github.com/phachon/go-logger"
-	"gopkg.in/yaml.v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"io/ioutil"
 	"log"
@@ -16,59 +21,86 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 )
 
 var yaml_conf = conf.EsConfig{}
-var logger = go_logger.NewLogger()
+
+// logOutput 是所有结构化日志共用的 go-logger 输出，各组件通过 lib.Logger 写日志
+var logOutput = go_logger.NewLogger()
+
+var (
+	logger       = lib.NewLogger("main")
+	syncLog      = lib.NewLogger("sync")
+	retentionLog = lib.NewLogger("retention")
+	apiLog       = lib.NewLogger("api")
+	alertLog     = lib.NewLogger("alert")
+)
 
 func main() {
 	if len(os.Args) < 2 {
 		log.Fatalf("Cli param config file is missing !")
 	}
-	configFile := os.Args[1]
-	yamlFile, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		log.Fatalf(err.Error())
-	}
-	err = yaml.Unmarshal(yamlFile, &yaml_conf)
-	if err != nil {
-		log.Fatalf(err.Error())
+	switch os.Args[1] {
+	case "import":
+		runImport(os.Args[2:])
+		return
+	case "export":
+		runExport(os.Args[2:])
+		return
+	case "passwd":
+		runPasswd()
+		return
 	}
+	loadConfig(os.Args[1])
+	initLogger()
 	r := gin.New()
 	r.Use(gin.Recovery())
 
-	logger.Detach("console")
-	consoleConfig := &go_logger.ConsoleConfig{
-		Color:      true,                                           // Does the text display the color
-		JsonFormat: false,                                          // Whether or not formatted into a JSON string
-		Format:     "%millisecond_format% [%level_string%] %body%", // JsonFormat is false, logger message output to console format string
+	if err := initElection(); err != nil {
+		fatal("init leader election", "err", err)
 	}
-	logger.Attach("console", go_logger.LOGGER_LEVEL_DEBUG, consoleConfig)
-
-	fileConfig := &go_logger.FileConfig{
-		//Filename: yaml_conf.LogDir + "essync.log", // The file name of the logger output, does not exist automatically
-		// If you want to separate separate logs into files, configure LevelFileName parameters.
-		LevelFileName: map[int]string{
-			logger.LoggerLevel("error"): yaml_conf.LogDir + "essync_error.log", // The error level log is written to the error.log file.
-			logger.LoggerLevel("info"):  yaml_conf.LogDir + "essync_info.log",  // The info level log is written to the info.log file.
-			logger.LoggerLevel("debug"): yaml_conf.LogDir + "essync_debug.log", // The debug level log is written to the debug.log file.
-		},
-		MaxSize:    1000 * 1024 * 1024,                             // File maximum (KB), default 0 is not limited
-		MaxLine:    0,                                              // The maximum number of lines in the file, the default 0 is not limited
-		DateSlice:  "d",                                            // Cut the document by date, support "Y" (year), "m" (month), "d" (day), "H" (hour), default "no".
-		JsonFormat: false,                                          // Whether the file data is written to JSON formatting
-		Format:     "%millisecond_format% [%level_string%] %body%", // JsonFormat is false, logger message written to file format string
+	if err := initSharding(); err != nil {
+		fatal("init sharding", "err", err)
+	}
+	if err := initJobs(); err != nil {
+		fatal("init jobs", "err", err)
+	}
+	if err := initAlerts(); err != nil {
+		fatal("init alerts", "err", err)
+	}
+	if err := initEvents(); err != nil {
+		fatal("init audit index", "err", err)
+	}
+	if err := initTracing(); err != nil {
+		fatal("init tracing", "err", err)
+	}
+	for _, job := range jobs {
+		for _, in := range job.inputs {
+			go getData(job, in)
+		}
+		for _, o := range job.outputs {
+			go clearData(job, o)
+		}
 	}
-	logger.Attach("file", go_logger.LOGGER_LEVEL_DEBUG, fileConfig)
-
-	go getData()
-	go clearData()
 	go SavePid()
+	go recordHistory()
+	if len(alerts.rules) > 0 {
+		go alerts.run()
+	}
+	if events != nil {
+		go events.run()
+	}
+	if election != nil {
+		go election.run()
+	}
+	if sharding != nil {
+		go sharding.run()
+	}
 
 	r.GET("/_healthy", func(c *gin.Context) {
 		c.String(200, "I am very healthy")
@@ -77,8 +109,10 @@ func main() {
 		var errorNew int
 		errorLogFile := yaml_conf.LogDir + "essync_error.log"
 		errorNew = getLogNew(errorLogFile)
-		c.String(200, "essync_error_new{} "+strconv.Itoa(errorNew))
+		c.String(200, "essync_error_new{} "+strconv.Itoa(errorNew)+"\n"+lib.MetricsText())
 	})
+	registerHealthApi(r)
+	startAdminApi(r)
 	httpPort := strconv.Itoa(yaml_conf.HttpPort)
 	httpAddress := ":" + httpPort
 	server := &http.Server{
@@ -87,116 +121,342 @@ func main() {
 	}
 	go func() {
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Error("listen httpPort error: " + httpPort)
-			log.Fatalf("listen: %s\n error: ", err)
+			fatal("listen http_port", "port", httpPort, "err", err)
 		}
 	}()
-	logger.Info("Server Start ...")
+	logger.Info("Server Start ...", "http_port", httpPort, "jobs", len(jobs))
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, os.Kill, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
+	for _, job := range jobs {
+		for _, in := range job.inputs {
+			if err := in.source.Close(); err != nil {
+				syncLog.Error("Source.Close", "job", job.cfg.Name, "source", in.key, "err", err)
+			}
+		}
+		for _, o := range job.outputs {
+			if err := o.sink.Close(); err != nil {
+				syncLog.Error("Sink.Close", "job", job.cfg.Name, "target", o.key, "err", err)
+			}
+		}
+	}
+	election.release()
+	sharding.release()
+	events.close()
+	shutdownTracing()
 	logger.Info("Server Shutdown ...")
 }
 
-func getData() {
-	sourceField := yaml_conf.SortField
-	syncCount := yaml_conf.SyncCount
+// startAdminApi 管理接口挂到 http_port，或者配置了 admin.address 时单独监听
+func startAdminApi(r *gin.Engine) {
+	cfg := yaml_conf.Admin
+	auth, err := newAdminAuth(cfg)
+	if err != nil {
+		fatal("admin api", "err", err)
+	}
+	tlsConfig, err := adminTlsConfig(cfg)
+	if err != nil {
+		fatal("admin api", "err", err)
+	}
+	if tlsConfig != nil && cfg.Address == "" {
+		fatal("admin.tls needs admin.address")
+	}
+	if !auth.enabled() {
+		apiLog.Warn("admin api: no authentication configured")
+	}
+	initAuditLogger(cfg)
+	if cfg.Address == "" {
+		registerJobApi(r, auth.middleware())
+		return
+	}
+	admin := gin.New()
+	admin.Use(gin.Recovery())
+	registerJobApi(admin, auth.middleware())
+	server := &http.Server{
+		Addr:      cfg.Address,
+		Handler:   admin,
+		TLSConfig: tlsConfig,
+	}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("listen admin address", "address", cfg.Address, "err", err)
+		}
+	}()
+}
+
+func loadConfig(configFile string) {
+	yamlFile, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	yaml_conf, err = conf.LoadConfig(yamlFile)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+}
+
+// initLogger 按 log 配置设置日志格式、级别和输出；text 格式保持原来的 "时间 [级别] 消息" 行，
+// json 和 logfmt 的时间、级别在行内
+func initLogger() {
+	cfg := yaml_conf.Log
+	format := "%millisecond_format% [%level_string%] %body%"
+	if cfg.Format == "json" || cfg.Format == "logfmt" {
+		format = "%body%"
+	}
+	logOutput.Detach("console")
+	if cfg.Console == nil || *cfg.Console {
+		consoleConfig := &go_logger.ConsoleConfig{
+			Color:  cfg.Format == "" || cfg.Format == "text",
+			Format: format,
+		}
+		logOutput.Attach("console", go_logger.LOGGER_LEVEL_DEBUG, consoleConfig)
+	}
+	fileConfig := logFileConfig()
+	// 每个级别一个文件，/exporter 统计 essync_error.log 的新增行数
+	fileConfig.LevelFileName = map[int]string{
+		logOutput.LoggerLevel("error"):   yaml_conf.LogDir + "essync_error.log",
+		logOutput.LoggerLevel("warning"): yaml_conf.LogDir + "essync_warn.log",
+		logOutput.LoggerLevel("info"):    yaml_conf.LogDir + "essync_info.log",
+		logOutput.LoggerLevel("debug"):   yaml_conf.LogDir + "essync_debug.log",
+	}
+	fileConfig.Format = format
+	if err := logOutput.Attach("file", go_logger.LOGGER_LEVEL_DEBUG, fileConfig); err != nil {
+		log.Fatalf("log file: " + err.Error())
+	}
+	if err := lib.SetLogOutput(logOutput, cfg.Format, cfg.Level, cfg.Levels); err != nil {
+		log.Fatalf("log: " + err.Error())
+	}
+}
+
+// logFileConfig 按 log 配置切分日志文件：max_size 单位 MB，默认 1000；date_slice 默认按天
+func logFileConfig() *go_logger.FileConfig {
+	cfg := yaml_conf.Log
+	maxSize := cfg.MaxSize
+	if maxSize == 0 {
+		maxSize = 1000
+	}
+	dateSlice := cfg.DateSlice
+	if dateSlice == "" {
+		dateSlice = "d"
+	}
+	return &go_logger.FileConfig{
+		MaxSize:   maxSize * 1024 * 1024, // 字节
+		MaxLine:   cfg.MaxLine,
+		DateSlice: dateSlice,
+	}
+}
+
+// fatal 记录错误后退出
+func fatal(msg string, kv ...interface{}) {
+	logger.Error(msg, kv...)
+	logOutput.Flush()
+	os.Exit(1)
+}
+
+func getData(job *syncJob, in *jobInput) {
+	cfg := job.cfg
+	syncCount := cfg.SyncCount
+	for _, t := range in.targets {
+		cp := job.startCheckpoint(t)
+		t.mu.Lock()
+		t.cp = cp
+		t.mu.Unlock()
+	}
+	pos, reading := job.initPositions(in)
+	for _, t := range in.targets {
+		go runTarget(job, t)
+	}
+	var reset chan error
+	var term int64
 	for {
-		sourceClient, _ := getSourceClient()
-		targetClient, _ := getTargetClient()
-		/*
-			var query1 lib.EsQuery
-			query1 = map[string]interface{}{
-				"query": map[string]interface{}{
-					"range": map[string]interface{}{
-						source_field: map[string]interface{}{
-							"gte": 0,
-						},
-					},
-				},
-				"sort": map[string]interface{}{
-					source_field: map[string]string{
-						"order": "desc",
-					},
-				},
-				"from": 0,
-				"size": 1,
-			}*/
-		//res, err := lib.Search(target_client, yaml_conf.TargetEs.IndexName, query1)
-		matchQuery := lib.MatchQuery{}
-		res, err := lib.PageSort(targetClient, yaml_conf.TargetEs.IndexName, matchQuery, sourceField, "desc", 0, 1)
+		touch(&in.beat)
+		if reset != nil {
+			// 管理接口重置进度，在读取循环里做，避免和读写交错
+			err := job.resetInput(in)
+			pos, reading = job.initPositions(in)
+			reset <- err
+			reset = nil
+		}
+		if !job.running(in) {
+			reset = job.idle(in, 0)
+			continue
+		}
+		if t := in.term(); t != term {
+			// 新当选 leader 或认领了分区，接着之前的实例保存的进度同步
+			term = t
+			job.reloadInput(in)
+			pos, reading = job.initPositions(in)
+		}
+		pos, reading = job.rejoinTargets(in, pos, reading)
+		if !reading {
+			// 所有目标都在追赶，等有目标追上再读
+			reset = job.idle(in, time.Second*cfg.SyncInterval)
+			continue
+		}
+		begin := time.Now()
+		// 一轮读取一个 trace，各目标的写入 span 挂在它下面
+		ctx, span := tracer.Start(context.Background(), "sync.cycle", trace.WithAttributes(in.attrs...))
+		res_source, next, fetched, err := job.fetch(ctx, in, pos)
 		if err != nil {
-			logger.Error("lib.PageSort: " + err.Error())
+			withTrace(in.log, ctx).Error("Source.Fetch", "err", err)
+			job.recordError(in.key, err)
+			job.readErrorEvent(ctx, in, pos, err, time.Since(begin))
+		} else {
+			job.recordRun()
 		}
-		//log.Println(res.List[0])
-		sort_field_type := yaml_conf.SortFieldType
-		var begin_sort interface{}
-		if sort_field_type == "int64" {
-			begin_sort = 0
+		backlog := false
+		// 文件来源轮转、截断或整批被抽样掉时位置变了但没有数据，也要交给目标保存进度
+		if len(res_source) > 0 || (err == nil && !next.Equal(pos)) {
+			reading = job.dispatch(in, targetBatch{docs: res_source, from: pos, next: next, read: fetched, ctx: ctx})
+			pos = next
+			// 一批读满说明还有积压，不等待直接读下一批
+			backlog = reading && fetched >= syncCount
+		}
+		span.SetAttributes(attribute.Int("docs.read", fetched), attribute.Int("docs.dispatched", len(res_source)))
+		endSpan(span, err)
+		if backlog {
+			reset = job.idle(in, 0)
 		} else {
-			begin_sort = time.Date(1970, 1, 1, 1, 1, 1, 20, time.Local)
+			reset = job.idle(in, time.Second*cfg.SyncInterval)
 		}
+	}
+}
 
-		if len(res.List) > 0 {
-			//levsion需要配置calldate
-			begin_sort = res.List[0].CallDate
-		} else {
-			logKeepDay := yaml_conf.LogKeepDay
-			clearDate := time.Now().AddDate(0, 0, -logKeepDay)
-			if logKeepDay > 0 {
-				if sort_field_type == "int64" {
-					begin_sort = clearDate.Unix()
-				} else {
-					begin_sort = clearDate
-				}
+// startCheckpoint 目标开始同步的位置，没有保存的进度时从 log_keep_day 之前开始
+func (j *syncJob) startCheckpoint(t *jobTarget) lib.Checkpoint {
+	cp, found := j.lastCheckpoint(t)
+	if !found {
+		cp = j.defaultCheckpoint()
+	}
+	return cp
+}
 
-			}
+// defaultCheckpoint 从头同步的位置：log_keep_day 之前，不清理时从 1970 年开始
+func (j *syncJob) defaultCheckpoint() lib.Checkpoint {
+	cfg := j.cfg
+	sort_field_type := cfg.SortFieldType
+	var begin_sort interface{}
+	if sort_field_type == "int64" {
+		begin_sort = 0
+	} else {
+		begin_sort = time.Date(1970, 1, 1, 1, 1, 1, 20, time.Local)
+	}
+	logKeepDay := cfg.LogKeepDay
+	clearDate := time.Now().AddDate(0, 0, -logKeepDay)
+	if logKeepDay > 0 {
+		if sort_field_type == "int64" {
+			begin_sort = clearDate.Unix()
+		} else {
+			begin_sort = clearDate
 		}
 
-		matchQuery = map[string]interface{}{
-			"query": map[string]interface{}{
-				"range": map[string]interface{}{
-					sourceField: map[string]interface{}{
-						"gt": begin_sort,
-					},
-				},
-			},
-		}
-		res_source, err := lib.PageSort(sourceClient, yaml_conf.SourceEs.IndexName, matchQuery, sourceField, "desc", 0, syncCount)
-		if err != nil {
-			logger.Error("lib.PageSort: " + err.Error())
-		}
-		//log.Println(res_source.List)
-		if len(res_source.List) > 0 {
-			var wg sync.WaitGroup
-			for i, data := range res_source.List {
-				wg.Add(1)
-				docId := res_source.IdList[i]
-				go func() {
-					_, err = lib.Create(targetClient, yaml_conf.TargetEs.IndexName, data, docId, "_doc")
-					if err != nil {
-						logger.Error("lib.Create: " + err.Error())
-					}
-					defer wg.Done()
-					//log.Println(i, res_id)
-				}()
+	}
+	return lib.Checkpoint{Value: begin_sort}
+}
 
-			}
-			wg.Wait()
+// writeDocs 同步和导入共用的写入路径：依次执行目标的 transforms，再交给目标的 Sink 写入。
+// 每批有一个 batch_id，这一批的日志和同步记录都带上它
+func writeDocs(ctx context.Context, job *syncJob, o *jobOutput, log *lib.Logger, labels map[string]string, batchId string, docs []lib.Doc) (lib.BulkResult, error) {
+	log = withTrace(log.With("batch_id", batchId), ctx)
+	begin := time.Now()
+	n := len(docs)
+	docs, errs, res, err := o.write(ctx, docs, labels)
+	latency := time.Since(begin)
+	for _, err := range errs {
+		logDocError(log, "lib.ApplyTransforms", err)
+	}
+	if err != nil {
+		log.Error("Sink.Write", "docs", len(docs), "latency_ms", latency, "err", err)
+		lib.MetricAdd("essync_docs_failed_total", labels, float64(len(docs)+len(errs)))
+		return res, err
+	}
+	for _, e := range res.Errors {
+		logDocError(log, "Sink.Write", e)
+	}
+	// 转换失败的文档也算写入失败，和写入失败的一起进死信
+	for _, err := range errs {
+		if e, ok := err.(lib.DocError); ok {
+			res.Errors = append(res.Errors, e)
+		} else {
+			res.Errors = append(res.Errors, lib.DocError{Err: err.Error()})
 		}
-		time.Sleep(time.Second * yaml_conf.SyncInterval)
 	}
+	res.Failed += len(errs)
+	if len(res.RetryDocs()) == 0 {
+		// 还有可重写的失败时整批会重读，这时不进死信
+		o.deadLetter(log, labels, res.Errors)
+	}
+	log.Debug("batch written", "docs", n, "succeeded", res.Succeeded, "conflicts", res.Conflicts,
+		"failed", res.Failed, "latency_ms", latency)
+	lib.MetricAdd("essync_docs_written_total", labels, float64(res.Succeeded))
+	lib.MetricAdd("essync_docs_conflict_total", labels, float64(res.Conflicts))
+	lib.MetricAdd("essync_docs_failed_total", labels, float64(res.Failed))
+	return res, nil
 }
 
-func clearData() {
-	dateField := yaml_conf.DateField
-	dateFieldType := yaml_conf.DateFieldType
-	logKeepDay := yaml_conf.LogKeepDay
+func logDocError(log *lib.Logger, msg string, err error) {
+	if e, ok := err.(lib.DocError); ok {
+		log.Error(msg, "doc_id", e.Id, "err", e.Err)
+		return
+	}
+	log.Error(msg, "err", err)
+}
+
+// newBatchId 随机的批次 id，用来在日志里关联同一批的记录
+func newBatchId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func clearData(job *syncJob, o *jobOutput) {
+	cfg := job.cfg
+	dateField := cfg.DateField
+	dateFieldType := cfg.DateFieldType
+	logKeepDay := cfg.LogKeepDay
+	indexName := o.cfg.TargetEs.IndexName
+	targetClient := o.client
+	var lastTask string
+	var err error
 	for {
-		if yaml_conf.LogKeepDay <= 0 {
+		if cfg.LogKeepDay <= 0 {
 			break
 		}
-		targetClient, err := getTargetClient()
+		// 开启选主时只有 leader 清理，开启 sharding 时只有持有 0 号分区的实例清理
+		job.waitRetention()
+		if !o.isEsSink() {
+			purger, ok := o.sink.(lib.Purger)
+			if !ok {
+				o.rlog.Info("sink has no retention, skip", "sink", o.cfg.Sink.Type)
+				break
+			}
+			purgeData(job, o, purger)
+			time.Sleep(time.Second * cfg.ClearInterval)
+			continue
+		}
+		if lastTask == "" {
+			// 进程重启或其他实例发起的任务也要识别出来
+			lastTask, err = lib.RunningDeleteByQuery(targetClient, indexName)
+			if err != nil {
+				// 查不到是否已有任务在跑时本轮不清理，避免重复发起
+				o.rlog.Error("RunningDeleteByQuery", "err", err)
+				time.Sleep(time.Second * cfg.ClearInterval)
+				continue
+			}
+		}
+		if lastTask != "" {
+			if !waitDeleteTask(job, o, lastTask, time.Second*cfg.ClearInterval) {
+				o.rlog.Info("DeleteByQuery: previous task still running, skip", "task", lastTask)
+				continue
+			}
+			lastTask = ""
+		}
 		var dateSort interface{}
 		nowTime := time.Now()
 		clearDate := nowTime.AddDate(0, 0, -logKeepDay)
@@ -214,32 +474,199 @@ func clearData() {
 				},
 			},
 		}
-		_, err = lib.DeleteByQuery(targetClient, yaml_conf.TargetEs.IndexName, deleteQuery)
+		if cfg.Archive.Enabled {
+			// 只删除归档了的文档，归档之后才写入的过期数据留到下一轮归档
+			if docs, ok := archiveExpired(job, o, deleteQuery); ok {
+				deleteArchived(job, o, docs)
+			}
+			time.Sleep(time.Second * cfg.ClearInterval)
+			continue
+		}
+		dbq := cfg.DeleteByQuery
+		opts := lib.DeleteByQueryOptions{
+			WaitForCompletion: dbq.WaitForCompletion,
+			Slices:            dbq.Slices,
+			RequestsPerSecond: dbq.RequestsPerSecond,
+			Conflicts:         dbq.Conflicts,
+		}
+		begin := time.Now()
+		res, err := lib.DeleteByQuery(targetClient, indexName, deleteQuery, opts)
 		if err != nil {
-			logger.Error("DeleteByQuery: " + err.Error())
+			o.rlog.Error("DeleteByQuery", "err", err)
+			lib.MetricAdd("essync_delete_by_query_runs_total", o.resultLabels(job, "error"), 1)
+			job.recordRetention(o, "delete_by_query", "error", 0, err.Error(), time.Since(begin))
+		} else if res.Task != "" {
+			o.rlog.Info("DeleteByQuery: started task", "task", res.Task)
+			if !waitDeleteTask(job, o, res.Task, time.Second*cfg.ClearInterval) {
+				lastTask = res.Task
+				continue
+			}
+		} else {
+			recordDeleteResult(job, o, res)
+		}
+		time.Sleep(time.Second * cfg.ClearInterval)
+	}
+}
+
+// purgeData 非 elasticsearch 目标按 log_keep_day 清理
+func purgeData(job *syncJob, o *jobOutput, purger lib.Purger) {
+	cfg := job.cfg
+	var dateSort interface{}
+	clearDate := time.Now().AddDate(0, 0, -cfg.LogKeepDay)
+	if cfg.DateFieldType == "int64" {
+		dateSort = clearDate.Unix()
+	} else {
+		dateSort = clearDate
+	}
+	begin := time.Now()
+	deleted, err := purger.Purge(cfg.DateField, dateSort)
+	if err != nil {
+		o.rlog.Error("Purge", "err", err)
+		lib.MetricAdd("essync_purge_runs_total", o.resultLabels(job, "error"), 1)
+		job.recordRetention(o, "purge", "error", 0, err.Error(), time.Since(begin))
+		return
+	}
+	lib.MetricAdd("essync_purge_deleted_total", o.labels(job), float64(deleted))
+	lib.MetricAdd("essync_purge_runs_total", o.resultLabels(job, "success"), 1)
+	job.recordRetention(o, "purge", "success", deleted, "", time.Since(begin))
+	o.rlog.Info("Purge", "deleted", deleted, "latency_ms", time.Since(begin))
+}
+
+// archiveDir 目标的归档目录，扇出时每个目标一个子目录
+func archiveDir(job *syncJob, o *jobOutput) string {
+	if o.name != "" {
+		return filepath.Join(job.cfg.Archive.Dir, o.name)
+	}
+	return job.cfg.Archive.Dir
+}
+
+// archiveExpired 归档即将删除的数据，返回可以删除的文档；失败时返回 false，本轮不删除
+func archiveExpired(job *syncJob, o *jobOutput, deleteQuery lib.EsQuery) ([]lib.ArchivedDoc, bool) {
+	cfg := job.cfg
+	indexName := o.cfg.TargetEs.IndexName
+	dir := archiveDir(job, o)
+	scrollSize := cfg.Archive.ScrollSize
+	if scrollSize <= 0 {
+		scrollSize = 1000
+	}
+	begin := time.Now()
+	res, err := lib.ArchiveExpired(o.client, indexName, deleteQuery, cfg.DateField, dir, scrollSize)
+	if err != nil {
+		o.rlog.Error("ArchiveExpired", "err", err)
+		lib.MetricAdd("essync_archive_runs_total", o.resultLabels(job, "error"), 1)
+		job.recordRetention(o, "archive", "error", 0, err.Error(), time.Since(begin))
+		return nil, false
+	}
+	lib.MetricAdd("essync_archive_docs_total", o.labels(job), float64(res.Count))
+	lib.MetricAdd("essync_archive_runs_total", o.resultLabels(job, "success"), 1)
+	job.recordRetention(o, "archive", "success", res.Count, "", time.Since(begin))
+	for day, count := range res.Days {
+		o.rlog.Info("ArchiveExpired", "day", day, "docs", count)
+	}
+	o.rlog.Info("ArchiveExpired", "docs", res.Count, "dir", dir, "latency_ms", time.Since(begin))
+	return res.Docs, true
+}
+
+// deleteArchived 按 id 删除归档了的文档，没删掉的留在待删除列表里，下一轮不再归档，直接重新删除
+func deleteArchived(job *syncJob, o *jobOutput, docs []lib.ArchivedDoc) {
+	if len(docs) == 0 {
+		return
+	}
+	begin := time.Now()
+	deleted, pending, err := lib.DeleteArchived(o.client, archiveDir(job, o), o.cfg.TargetEs.IndexName, docs)
+	lib.MetricAdd("essync_archive_deleted_total", o.labels(job), float64(deleted))
+	log := o.rlog.With("docs", len(docs), "deleted", deleted, "pending", pending, "latency_ms", time.Since(begin))
+	switch {
+	case err != nil:
+		log.Error("DeleteArchived", "err", err)
+		lib.MetricAdd("essync_archive_delete_runs_total", o.resultLabels(job, "error"), 1)
+		job.recordRetention(o, "delete_archived", "error", deleted, err.Error(), time.Since(begin))
+	case pending > 0:
+		log.Error("DeleteArchived")
+		lib.MetricAdd("essync_archive_delete_runs_total", o.resultLabels(job, "partial"), 1)
+		job.recordRetention(o, "delete_archived", "partial", deleted, fmt.Sprintf("%d docs not deleted", pending), time.Since(begin))
+	default:
+		log.Info("DeleteArchived")
+		lib.MetricAdd("essync_archive_delete_runs_total", o.resultLabels(job, "success"), 1)
+		job.recordRetention(o, "delete_archived", "success", deleted, "", time.Since(begin))
+	}
+}
+
+// waitDeleteTask 轮询 delete_by_query 任务直到结束或超过 maxWait，任务结束返回 true
+func waitDeleteTask(job *syncJob, o *jobOutput, taskId string, maxWait time.Duration) bool {
+	cfg := job.cfg
+	pollInterval := time.Second * cfg.DeleteByQuery.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = time.Second * 10
+	}
+	lib.MetricSet("essync_delete_by_query_running", o.labels(job), 1)
+	deadline := time.Now().Add(maxWait)
+	for {
+		task, err := lib.GetTask(o.client, taskId)
+		if err != nil {
+			o.rlog.Error("GetTask", "task", taskId, "err", err)
+		} else if task.Completed {
+			lib.MetricSet("essync_delete_by_query_running", o.labels(job), 0)
+			if len(task.Error) > 0 {
+				o.rlog.Error("DeleteByQuery: task failed", "task", taskId, "err", string(task.Error))
+				lib.MetricAdd("essync_delete_by_query_runs_total", o.resultLabels(job, "error"), 1)
+				job.recordRetention(o, "delete_by_query", "error", 0, string(task.Error),
+					time.Duration(task.Task.RunningTimeInNanos))
+				return true
+			}
+			task.Response.Task = taskId
+			recordDeleteResult(job, o, task.Response)
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func recordDeleteResult(job *syncJob, o *jobOutput, res lib.DeleteByQueryResult) {
+	labels := o.labels(job)
+	lib.MetricAdd("essync_delete_by_query_deleted_total", labels, float64(res.Deleted))
+	lib.MetricAdd("essync_delete_by_query_failures_total", labels, float64(len(res.Failures)))
+	lib.MetricAdd("essync_delete_by_query_version_conflicts_total", labels, float64(res.VersionConflicts))
+	took := time.Duration(res.Took) * time.Millisecond
+	log := o.rlog.With("task", res.Task, "latency_ms", res.Took, "total", res.Total, "deleted", res.Deleted,
+		"conflicts", res.VersionConflicts, "failures", len(res.Failures))
+	if len(res.Failures) > 0 || res.TimedOut {
+		for _, f := range res.Failures {
+			o.rlog.Error("DeleteByQuery failure", "task", res.Task, "err", string(f))
 		}
-		time.Sleep(time.Second * yaml_conf.ClearInterval)
+		log.Error("DeleteByQuery", "timed_out", res.TimedOut)
+		lib.MetricAdd("essync_delete_by_query_runs_total", o.resultLabels(job, "partial"), 1)
+		job.recordRetention(o, "delete_by_query", "partial", res.Deleted, fmt.Sprintf("%d failures", len(res.Failures)), took)
+		return
 	}
+	log.Info("DeleteByQuery")
+	lib.MetricAdd("essync_delete_by_query_runs_total", o.resultLabels(job, "success"), 1)
+	job.recordRetention(o, "delete_by_query", "success", res.Deleted, "", took)
 }
 
-func getSourceClient() (*elasticsearch.Client, error) {
+func getSourceClient(esCfg conf.SourceEs) (*elasticsearch.Client, error) {
 	cfg := elasticsearch.Config{
-		Addresses: yaml_conf.SourceEs.Hosts,
+		Addresses: esCfg.Hosts,
+		Username:  esCfg.User,
+		Password:  esCfg.Password,
 		Transport: &http.Transport{
-			MaxIdleConns:          yaml_conf.SourceEs.HttpConfig.MaxIdleConns,                  //所有host的连接池缓存最大连接数量，默认无穷大
-			MaxIdleConnsPerHost:   yaml_conf.SourceEs.HttpConfig.MaxIdleConnsPerHost,           //每个host的连接池缓存最大空闲连接数
-			MaxConnsPerHost:       yaml_conf.SourceEs.HttpConfig.MaxConnsPerHost,               //对每个host的最大连接数量，0表示不限制
-			IdleConnTimeout:       time.Second * yaml_conf.SourceEs.HttpConfig.IdleConnTimeout, //how long an idle connection is kept in the connection pool.
-			ResponseHeaderTimeout: time.Second * yaml_conf.SourceEs.HttpConfig.ResponseHeaderTimeout,
+			MaxIdleConns:          esCfg.HttpConfig.MaxIdleConns,                  //所有host的连接池缓存最大连接数量，默认无穷大
+			MaxIdleConnsPerHost:   esCfg.HttpConfig.MaxIdleConnsPerHost,           //每个host的连接池缓存最大空闲连接数
+			MaxConnsPerHost:       esCfg.HttpConfig.MaxConnsPerHost,               //对每个host的最大连接数量，0表示不限制
+			IdleConnTimeout:       time.Second * esCfg.HttpConfig.IdleConnTimeout, //how long an idle connection is kept in the connection pool.
+			ResponseHeaderTimeout: time.Second * esCfg.HttpConfig.ResponseHeaderTimeout,
 			DialContext: (&net.Dialer{
-				Timeout:   time.Second * yaml_conf.SourceEs.HttpConfig.DialTimeout, //限制建立TCP连接的时间
-				KeepAlive: time.Second * yaml_conf.SourceEs.HttpConfig.DialKeepAlive,
+				Timeout:   time.Second * esCfg.HttpConfig.DialTimeout, //限制建立TCP连接的时间
+				KeepAlive: time.Second * esCfg.HttpConfig.DialKeepAlive,
 			}).DialContext,
 		},
 	}
 	es, err := elasticsearch.NewClient(cfg)
 	if err != nil {
-		logger.Error("getSourceClient: " + err.Error())
+		logger.Error("getSourceClient", "hosts", strings.Join(esCfg.Hosts, ","), "err", err)
 		return es, err
 	} else {
 		//log.Println(es.Info())
@@ -247,26 +674,26 @@ func getSourceClient() (*elasticsearch.Client, error) {
 	}
 }
 
-func getTargetClient() (*elasticsearch.Client, error) {
+func getTargetClient(esCfg conf.TargetEs) (*elasticsearch.Client, error) {
 	cfg := elasticsearch.Config{
-		Addresses: yaml_conf.TargetEs.Hosts,
-		Username:  yaml_conf.TargetEs.User,
-		Password:  yaml_conf.TargetEs.Password,
+		Addresses: esCfg.Hosts,
+		Username:  esCfg.User,
+		Password:  esCfg.Password,
 		Transport: &http.Transport{
-			MaxIdleConns:          yaml_conf.TargetEs.HttpConfig.MaxIdleConns,                  //所有host的连接池缓存最大连接数量，默认无穷大
-			MaxIdleConnsPerHost:   yaml_conf.TargetEs.HttpConfig.MaxIdleConnsPerHost,           //每个host的连接池缓存最大空闲连接数
-			MaxConnsPerHost:       yaml_conf.TargetEs.HttpConfig.MaxConnsPerHost,               //对每个host的最大连接数量，0表示不限制
-			IdleConnTimeout:       time.Second * yaml_conf.TargetEs.HttpConfig.IdleConnTimeout, //how long an idle connection is kept in the connection pool.
-			ResponseHeaderTimeout: time.Second * yaml_conf.TargetEs.HttpConfig.ResponseHeaderTimeout,
+			MaxIdleConns:          esCfg.HttpConfig.MaxIdleConns,                  //所有host的连接池缓存最大连接数量，默认无穷大
+			MaxIdleConnsPerHost:   esCfg.HttpConfig.MaxIdleConnsPerHost,           //每个host的连接池缓存最大空闲连接数
+			MaxConnsPerHost:       esCfg.HttpConfig.MaxConnsPerHost,               //对每个host的最大连接数量，0表示不限制
+			IdleConnTimeout:       time.Second * esCfg.HttpConfig.IdleConnTimeout, //how long an idle connection is kept in the connection pool.
+			ResponseHeaderTimeout: time.Second * esCfg.HttpConfig.ResponseHeaderTimeout,
 			DialContext: (&net.Dialer{
-				Timeout:   time.Second * yaml_conf.TargetEs.HttpConfig.DialTimeout, //限制建立TCP连接的时间
-				KeepAlive: time.Second * yaml_conf.TargetEs.HttpConfig.DialKeepAlive,
+				Timeout:   time.Second * esCfg.HttpConfig.DialTimeout, //限制建立TCP连接的时间
+				KeepAlive: time.Second * esCfg.HttpConfig.DialKeepAlive,
 			}).DialContext,
 		},
 	}
 	es, err := elasticsearch.NewClient(cfg)
 	if err != nil {
-		logger.Error("getTargetClient: " + err.Error())
+		logger.Error("getTargetClient", "hosts", strings.Join(esCfg.Hosts, ","), "err", err)
 		return es, err
 	} else {
 		//log.Println(es.Info())
@@ -283,19 +710,16 @@ func getLogNew(logFile string) int {
 	command.Stderr = &cmdStderr
 	err := command.Run()
 	if err != nil {
-		logger.Error("getLogNew: " + err.Error())
+		logger.Error("getLogNew", "err", err)
 		return errorNew
 	}
 	outString := cmdOut.String()
 	outList := strings.Split(outString, "\n")
 
 	if len(outList) >= 2 {
-		firstLine := outList[0]
-		timeString := firstLine[0:19]
-		lastT, _ := time.ParseInLocation("2006-01-02 15:04:05", timeString, time.Local)
-		lastInt := lastT.Unix()
-		nowInt := time.Now().Unix()
-		if nowInt-lastInt < 300 {
+		// 时间的位置取决于 log.format，解析不出来(空行、截断的行)时不算新错误
+		lastT, ok := lib.LogLineTime(outList[0])
+		if ok && time.Since(lastT) < 300*time.Second {
 			return 1
 		}
 	}
@@ -311,27 +735,27 @@ func SavePid() bool {
 		f, err1 = os.Create(pidFile) //创建文件
 		defer f.Close()
 		if err1 != nil {
-			logger.Error("SavePid-create: " + err1.Error())
+			logger.Error("SavePid-create", "err", err1)
 			return false
 		}
 	} else {
 		f, err1 = os.OpenFile(pidFile, os.O_CREATE, 0666)
 		defer f.Close()
 		if err1 != nil {
-			logger.Error("SavePid-open: " + err1.Error())
+			logger.Error("SavePid-open", "err", err1)
 			return false
 		}
 	}
 	pid := os.Getpid()
 	pidString := strconv.Itoa(pid)
 	if _, err = io.WriteString(f, pidString); err != nil {
-		logger.Error("SavePid-write: " + err.Error())
+		logger.Error("SavePid-write", "err", err)
 		return false
 	}
 	/*
 		byteString := []byte(pidString)
 		if err = ioutil.WriteFile(pidFile, byteString, 0666); err != nil {
-			logger.Error("SavePid: " + err.Error())
+			logger.Error("SavePid", "err", err)
 		}
 	*/
 	return true
@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+package service
+
+import (
+	"os"
+	"syscall"
+)
+
+// 监听的信号，SIGUSR2 触发热重启
+var notifySignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2}
+
+var reloadSignal os.Signal = syscall.SIGUSR2
+
+// nochdir 是 程序初始路径 1是当前路径，0是系统根目录
+// noclose 是 错误信息输出 1是输出当前， 0是不显示错误信息
+func daemonProcce(nochdir, noclose int) (int, error) {
+	// already a daemon
+	serviceLog.Debug("daemon", "ppid", syscall.Getppid())
+	//如果是守护进程 syscall.Getppid() = 1
+	if syscall.Getppid() == 1 {
+		/* Change the file mode mask */
+		syscall.Umask(0)
+		if nochdir == 0 {
+			os.Chdir("/")
+		}
+		return 0, nil
+	}
+
+	files := make([]*os.File, 3, 6)
+	if noclose == 0 {
+		nullDev, err := os.OpenFile("/dev/null", 0, 0)
+		if err != nil {
+			return 1, err
+		}
+		files[0], files[1], files[2] = nullDev, nullDev, nullDev
+	} else {
+		files[0], files[1], files[2] = os.Stdin, os.Stdout, os.Stderr
+	}
+
+	dir, _ := os.Getwd()
+	sysattrs := syscall.SysProcAttr{Setsid: true}
+	attrs := os.ProcAttr{Dir: dir, Env: os.Environ(), Files: files, Sys: &sysattrs}
+
+	proc, err := os.StartProcess(os.Args[0], os.Args, &attrs)
+	if err != nil {
+		return -1, err
+	}
+	proc.Release()
+	os.Exit(0)
+
+	return 0, nil
+
+}
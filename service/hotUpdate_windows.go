@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package service
+
+import (
+	"os"
+	"syscall"
+)
+
+// Windows 没有 SIGUSR2，不支持热重启，只处理退出信号
+var notifySignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+
+var reloadSignal os.Signal
+
+// daemonProcce Windows 上不脱离终端，直接在前台运行
+func daemonProcce(nochdir, noclose int) (int, error) {
+	return 0, nil
+}
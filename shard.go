@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"essync/lib"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"sort"
+	"sync"
+	"time"
+)
+
+// partitionDoc 分区任务的协调文档：存活的实例(每次心跳 beat 加一)和每个分区的持有者，持有者为空表示没有人持有
+type partitionDoc struct {
+	Type      string                `json:"type"`
+	Job       string                `json:"job"`
+	By        string                `json:"by"`
+	Count     int                   `json:"count"`
+	Workers   map[string]workerBeat `json:"workers"`
+	Owners    []string              `json:"owners"`
+	UpdatedAt time.Time             `json:"updated_at"`
+}
+
+type workerBeat struct {
+	Beat      int64     `json:"beat"`
+	RenewedAt time.Time `json:"renewed_at"`
+}
+
+// beatSeen 其他实例的心跳最近一次变化的时间(本机时钟)
+type beatSeen struct {
+	beat int64
+	at   time.Time
+}
+
+// shardWorker 本实例在分片同步里的身份，每 heartbeat 更新所有任务的协调文档。
+// 和选主一样，写入都带 if_seq_no/if_primary_term，实例心跳 ttl 内没有变化就被移除，不依赖各实例的时钟一致
+type shardWorker struct {
+	client    *elasticsearch.Client
+	index     string
+	identity  string
+	ttl       time.Duration
+	heartbeat time.Duration
+	log       *lib.Logger
+	jobs      []*jobPartitions
+}
+
+// sharding 没有开启 sharding 时为 nil，本实例同步所有分区
+var sharding *shardWorker
+
+// jobPartitions 任务的分区在本实例上的状态。没有配置 partition 的任务在开启 sharding 时算一个分区，整个任务由一个实例同步
+type jobPartitions struct {
+	job   *syncJob
+	by    string
+	count int
+	docId string
+	log   *lib.Logger
+
+	mu        sync.Mutex
+	stopped   bool
+	owned     []bool
+	terms     []int64 // 每次认领分区加一，读取循环据此重新加载进度
+	doc       lib.VersionedDoc
+	view      partitionDoc // 最近一次写入的协调文档
+	seen      map[string]beatSeen
+	lastWrite time.Time
+}
+
+func initSharding() error {
+	cfg := yaml_conf.Sharding
+	if !cfg.Enabled {
+		return nil
+	}
+	if yaml_conf.LeaderElection.Enabled {
+		return errors.New("sharding and leader_election can't both be enabled, sharding already moves partitions off stopped instances")
+	}
+	esCfg := cfg.TargetEs
+	if len(esCfg.Hosts) == 0 {
+		esCfg = yaml_conf.TargetEs
+	}
+	client, err := getTargetClient(esCfg)
+	if err != nil {
+		return err
+	}
+	w := &shardWorker{
+		client:    client,
+		index:     cfg.Index,
+		identity:  cfg.Identity,
+		ttl:       time.Second * cfg.Ttl,
+		heartbeat: time.Second * cfg.HeartbeatInterval,
+	}
+	if w.index == "" {
+		w.index = "essync-partitions"
+	}
+	if w.identity == "" {
+		w.identity = defaultIdentity()
+	}
+	if w.ttl <= 0 {
+		w.ttl = 30 * time.Second
+	}
+	if w.heartbeat <= 0 {
+		w.heartbeat = w.ttl / 3
+	}
+	if w.heartbeat >= w.ttl {
+		return errors.New("sharding.heartbeat_interval must be less than ttl")
+	}
+	w.log = lib.NewLogger("shard").With("identity", w.identity)
+	sharding = w
+	return nil
+}
+
+// newJobPartitions 按 partition 配置确定分区数：shard 为来源索引的主分片数，id_hash 为 count
+func newJobPartitions(job *syncJob) (*jobPartitions, error) {
+	cfg := job.cfg
+	p := &jobPartitions{job: job, by: cfg.Partition.By, count: 1, docId: "partitions:" + cfg.Name}
+	switch p.by {
+	case "":
+	case "shard", "id_hash":
+		if len(cfg.Sources) > 0 {
+			return nil, errors.New("partition needs a single source, not sources")
+		}
+		if cfg.Source.Type != "" && cfg.Source.Type != "elasticsearch" {
+			return nil, errors.New("partition needs an elasticsearch source")
+		}
+		if p.by == "id_hash" {
+			if cfg.Partition.Count < 2 {
+				return nil, fmt.Errorf("partition.count must be at least 2 for id_hash: %d", cfg.Partition.Count)
+			}
+			p.count = cfg.Partition.Count
+			break
+		}
+		client, err := getSourceClient(cfg.SourceEs)
+		if err != nil {
+			return nil, err
+		}
+		// 分区数只在启动时确定，别名或通配符以后可能匹配到分片更多的索引，所以只接受具体的索引
+		if p.count, err = lib.PrimaryShards(client, cfg.SourceEs.IndexName); err != nil {
+			return nil, fmt.Errorf("partition.by shard: %v, use id_hash for aliases and patterns", err)
+		}
+	default:
+		return nil, errors.New("partition.by must be shard or id_hash: " + p.by)
+	}
+	p.owned = make([]bool, p.count)
+	p.terms = make([]int64, p.count)
+	p.seen = map[string]beatSeen{}
+	p.log = job.log
+	if sharding == nil {
+		// 只有本实例，所有分区都在本实例上并行同步
+		for i := range p.owned {
+			p.owned[i] = true
+		}
+		return p, nil
+	}
+	p.log = sharding.log.With("job", cfg.Name)
+	sharding.jobs = append(sharding.jobs, p)
+	lib.MetricSet("essync_partitions_owned", job.labels(), 0)
+	return p, nil
+}
+
+// partition 分区 i 在 lib 里的读取参数，任务没有分区时为 nil
+func (p *jobPartitions) partition(i int) *lib.Partition {
+	if p == nil || p.by == "" {
+		return nil
+	}
+	return &lib.Partition{By: p.by, Id: i, Max: p.count}
+}
+
+func (p *jobPartitions) owns(i int) bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.owned[i]
+}
+
+// validUntil 持有的分区最晚写到什么时候：最近一次写成协调文档之后 ttl - heartbeat_interval；
+// ok 为 false 表示没有开启 sharding
+func (p *jobPartitions) validUntil() (until time.Time, ok bool) {
+	if p == nil {
+		return until, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastWrite.Add(sharding.ttl - sharding.heartbeat), true
+}
+
+// ownsAny 本实例是否持有任务的至少一个分区
+func (p *jobPartitions) ownsAny() bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, owned := range p.owned {
+		if owned {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *jobPartitions) term(i int) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.terms[i]
+}
+
+// owner 协调文档里分区 i 的持有者，没有开启 sharding 时为空
+func (p *jobPartitions) owner(i int) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if i < len(p.view.Owners) {
+		return p.view.Owners[i]
+	}
+	return ""
+}
+
+// owned 来源所在的分区由本实例同步
+func (in *jobInput) owned() bool {
+	return in.parts.owns(in.partition)
+}
+
+// writable 本实例还是 leader、持有来源所在的分区，而且租约和心跳到 now 还没有过期。
+// 续约卡住时 isLeader 和 owned 要等请求超时才会变，写入目标前按时间再确认一次
+func (in *jobInput) writable(now time.Time) bool {
+	if !isLeader() || !in.owned() {
+		return false
+	}
+	if until, ok := leaseValidUntil(); ok && !now.Before(until) {
+		return false
+	}
+	if until, ok := in.parts.validUntil(); ok && !now.Before(until) {
+		return false
+	}
+	return true
+}
+
+// term 读取循环据此在成为 leader 或认领分区后重新加载进度
+func (in *jobInput) term() int64 {
+	if in.parts != nil {
+		return in.parts.term(in.partition)
+	}
+	return leaderTerm()
+}
+
+// waitRetention 开启选主时等本实例成为 leader；开启 sharding 时由持有 0 号分区的实例清理
+func (j *syncJob) waitRetention() {
+	waitLeader()
+	for !j.parts.owns(0) {
+		<-j.wakeChan()
+	}
+}
+
+func (w *shardWorker) run() {
+	w.log.Info("sharding started", "index", w.index, "ttl", w.ttl.String(), "heartbeat_interval", w.heartbeat.String())
+	for {
+		for _, p := range w.jobs {
+			// 多个实例同时心跳时冲突，重新读一次再写
+			for i := 0; i < 3 && p.step(time.Now()); i++ {
+			}
+		}
+		time.Sleep(w.heartbeat)
+	}
+}
+
+// callContext 协调文档请求的超时：不超过 ttl - heartbeat_interval，持有分区时也不超过必须写成功的时间
+func (p *jobPartitions) callContext(now time.Time) (context.Context, context.CancelFunc) {
+	deadline := now.Add(sharding.ttl - sharding.heartbeat)
+	if p.ownsAny() {
+		p.mu.Lock()
+		if d := p.lastWrite.Add(sharding.ttl - sharding.heartbeat); d.Before(deadline) {
+			deadline = d
+		}
+		p.mu.Unlock()
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+// step 更新心跳，移除 ttl 内心跳没有变化的实例，按存活的实例重新分配分区后写回；版本冲突时返回 true
+func (p *jobPartitions) step(now time.Time) bool {
+	w := sharding
+	ctx, cancel := p.callContext(now)
+	defer cancel()
+	doc, err := lib.GetVersioned(ctx, w.client, w.index, p.docId)
+	if err != nil {
+		p.log.Error("get partitions", "err", err)
+		p.checkRenewed(time.Now())
+		return false
+	}
+	var d partitionDoc
+	if doc.Found {
+		if err := json.Unmarshal(doc.Source, &d); err != nil {
+			p.log.Error("decode partitions", "err", err)
+			return false
+		}
+	}
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return false
+	}
+	expired := p.prune(&d, now)
+	others := len(d.Workers)
+	if _, ok := d.Workers[w.identity]; ok {
+		others--
+	}
+	if doc.Found && (d.By != p.by || d.Count != p.count) && others > 0 {
+		p.mu.Unlock()
+		// 分区方式不同时各实例的进度对不上，等其他实例停掉或改成一样的配置
+		p.log.Error("partition layout differs from running workers", "by", d.By, "count", d.Count)
+		p.dropAll("partition layout differs")
+		return false
+	}
+	if doc.Found && (d.By != p.by || d.Count != p.count) {
+		// 其他实例都停了，按本实例的配置重新分区
+		d.Owners = nil
+	}
+	if d.Workers == nil {
+		d.Workers = map[string]workerBeat{}
+	}
+	if len(d.Owners) != p.count {
+		d.Owners = make([]string, p.count)
+	}
+	d.Type, d.Job, d.By, d.Count, d.UpdatedAt = "partitions", p.job.cfg.Name, p.by, p.count, now
+	d.Workers[w.identity] = workerBeat{Beat: d.Workers[w.identity].Beat + 1, RenewedAt: now}
+	members := make([]string, 0, len(d.Workers))
+	for id := range d.Workers {
+		members = append(members, id)
+	}
+	sort.Strings(members)
+	var released []int
+	for i, owner := range d.Owners {
+		if _, ok := d.Workers[owner]; !ok {
+			// 持有者已经不在了
+			owner = ""
+		}
+		want := members[i%len(members)]
+		switch {
+		case owner == w.identity && want != w.identity:
+			// 交给新的实例，先在本地停下再写协调文档
+			owner = ""
+			if p.owned[i] {
+				p.owned[i] = false
+				released = append(released, i)
+			}
+		case owner == "" && want == w.identity:
+			owner = w.identity
+		}
+		d.Owners[i] = owner
+	}
+	p.mu.Unlock()
+	for _, id := range expired {
+		p.log.Warn("worker expired", "worker", id)
+	}
+	if len(released) > 0 {
+		p.log.Info("partitions released", "partitions", fmt.Sprint(released), "workers", len(members))
+		p.changed()
+	}
+	next, err := lib.PutVersioned(ctx, w.client, w.index, p.docId, d, doc)
+	if err == lib.ErrVersionConflict {
+		// 一直冲突也算没有写成功，同样要在过期前放下分区
+		p.checkRenewed(time.Now())
+		return true
+	}
+	if err != nil {
+		p.log.Error("write partitions", "err", err)
+		p.checkRenewed(time.Now())
+		return false
+	}
+	var claimed []int
+	p.mu.Lock()
+	p.doc, p.view, p.lastWrite = next, d, now
+	for i, owner := range d.Owners {
+		if owner == w.identity && !p.owned[i] {
+			p.owned[i] = true
+			p.terms[i]++
+			claimed = append(claimed, i)
+		}
+	}
+	p.mu.Unlock()
+	if len(claimed) > 0 {
+		p.log.Info("partitions claimed", "partitions", fmt.Sprint(claimed), "workers", len(members))
+		lib.MetricAdd("essync_partition_claims_total", p.job.labels(), float64(len(claimed)))
+		p.changed()
+	}
+	return false
+}
+
+// prune 去掉心跳 ttl 内没有变化的其他实例，返回去掉的实例；调用时持有 p.mu
+func (p *jobPartitions) prune(d *partitionDoc, now time.Time) []string {
+	var expired []string
+	for id, b := range d.Workers {
+		if id == sharding.identity {
+			continue
+		}
+		s, ok := p.seen[id]
+		if !ok || s.beat != b.Beat {
+			p.seen[id] = beatSeen{beat: b.Beat, at: now}
+			continue
+		}
+		if now.Sub(s.at) >= sharding.ttl {
+			delete(d.Workers, id)
+			expired = append(expired, id)
+		}
+	}
+	for id := range p.seen {
+		if _, ok := d.Workers[id]; !ok {
+			delete(p.seen, id)
+		}
+	}
+	return expired
+}
+
+// checkRenewed 协调文档写入失败时，超过 ttl - heartbeat_interval 没有写成功就放下所有分区，
+// 保证在其他实例认为本实例不在了之前停止写入
+func (p *jobPartitions) checkRenewed(now time.Time) {
+	p.mu.Lock()
+	expired := now.Sub(p.lastWrite) >= sharding.ttl-sharding.heartbeat
+	p.mu.Unlock()
+	if expired {
+		p.dropAll("heartbeat not renewed in time")
+	}
+}
+
+// dropAll 本地停掉所有分区，协调文档里的持有者由其他实例在本实例过期后清掉
+func (p *jobPartitions) dropAll(reason string) {
+	p.mu.Lock()
+	dropped := false
+	for i := range p.owned {
+		dropped = dropped || p.owned[i]
+		p.owned[i] = false
+	}
+	p.mu.Unlock()
+	if dropped {
+		p.log.Warn("partitions dropped", "reason", reason)
+		p.changed()
+	}
+}
+
+// changed 分区变化后更新指标，唤醒任务的读取、写入和清理循环
+func (p *jobPartitions) changed() {
+	p.mu.Lock()
+	n := 0
+	for _, owned := range p.owned {
+		if owned {
+			n++
+		}
+	}
+	p.mu.Unlock()
+	lib.MetricSet("essync_partitions_owned", p.job.labels(), float64(n))
+	p.job.wakeAll()
+}
+
+// release 退出前把本实例从协调文档里去掉，其他实例不用等 ttl 就能接管分区
+func (w *shardWorker) release() {
+	if w == nil {
+		return
+	}
+	for _, p := range w.jobs {
+		p.mu.Lock()
+		p.stopped = true
+		p.mu.Unlock()
+		p.dropAll("shutdown")
+		for i := 0; i < 3; i++ {
+			err := p.leave()
+			if err == lib.ErrVersionConflict {
+				continue
+			}
+			if err != nil {
+				p.log.Error("leave", "err", err)
+			} else {
+				p.log.Info("left partitions")
+			}
+			break
+		}
+	}
+}
+
+func (p *jobPartitions) leave() error {
+	w := sharding
+	ctx, cancel := context.WithTimeout(context.Background(), w.ttl-w.heartbeat)
+	defer cancel()
+	doc, err := lib.GetVersioned(ctx, w.client, w.index, p.docId)
+	if err != nil || !doc.Found {
+		return err
+	}
+	var d partitionDoc
+	if err := json.Unmarshal(doc.Source, &d); err != nil {
+		return err
+	}
+	if _, ok := d.Workers[w.identity]; !ok {
+		return nil
+	}
+	delete(d.Workers, w.identity)
+	for i, owner := range d.Owners {
+		if owner == w.identity {
+			d.Owners[i] = ""
+		}
+	}
+	d.UpdatedAt = time.Now()
+	_, err = lib.PutVersioned(ctx, w.client, w.index, p.docId, d, doc)
+	return err
+}
+
+type partitionsStatus struct {
+	Job      string   `json:"job"`
+	By       string   `json:"by,omitempty"`
+	Count    int      `json:"count"`
+	Owned    []int    `json:"owned"`
+	Owners   []string `json:"owners,omitempty"`
+	Workers  []string `json:"workers,omitempty"`
+	Identity string   `json:"identity,omitempty"`
+}
+
+// partitionsView 各任务的分区和持有者，GET /partitions 用
+func partitionsView() []partitionsStatus {
+	list := []partitionsStatus{}
+	for _, job := range jobs {
+		p := job.parts
+		if p == nil {
+			continue
+		}
+		p.mu.Lock()
+		s := partitionsStatus{Job: job.cfg.Name, By: p.by, Count: p.count, Owned: []int{}, Owners: p.view.Owners}
+		for i, owned := range p.owned {
+			if owned {
+				s.Owned = append(s.Owned, i)
+			}
+		}
+		for id := range p.view.Workers {
+			s.Workers = append(s.Workers, id)
+		}
+		p.mu.Unlock()
+		sort.Strings(s.Workers)
+		if sharding != nil {
+			s.Identity = sharding.identity
+		}
+		list = append(list, s)
+	}
+	return list
+}
+
+// partitionKey 分区的进度 key：key@分区/分区数，分区数变了之后旧的进度不会被误用
+func partitionKey(key string, p *lib.Partition) string {
+	if p == nil {
+		return key
+	}
+	return fmt.Sprintf("%s@%d/%d", key, p.Id, p.Max)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"essync/conf"
+	"essync/lib"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// versionedEs 只有一个文档的集群，写入按 if_seq_no 和 op_type=create 检查版本
+type versionedEs struct {
+	mu     sync.Mutex
+	source json.RawMessage
+	seqNo  int64
+}
+
+func (f *versionedEs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	reply := func(status int, v interface{}) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Path == "/" {
+			reply(200, map[string]interface{}{"version": map[string]string{"number": "7.16.0"}})
+		} else if f.source == nil {
+			reply(404, map[string]bool{"found": false})
+		} else {
+			reply(200, map[string]interface{}{"found": true, "_seq_no": f.seqNo, "_primary_term": 1, "_source": f.source})
+		}
+	case http.MethodPut, http.MethodPost:
+		q := r.URL.Query()
+		if q.Get("op_type") == "create" && f.source != nil || q.Get("if_seq_no") != "" && q.Get("if_seq_no") != strconv.FormatInt(f.seqNo, 10) {
+			reply(409, map[string]string{"error": "version_conflict_engine_exception"})
+			return
+		}
+		f.source, _ = ioutil.ReadAll(r.Body)
+		f.seqNo++
+		reply(200, map[string]interface{}{"_seq_no": f.seqNo, "_primary_term": 1})
+	default:
+		reply(400, map[string]string{"error": r.Method})
+	}
+}
+
+// testWorker 一个实例：同一个进程里轮流把 sharding 换成各自的身份
+type testWorker struct {
+	w *shardWorker
+	p *jobPartitions
+}
+
+func newTestWorkers(t *testing.T, count int, ids ...string) []*testWorker {
+	srv := httptest.NewServer(&versionedEs{})
+	t.Cleanup(srv.Close)
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := sharding
+	t.Cleanup(func() { sharding = prev })
+	var workers []*testWorker
+	for _, id := range ids {
+		job := &syncJob{cfg: &conf.Job{Name: "j"}, wake: make(chan struct{})}
+		w := &shardWorker{client: client, index: "essync-partitions", identity: id, ttl: 30 * time.Second,
+			heartbeat: 10 * time.Second, log: lib.NewLogger("shard")}
+		p := &jobPartitions{job: job, by: "id_hash", count: count, docId: "partitions:j", log: w.log,
+			owned: make([]bool, count), terms: make([]int64, count), seen: map[string]beatSeen{}}
+		workers = append(workers, &testWorker{w: w, p: p})
+	}
+	return workers
+}
+
+// step 以这个实例的身份心跳一次，版本冲突时像 run 一样重试
+func (tw *testWorker) step(t *testing.T, now time.Time) {
+	t.Helper()
+	sharding = tw.w
+	for i := 0; i < 3 && tw.p.step(now); i++ {
+	}
+}
+
+func (tw *testWorker) ownedString() string {
+	tw.p.mu.Lock()
+	defer tw.p.mu.Unlock()
+	s := ""
+	for i, owned := range tw.p.owned {
+		if owned {
+			s += strconv.Itoa(i)
+		}
+	}
+	return s
+}
+
+func TestPartitionAssignment(t *testing.T) {
+	ws := newTestWorkers(t, 4, "a", "b")
+	a, b := ws[0], ws[1]
+	base := time.Now()
+	steps := []struct {
+		name   string
+		worker *testWorker
+		at     time.Duration
+		a, b   string
+	}{
+		{"a alone takes every partition", a, 0, "0123", ""},
+		// b 要分到的分区还在 a 手上，a 先放下，b 下一次心跳再认领
+		{"b joins", b, time.Second, "0123", ""},
+		{"a hands over", a, 2 * time.Second, "02", ""},
+		{"b claims", b, 3 * time.Second, "02", "13"},
+		{"stable", a, 12 * time.Second, "02", "13"},
+		// a 在 12s 时最后一次看到 b 的心跳变化，之后 ttl 内没有变化，a 移除 b 并接管它的分区
+		{"b still inside ttl", a, 41 * time.Second, "02", "13"},
+		{"b expired", a, 42 * time.Second, "0123", "13"},
+	}
+	for _, s := range steps {
+		s.worker.step(t, base.Add(s.at))
+		if got := fmt.Sprintf("%s/%s", a.ownedString(), b.ownedString()); got != s.a+"/"+s.b {
+			t.Fatalf("%s: a/b own %s, want %s/%s", s.name, got, s.a, s.b)
+		}
+	}
+	a.p.mu.Lock()
+	defer a.p.mu.Unlock()
+	// 0、2 认领过一次，1、3 交出去又认领回来，进度要重新加载
+	if fmt.Sprint(a.p.terms) != "[1 2 1 2]" {
+		t.Fatalf("terms %v", a.p.terms)
+	}
+	if _, ok := a.p.view.Workers["b"]; ok || a.p.view.Owners[1] != "a" {
+		t.Fatalf("document %+v", a.p.view)
+	}
+}
+
+func TestPartitionPrune(t *testing.T) {
+	ws := newTestWorkers(t, 2, "a")
+	p := ws[0].p
+	sharding = ws[0].w
+	base := time.Now()
+	d := partitionDoc{Workers: map[string]workerBeat{"a": {Beat: 5}, "b": {Beat: 1}, "c": {Beat: 7}}}
+	tests := []struct {
+		at      time.Duration
+		beats   map[string]int64
+		expired string
+	}{
+		{0, nil, "[]"},
+		// b 的心跳变了，重新计时；c 一直没变
+		{20 * time.Second, map[string]int64{"b": 2}, "[]"},
+		{30 * time.Second, nil, "[c]"},
+		{49 * time.Second, nil, "[]"},
+		{50 * time.Second, nil, "[b]"},
+	}
+	for _, tt := range tests {
+		for id, beat := range tt.beats {
+			d.Workers[id] = workerBeat{Beat: beat}
+		}
+		if got := fmt.Sprint(p.prune(&d, base.Add(tt.at))); got != tt.expired {
+			t.Fatalf("at %s expired %s, want %s", tt.at, got, tt.expired)
+		}
+	}
+	// 自己不会被移除，移除的实例也不再记录
+	if _, ok := d.Workers["a"]; !ok || len(d.Workers) != 1 || len(p.seen) != 0 {
+		t.Fatalf("workers %v, seen %v", d.Workers, p.seen)
+	}
+}
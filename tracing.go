@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"essync/lib"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+	"time"
+)
+
+// tracer 没有配置 tracing.exporter 时是 otel 默认的空实现，span 不记录也没有 trace id
+var tracer = otel.Tracer("essync")
+
+// tracerShutdown 退出前把缓冲的 span 发完
+var tracerShutdown = func(ctx context.Context) error { return nil }
+
+// initTracing 按 tracing 配置设置全局 TracerProvider：otlp 用 http 发到 collector，file 每行一个 span 的 json
+func initTracing() error {
+	cfg := yaml_conf.Tracing
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "", "none":
+		return nil
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.UrlPath != "" {
+			opts = append(opts, otlptracehttp.WithURLPath(cfg.UrlPath))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case "file":
+		if cfg.File == "" {
+			return errors.New("tracing.file is required for the file exporter")
+		}
+		var f *os.File
+		if f, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+			return err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return fmt.Errorf("unknown tracing.exporter %q, want otlp or file", cfg.Exporter)
+	}
+	if err != nil {
+		return err
+	}
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "essync"
+	}
+	ratio := cfg.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	attrs := []attribute.KeyValue{attribute.String("service.name", serviceName)}
+	if host, err := os.Hostname(); err == nil {
+		attrs = append(attrs, attribute.String("host.name", host))
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Error("tracing", "err", err)
+	}))
+	tracerShutdown = tp.Shutdown
+	return nil
+}
+
+func shutdownTracing() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tracerShutdown(ctx); err != nil {
+		logger.Error("tracing shutdown", "err", err)
+	}
+}
+
+// endSpan 结束 span，出错时记录错误并把状态设为 Error
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceId 当前 span 的 trace id，没有在记录时为空
+func traceId(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// withTrace 日志带上 trace_id，方便从日志找到对应的 trace
+func withTrace(log *lib.Logger, ctx context.Context) *lib.Logger {
+	if id := traceId(ctx); id != "" {
+		return log.With("trace_id", id)
+	}
+	return log
+}